@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultChannel is the release channel of an agent without -channel
+const defaultChannel = "stable"
+
+var channelNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// ManifestIndex can be served at the config URL instead of a version.yaml.
+// It names the version of every release channel and where the config of
+// each version is:
+//
+//	channels:
+//	  stable: "1.2.0"
+//	  beta: "1.3.0-beta.2"
+//	versions:
+//	  "1.2.0": "releases/1.2.0/version.yaml"
+//	  "1.3.0-beta.2": "releases/1.3.0-beta.2/version.yaml"
+type ManifestIndex struct {
+	Channels map[string]string `yaml:"channels"` // channel name -> version
+	Versions map[string]string `yaml:"versions"` // version -> config URL, relative to the index URL
+}
+
+// parseManifestIndex decodes a manifest index. It returns nil when body is
+// a plain config.
+func parseManifestIndex(body []byte) (*ManifestIndex, error) {
+	var idx ManifestIndex
+	if err := yaml.Unmarshal(body, &idx); err != nil {
+		return nil, fmt.Errorf("decode yaml: %w", err)
+	}
+	if idx.Channels == nil {
+		return nil, nil
+	}
+	return &idx, nil
+}
+
+// resolve returns the version of channel and the absolute URL of its config
+func (idx *ManifestIndex) resolve(channel, indexURL string) (string, string, error) {
+	version, ok := idx.Channels[channel]
+	if !ok {
+		return "", "", fmt.Errorf("channel %q is not in the manifest index", channel)
+	}
+	ref, ok := idx.Versions[version]
+	if !ok || ref == "" {
+		return "", "", fmt.Errorf("version %s of channel %s is not in the manifest index versions", version, channel)
+	}
+	base, err := url.Parse(indexURL)
+	if err != nil {
+		return "", "", err
+	}
+	u, err := base.Parse(ref)
+	if err != nil {
+		return "", "", fmt.Errorf("versions[%s]: %w", version, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", "", fmt.Errorf("versions[%s] must be http:// or https://", version)
+	}
+	return version, u.String(), nil
+}
+
+// channelSelector picks the release channel of the agent. The channel
+// file, written by the control API or by hand, overrides the -channel
+// flag; it is read on every check, so changing it needs no restart.
+type channelSelector struct {
+	Default string // -channel, defaultChannel if empty
+	File    string // channel file, empty to disable
+}
+
+// Current returns the channel the next check resolves
+func (c channelSelector) Current() (string, error) {
+	if c.File != "" {
+		b, err := os.ReadFile(c.File)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if name := strings.TrimSpace(string(b)); name != "" {
+			if !channelNameRegex.MatchString(name) {
+				return "", fmt.Errorf("%s: invalid channel name %q", c.File, name)
+			}
+			return name, nil
+		}
+	}
+	if c.Default != "" {
+		return c.Default, nil
+	}
+	return defaultChannel, nil
+}
+
+// Set writes name to the channel file; an empty name removes the file so
+// that the -channel flag applies again
+func (c channelSelector) Set(name string) error {
+	if c.File == "" {
+		return fmt.Errorf("no channel file configured")
+	}
+	if name == "" {
+		if err := os.Remove(c.File); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if !channelNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid channel name %q", name)
+	}
+	tmp := c.File + ".tmp"
+	if err := os.WriteFile(tmp, []byte(name+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.File)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseManifestIndex(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantIndex bool
+		wantErr   bool
+	}{
+		{name: "plain config", body: "version: \"1.2.0\"\nfiles: []\n"},
+		{name: "index", body: "channels:\n  stable: \"1.2.0\"\nversions:\n  \"1.2.0\": releases/1.2.0/version.yaml\n", wantIndex: true},
+		{name: "index without versions", body: "channels:\n  stable: \"1.2.0\"\n", wantIndex: true},
+		{name: "not yaml", body: "channels: [", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx, err := parseManifestIndex([]byte(tt.body))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseManifestIndex succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseManifestIndex: %v", err)
+			}
+			if (idx != nil) != tt.wantIndex {
+				t.Errorf("parseManifestIndex index = %v, want index %v", idx, tt.wantIndex)
+			}
+		})
+	}
+}
+
+func TestManifestIndexResolve(t *testing.T) {
+	idx := &ManifestIndex{
+		Channels: map[string]string{
+			"stable":  "1.2.0",
+			"beta":    "1.3.0-beta.2",
+			"canary":  "1.4.0",
+			"nightly": "1.5.0",
+			"ftp":     "1.6.0",
+			"empty":   "1.7.0",
+		},
+		Versions: map[string]string{
+			"1.2.0":        "releases/1.2.0/version.yaml",
+			"1.3.0-beta.2": "/ota/app1/releases/1.3.0-beta.2/version.yaml",
+			"1.4.0":        "https://cdn.example.com/app1/1.4.0/version.yaml",
+			"1.6.0":        "ftp://example.com/1.6.0/version.yaml",
+			"1.7.0":        "",
+		},
+	}
+	const indexURL = "http://server.com/ota/app1/version.yaml"
+	tests := []struct {
+		channel     string
+		wantVersion string
+		wantURL     string
+		wantErr     string
+	}{
+		{channel: "stable", wantVersion: "1.2.0", wantURL: "http://server.com/ota/app1/releases/1.2.0/version.yaml"},
+		{channel: "beta", wantVersion: "1.3.0-beta.2", wantURL: "http://server.com/ota/app1/releases/1.3.0-beta.2/version.yaml"},
+		{channel: "canary", wantVersion: "1.4.0", wantURL: "https://cdn.example.com/app1/1.4.0/version.yaml"},
+		{channel: "lts", wantErr: `channel "lts" is not in the manifest index`},
+		{channel: "nightly", wantErr: "version 1.5.0 of channel nightly is not in the manifest index versions"},
+		{channel: "empty", wantErr: "version 1.7.0 of channel empty is not in the manifest index versions"},
+		{channel: "ftp", wantErr: "must be http:// or https://"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.channel, func(t *testing.T) {
+			version, u, err := idx.resolve(tt.channel, indexURL)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolve error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve: %v", err)
+			}
+			if version != tt.wantVersion || u != tt.wantURL {
+				t.Errorf("resolve = %q, %q, want %q, %q", version, u, tt.wantVersion, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestChannelSelectorCurrent(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		name     string
+		selector channelSelector
+		want     string
+		wantErr  bool
+	}{
+		{name: "default", selector: channelSelector{}, want: "stable"},
+		{name: "flag", selector: channelSelector{Default: "beta"}, want: "beta"},
+		{name: "missing file", selector: channelSelector{Default: "beta", File: filepath.Join(dir, "missing")}, want: "beta"},
+		{name: "file overrides flag", selector: channelSelector{Default: "beta", File: write("canary", "canary\n")}, want: "canary"},
+		{name: "empty file", selector: channelSelector{Default: "beta", File: write("empty", " \n")}, want: "beta"},
+		{name: "invalid name in file", selector: channelSelector{File: write("invalid", "no/such channel\n")}, wantErr: true},
+		{name: "file is a directory", selector: channelSelector{File: dir}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.selector.Current()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Current = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Current: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Current = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChannelSelectorSet(t *testing.T) {
+	c := channelSelector{Default: "stable", File: filepath.Join(t.TempDir(), "channel")}
+	if err := c.Set("beta"); err != nil {
+		t.Fatalf("Set(beta): %v", err)
+	}
+	if got, _ := c.Current(); got != "beta" {
+		t.Errorf("Current after Set(beta) = %q, want beta", got)
+	}
+	if err := c.Set("../beta"); err == nil {
+		t.Errorf("Set(../beta) succeeded, want an error")
+	}
+	if err := c.Set(""); err != nil {
+		t.Fatalf("Set(\"\"): %v", err)
+	}
+	if _, err := os.Stat(c.File); !os.IsNotExist(err) {
+		t.Errorf("channel file still exists after Set(\"\"): %v", err)
+	}
+	if got, _ := c.Current(); got != "stable" {
+		t.Errorf("Current after Set(\"\") = %q, want stable", got)
+	}
+	if err := (channelSelector{}).Set("beta"); err == nil {
+		t.Errorf("Set without a channel file succeeded, want an error")
+	}
+}
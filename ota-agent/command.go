@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Command is a program with its arguments. In the config it is written
+// either as a string, split with POSIX shell quoting rules, or as an
+// explicit argv list:
+//
+//	restart_cmd: '/usr/bin/app --name "my app"'
+//	restart_cmd: ["/usr/bin/app", "--name", "my app"]
+//
+// The string form may start with NAME=value environment assignments. No
+// shell is involved: variables are not expanded and pipes, redirections
+// and command lists are rejected; use ["sh", "-c", "..."] for those.
+type Command struct {
+	Env  []string // NAME=value assignments in front of the program
+	Argv []string // program and arguments
+}
+
+// shellSpecial are characters with a meaning to the shell that a plain
+// command line cannot express
+const shellSpecial = "|&;<>()$`"
+
+// ParseCommand splits a command line with POSIX shell quoting rules
+func ParseCommand(s string) (Command, error) {
+	var c Command
+	var word strings.Builder
+	inWord := false
+	quoted := false   // the current word contains quotes
+	assign := false   // the current word is NAME=value
+	checkName := true // no '=' or quote seen yet in the current word
+	end := func() {
+		if !inWord {
+			return
+		}
+		if assign && len(c.Argv) == 0 {
+			c.Env = append(c.Env, word.String())
+		} else {
+			c.Argv = append(c.Argv, word.String())
+		}
+		word.Reset()
+		inWord, quoted, assign, checkName = false, false, false, true
+	}
+
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			end()
+		case ch == '\'':
+			j := strings.IndexByte(s[i+1:], '\'')
+			if j < 0 {
+				return Command{}, fmt.Errorf("unterminated single quote in %q", s)
+			}
+			word.WriteString(s[i+1 : i+1+j])
+			i += j + 1
+			inWord, quoted, checkName = true, true, false
+		case ch == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0 {
+					i++
+					if s[i] == '\n' {
+						continue
+					}
+				} else if s[i] == '$' || s[i] == '`' {
+					return Command{}, fmt.Errorf("variable or command substitution is not supported in %q", s)
+				}
+				word.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return Command{}, fmt.Errorf("unterminated double quote in %q", s)
+			}
+			inWord, quoted, checkName = true, true, false
+		case ch == '\\':
+			if i+1 >= len(s) {
+				return Command{}, fmt.Errorf("trailing backslash in %q", s)
+			}
+			i++
+			if s[i] != '\n' {
+				word.WriteByte(s[i])
+				inWord, quoted = true, true
+			}
+			checkName = false
+		case strings.IndexByte(shellSpecial, ch) >= 0:
+			return Command{}, fmt.Errorf("shell syntax %q is not supported in %q, run it through sh -c", ch, s)
+		default:
+			if ch == '=' && checkName && !quoted && isEnvName(word.String()) {
+				assign = true
+			}
+			if ch == '=' {
+				checkName = false
+			}
+			word.WriteByte(ch)
+			inWord = true
+		}
+	}
+	end()
+	if len(c.Argv) == 0 && len(c.Env) > 0 {
+		return Command{}, fmt.Errorf("no program in %q", s)
+	}
+	return c, nil
+}
+
+// isEnvName reports whether s is a valid environment variable name
+func isEnvName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if !(r == '_' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// shellQuote quotes a word so that ParseCommand reads it back unchanged
+func shellQuote(w string) string {
+	if w == "" {
+		return "''"
+	}
+	if !strings.ContainsAny(w, " \t\n'\"\\#*?[]~"+shellSpecial) {
+		return w
+	}
+	return "'" + strings.ReplaceAll(w, "'", `'\''`) + "'"
+}
+
+// String returns the command as a shell-quoted command line
+func (c Command) String() string {
+	words := make([]string, 0, len(c.Env)+len(c.Argv))
+	for _, kv := range c.Env {
+		name, value, _ := strings.Cut(kv, "=")
+		words = append(words, name+"="+shellQuote(value))
+	}
+	for i, w := range c.Argv {
+		if name, _, ok := strings.Cut(w, "="); i == 0 && ok && isEnvName(name) {
+			// Would read back as an assignment
+			words = append(words, "'"+w+"'")
+			continue
+		}
+		words = append(words, shellQuote(w))
+	}
+	return strings.Join(words, " ")
+}
+
+// IsZero reports whether no command is set
+func (c Command) IsZero() bool {
+	return len(c.Argv) == 0
+}
+
+// Equal reports whether both commands run the same program the same way
+func (c Command) Equal(o Command) bool {
+	return c.String() == o.String()
+}
+
+// UnmarshalYAML accepts a command line string or an argv list
+func (c *Command) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		var s string
+		if err := node.Decode(&s); err != nil {
+			return err
+		}
+		parsed, err := ParseCommand(s)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		*c = parsed
+		return nil
+	case yaml.SequenceNode:
+		var argv []string
+		if err := node.Decode(&argv); err != nil {
+			return err
+		}
+		if len(argv) == 0 || argv[0] == "" {
+			return fmt.Errorf("line %d: command list needs a program", node.Line)
+		}
+		*c = Command{Argv: argv}
+		return nil
+	}
+	return fmt.Errorf("line %d: command must be a string or a list", node.Line)
+}
+
+// MarshalYAML writes the command as an argv list when it has no
+// environment assignments, which keeps it unambiguous
+func (c Command) MarshalYAML() (interface{}, error) {
+	if len(c.Env) == 0 {
+		return c.Argv, nil
+	}
+	return c.String(), nil
+}
+
+// MarshalJSON writes the command line as a string
+func (c Command) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+// CommandSpec is a command together with how it is spawned
+type CommandSpec struct {
+	Command Command           `yaml:"command"`
+	Env     map[string]string `yaml:"env,omitempty"` // extra environment variables
+	Dir     string            `yaml:"dir,omitempty"` // working directory
+
+	Privileges `yaml:",inline"` // user, group and restrictions
+	Lifecycle  `yaml:",inline"` // stop and reload policy of a supervised process
+}
+
+// UnmarshalYAML accepts a bare command (string or list) or a mapping with
+// command, env, dir, the privilege settings and the stop policy
+func (cs *CommandSpec) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		*cs = CommandSpec{}
+		return node.Decode(&cs.Command)
+	}
+	type plain CommandSpec
+	var p plain
+	if err := node.Decode(&p); err != nil {
+		return err
+	}
+	*cs = CommandSpec(p)
+	return nil
+}
+
+// IsZero reports whether no command is set
+func (cs CommandSpec) IsZero() bool {
+	return cs.Command.IsZero()
+}
+
+// String returns the command line
+func (cs CommandSpec) String() string {
+	return cs.Command.String()
+}
+
+// Equal reports whether both specs run the same command the same way
+func (cs CommandSpec) Equal(o CommandSpec) bool {
+	return cs.Command.Equal(o.Command) && cs.Dir == o.Dir && cs.Privileges.Equal(o.Privileges) && cs.Lifecycle == o.Lifecycle &&
+		(len(cs.Env) == 0 && len(o.Env) == 0 || reflect.DeepEqual(cs.Env, o.Env))
+}
+
+// environ returns the agent's environment with the spec's variables on top
+func (cs CommandSpec) environ() []string {
+	extra := make([]string, 0, len(cs.Env))
+	for k, v := range cs.Env {
+		extra = append(extra, k+"="+v)
+	}
+	sort.Strings(extra)
+	env := append(os.Environ(), cs.Command.Env...)
+	return append(env, extra...)
+}
+
+// build creates the exec.Cmd for the spec with its environment, working
+// directory and privileges applied
+func (cs CommandSpec) build(ctx context.Context) (*exec.Cmd, error) {
+	if cs.Command.IsZero() {
+		return nil, fmt.Errorf("empty command")
+	}
+	argv := cs.Command.Argv
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = cs.Dir
+	if len(cs.Env) > 0 || len(cs.Command.Env) > 0 {
+		cmd.Env = cs.environ()
+	}
+	if !cs.Privileges.IsZero() {
+		if err := applyPrivileges(cmd, cs.Privileges); err != nil {
+			return nil, err
+		}
+	}
+	return cmd, nil
+}
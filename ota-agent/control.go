@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// errNothingToRollBack is returned when no applied update is eligible for
+// rollback
+var errNothingToRollBack = errors.New("no applied update to roll back")
+
+// appliedUpdate is the most recent update that passed its health gate
+type appliedUpdate struct {
+	Result    UpdateResult
+	PrevCmd   CommandSpec // command the previous build ran with
+	AppliedAt time.Time
+}
+
+// appliedFile returns where the update offered for rollback is kept, so
+// that it can still be rolled back after the agent restarted
+func appliedFile(versionFile string) string {
+	return versionFile + ".applied.yaml"
+}
+
+// appliedRecord is the persisted form of an appliedUpdate: what rolling it
+// back needs to put the previous release back and restart it
+type appliedRecord struct {
+	Version         string         `yaml:"version"`
+	PreviousVersion string         `yaml:"previous_version"`
+	Channel         string         `yaml:"channel,omitempty"`
+	Replaced        []ReplacedFile `yaml:"replaced,omitempty"`
+	PreviousRelease string         `yaml:"previous_release,omitempty"`
+	Processes       []ProcessSpec  `yaml:"processes,omitempty"`
+	PrevProcesses   []ProcessSpec  `yaml:"previous_processes,omitempty"`
+	RestartMain     bool           `yaml:"restart_main,omitempty"`
+	RestartCmd      CommandSpec    `yaml:"restart_cmd,omitempty"`
+	RestartCmds     []Command      `yaml:"restart_cmds,omitempty"`
+	OnRollback      Command        `yaml:"on_rollback,omitempty"`
+	HookTimeout     time.Duration  `yaml:"hook_timeout,omitempty"`
+	Files           []FileReport   `yaml:"files,omitempty"`
+	PrevCmd         CommandSpec    `yaml:"previous_cmd,omitempty"`
+	AppliedAt       time.Time      `yaml:"applied_at"`
+}
+
+// writeAppliedUpdate records a as the update offered for rollback
+func writeAppliedUpdate(versionFile string, a *appliedUpdate) error {
+	r := a.Result
+	b, err := yaml.Marshal(appliedRecord{
+		Version:         r.RemoteVersion,
+		PreviousVersion: r.PreviousVersion,
+		Channel:         r.Channel,
+		Replaced:        r.Replaced,
+		PreviousRelease: r.PreviousRelease,
+		Processes:       r.Processes,
+		PrevProcesses:   r.PrevProcesses,
+		RestartMain:     r.RestartMain,
+		RestartCmd:      r.RestartCmd,
+		RestartCmds:     r.RestartCmds,
+		OnRollback:      r.Hooks.OnRollback,
+		HookTimeout:     r.Hooks.Timeout,
+		Files:           r.Files,
+		PrevCmd:         a.PrevCmd,
+		AppliedAt:       a.AppliedAt,
+	})
+	if err != nil {
+		return err
+	}
+	path := appliedFile(versionFile)
+	if err := os.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// readAppliedUpdate loads the update offered for rollback, nil if there is
+// none or the installed version is no longer the one it applied
+func readAppliedUpdate(versionFile string) (*appliedUpdate, error) {
+	b, err := os.ReadFile(appliedFile(versionFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var rec appliedRecord
+	if err := yaml.Unmarshal(b, &rec); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", appliedFile(versionFile), err)
+	}
+	if current, _ := readLocalVersion(versionFile); current != rec.Version {
+		return nil, fmt.Errorf("%s applied %s but %q is installed", appliedFile(versionFile), rec.Version, current)
+	}
+	return &appliedUpdate{
+		Result: UpdateResult{
+			Updated:         true,
+			RemoteVersion:   rec.Version,
+			PreviousVersion: rec.PreviousVersion,
+			Channel:         rec.Channel,
+			Replaced:        rec.Replaced,
+			PreviousRelease: rec.PreviousRelease,
+			Processes:       rec.Processes,
+			PrevProcesses:   rec.PrevProcesses,
+			RestartMain:     rec.RestartMain,
+			RestartCmd:      rec.RestartCmd,
+			RestartCmds:     rec.RestartCmds,
+			Hooks:           Hooks{OnRollback: rec.OnRollback, Timeout: rec.HookTimeout},
+			Files:           rec.Files,
+			Outcome:         OutcomeUpdated,
+		},
+		PrevCmd:   rec.PrevCmd,
+		AppliedAt: rec.AppliedAt,
+	}, nil
+}
+
+// removeAppliedUpdate forgets the update offered for rollback
+func removeAppliedUpdate(versionFile string) error {
+	if err := os.Remove(appliedFile(versionFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// agentState is the daemon state shared with the control API
+type agentState struct {
+	mu         sync.Mutex
+	startedAt  time.Time
+	labels     Labels
+	paused     bool
+	checking   bool
+	lastReport *UpdateReport
+	applied    *appliedUpdate
+}
+
+func newAgentState() *agentState {
+	return &agentState{startedAt: time.Now()}
+}
+
+// Paused reports whether scheduled update checks are paused
+func (s *agentState) Paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+// SetPaused pauses or resumes scheduled update checks
+func (s *agentState) SetPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = paused
+}
+
+// beginCheck marks a check as running
+func (s *agentState) beginCheck() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checking = true
+}
+
+// finishCheck records the outcome of a check. applied is the update to
+// offer for rollback, or nil to keep the current one; a rolled back or
+// failed-over update clears it.
+func (s *agentState) finishCheck(report UpdateReport, applied *appliedUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checking = false
+	s.lastReport = &report
+	if applied != nil {
+		s.applied = applied
+	} else if report.Outcome == OutcomeRolledBack {
+		s.applied = nil
+	}
+}
+
+// restoreApplied offers an update applied by a previous agent run for
+// rollback
+func (s *agentState) restoreApplied(a *appliedUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.applied = a
+}
+
+// takeApplied returns the update eligible for rollback and forgets it
+func (s *agentState) takeApplied() *appliedUpdate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.applied
+	s.applied = nil
+	return a
+}
+
+// takeRecentApplied is takeApplied for an update applied within d; an
+// older one is kept
+func (s *agentState) takeRecentApplied(d time.Duration) *appliedUpdate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.applied
+	if a == nil || time.Since(a.AppliedAt) > d {
+		return nil
+	}
+	s.applied = nil
+	return a
+}
+
+// ProcessStatus describes a supervised process in the status response
+type ProcessStatus struct {
+	Name         string       `json:"name"`
+	Command      string       `json:"command"`
+	Running      bool         `json:"running"`
+	PID          int          `json:"pid,omitempty"`
+	RestartCount int          `json:"restart_count"`
+	CrashLooping bool         `json:"crash_looping"`
+	LastCrash    *CrashReport `json:"last_crash,omitempty"`
+}
+
+// AgentStatus is returned by GET /status
+type AgentStatus struct {
+	AgentID        string          `json:"agent_id"`
+	Version        string          `json:"version"`
+	Channel        string          `json:"channel,omitempty"` // channel the next check resolves
+	Labels         Labels          `json:"labels,omitempty"`
+	Paused         bool            `json:"paused"`
+	Checking       bool            `json:"checking"`
+	Uptime         string          `json:"uptime"`
+	RollbackTarget string          `json:"rollback_target,omitempty"` // version POST /rollback returns to
+	LastCheck      *UpdateReport   `json:"last_check,omitempty"`
+	Processes      []ProcessStatus `json:"processes,omitempty"`
+}
+
+// controlRequest asks the daemon loop to perform an action
+type controlRequest struct {
+	action string // "rollback"
+	reply  chan error
+}
+
+// ControlServer is the local HTTP control API. Actions that change the
+// install are handed to the daemon loop so that they never run
+// concurrently with an update check.
+type ControlServer struct {
+	addr        string
+	agentID     string
+	versionFile string
+	channel     channelSelector
+	state       *agentState
+	registry    *ProcessRegistry
+	checkNow    chan struct{}
+	requests    chan controlRequest
+	logger      *Logger
+	server      *http.Server
+	listener    net.Listener
+}
+
+// NewControlServer creates a control server for addr, which is either
+// host:port on a loopback address or unix:/path/to/socket
+func NewControlServer(addr, agentID, versionFile string, channel channelSelector, state *agentState, registry *ProcessRegistry, logger *Logger) *ControlServer {
+	cs := &ControlServer{
+		addr:        addr,
+		agentID:     agentID,
+		versionFile: versionFile,
+		channel:     channel,
+		state:       state,
+		registry:    registry,
+		checkNow:    make(chan struct{}, 1),
+		requests:    make(chan controlRequest),
+		logger:      logger,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", cs.handleStatus)
+	mux.HandleFunc("/check", cs.post(cs.handleCheck))
+	mux.HandleFunc("/pause", cs.post(cs.handlePause))
+	mux.HandleFunc("/resume", cs.post(cs.handleResume))
+	mux.HandleFunc("/rollback", cs.post(cs.handleRollback))
+	mux.HandleFunc("/reload", cs.post(cs.handleReload))
+	mux.HandleFunc("/channel", cs.post(cs.handleChannel))
+	mux.Handle("/metrics", metricsHandler(agentID, versionFile, registry))
+	cs.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return cs
+}
+
+// CheckNow receives a value whenever an immediate check was requested
+func (cs *ControlServer) CheckNow() <-chan struct{} {
+	return cs.checkNow
+}
+
+// Requests receives actions the daemon loop must perform and answer
+func (cs *ControlServer) Requests() <-chan controlRequest {
+	return cs.requests
+}
+
+// listen opens the configured TCP or unix socket
+func (cs *ControlServer) listen() (net.Listener, error) {
+	if path, ok := strings.CutPrefix(cs.addr, "unix:"); ok {
+		// A socket left behind by a previous run blocks the bind
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0660); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+
+	host, _, err := net.SplitHostPort(cs.addr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("control API must listen on a loopback address or unix socket, got %q", cs.addr)
+		}
+	}
+	return net.Listen("tcp", cs.addr)
+}
+
+// Start begins serving in the background
+func (cs *ControlServer) Start() error {
+	l, err := cs.listen()
+	if err != nil {
+		return fmt.Errorf("control API listen on %s: %w", cs.addr, err)
+	}
+	cs.listener = l
+	go func() {
+		if err := cs.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			cs.logger.Error("control API stopped: %v", err)
+		}
+	}()
+	cs.logger.Info("control API listening on %s", cs.addr)
+	return nil
+}
+
+// Close shuts the server down and removes the unix socket
+func (cs *ControlServer) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_ = cs.server.Shutdown(ctx)
+	if path, ok := strings.CutPrefix(cs.addr, "unix:"); ok {
+		_ = os.Remove(path)
+	}
+}
+
+// post restricts a handler to POST requests
+func (cs *ControlServer) post(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func (cs *ControlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	version, _ := readLocalVersion(cs.versionFile)
+	status := AgentStatus{AgentID: cs.agentID, Version: version}
+	status.Channel, _ = cs.channel.Current()
+
+	cs.state.mu.Lock()
+	status.Labels = cs.state.labels
+	status.Paused = cs.state.paused
+	status.Checking = cs.state.checking
+	status.Uptime = time.Since(cs.state.startedAt).Round(time.Second).String()
+	status.LastCheck = cs.state.lastReport
+	if cs.state.applied != nil {
+		status.RollbackTarget = cs.state.applied.Result.PreviousVersion
+	}
+	cs.state.mu.Unlock()
+
+	for _, p := range cs.registry.List() {
+		status.Processes = append(status.Processes, ProcessStatus{
+			Name:         p.Spec.Name,
+			Command:      p.Spec.Command.String(),
+			Running:      p.PM.IsRunning(),
+			PID:          p.PM.Pid(),
+			RestartCount: p.PM.GetRestartCount(),
+			CrashLooping: p.PM.CrashLooping(),
+			LastCrash:    p.PM.LastCrash(),
+		})
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (cs *ControlServer) handleCheck(w http.ResponseWriter, r *http.Request) {
+	if cs.state.Paused() {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "updates are paused"})
+		return
+	}
+	select {
+	case cs.checkNow <- struct{}{}:
+		cs.logger.Info("control API: update check requested")
+	default:
+		// A check is already queued
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "check scheduled"})
+}
+
+func (cs *ControlServer) handlePause(w http.ResponseWriter, r *http.Request) {
+	cs.state.SetPaused(true)
+	cs.logger.Info("control API: updates paused")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+func (cs *ControlServer) handleResume(w http.ResponseWriter, r *http.Request) {
+	cs.state.SetPaused(false)
+	cs.logger.Info("control API: updates resumed")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
+
+func (cs *ControlServer) handleRollback(w http.ResponseWriter, r *http.Request) {
+	cs.logger.Info("control API: rollback requested")
+	req := controlRequest{action: "rollback", reply: make(chan error, 1)}
+	select {
+	case cs.requests <- req:
+	case <-r.Context().Done():
+		return
+	}
+	var err error
+	select {
+	case err = <-req.reply:
+	case <-r.Context().Done():
+		return
+	}
+	switch {
+	case errors.Is(err, errNothingToRollBack):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	default:
+		version, _ := readLocalVersion(cs.versionFile)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "rolled back", "version": version})
+	}
+}
+
+func (cs *ControlServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("process")
+	if name == "" {
+		name = defaultProcessName
+	}
+	cs.logger.Info("control API: reload of %s requested", name)
+	err := cs.registry.Reload(name)
+	switch {
+	case errors.Is(err, errUnknownProcess):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("process %s not found", name)})
+	case err != nil:
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded", "process": name})
+	}
+}
+
+func (cs *ControlServer) handleChannel(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if err := cs.channel.Set(name); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	current, err := cs.channel.Current()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	cs.logger.Info("control API: release channel set to %s", current)
+	status := "channel set"
+	if !cs.state.Paused() {
+		select {
+		case cs.checkNow <- struct{}{}:
+		default:
+		}
+		status = "channel set, check scheduled"
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": status, "channel": current})
+}
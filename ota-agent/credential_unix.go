@@ -0,0 +1,90 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// credential resolves the user, group and supplementary groups of p.
+// Names and numeric ids are accepted; without a group the user's primary
+// group is used, and without a user the agent's uid is kept. The
+// supplementary groups default to those of the user, or to the agent's
+// when no user is set.
+func credential(p Privileges) (*syscall.Credential, error) {
+	cred := &syscall.Credential{Uid: uint32(syscall.Getuid()), Gid: uint32(syscall.Getgid()), NoSetGroups: true}
+	var u *user.User
+	if p.User != "" {
+		var err error
+		if u, err = lookupUser(p.User); err != nil {
+			return nil, err
+		}
+		id, _ := strconv.ParseUint(u.Uid, 10, 32)
+		cred.Uid = uint32(id)
+		id, _ = strconv.ParseUint(u.Gid, 10, 32)
+		cred.Gid = uint32(id)
+	}
+	if p.Group != "" {
+		id, err := lookupGroupID(p.Group)
+		if err != nil {
+			return nil, err
+		}
+		cred.Gid = id
+	}
+
+	groups := p.Groups
+	if groups == nil && u != nil {
+		// A bare uid without a passwd entry has no groups
+		groups, _ = u.GroupIds()
+		if groups == nil {
+			groups = []string{}
+		}
+	}
+	if groups != nil {
+		cred.NoSetGroups = false
+		cred.Groups = make([]uint32, 0, len(groups))
+		for _, g := range groups {
+			id, err := lookupGroupID(g)
+			if err != nil {
+				return nil, err
+			}
+			cred.Groups = append(cred.Groups, id)
+		}
+	}
+	return cred, nil
+}
+
+// lookupUser resolves a user name or numeric uid
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		// A bare uid without a passwd entry runs with the same gid
+		return &user.User{Uid: name, Gid: name, Username: name}, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("user %q: %w", name, err)
+	}
+	return u, nil
+}
+
+// lookupGroupID resolves a group name or numeric gid
+func lookupGroupID(name string) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("group %q: %w", name, err)
+	}
+	id, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("group %q: bad gid %q", name, g.Gid)
+	}
+	return uint32(id), nil
+}
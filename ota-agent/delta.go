@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Patch is a binary delta that turns a known base file into the new file
+type Patch struct {
+	FromSHA256 string `yaml:"from_sha256"` // sha256 of the base file the patch applies to
+	URL        string `yaml:"url"`         // download URL of the patch
+	SHA256     string `yaml:"sha256"`      // sha256 of the patch itself
+}
+
+// Delta patches use the bsdiff algorithm with zlib instead of bzip2:
+//
+//	magic "OTADIFF1" | new size | ctrl block length | diff block length
+//	ctrl block (zlib) | diff block (zlib) | extra block (zlib)
+//
+// The header integers are little-endian int64. The control block is a
+// sequence of (diff length, extra length, old seek) int64 triples.
+const deltaMagic = "OTADIFF1"
+
+const deltaHeaderSize = len(deltaMagic) + 3*8
+
+// applyPatch reconstructs the new file from old and a patch, writing it to w.
+// The old file is read with ReadAt so that neither file has to fit in memory.
+func applyPatch(old io.ReaderAt, oldSize int64, patch io.ReaderAt, patchSize int64, w io.Writer) error {
+	header := make([]byte, deltaHeaderSize)
+	if _, err := patch.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("read patch header: %w", err)
+	}
+	if string(header[:len(deltaMagic)]) != deltaMagic {
+		return fmt.Errorf("not a delta patch")
+	}
+	newSize := int64(binary.LittleEndian.Uint64(header[8:]))
+	ctrlLen := int64(binary.LittleEndian.Uint64(header[16:]))
+	diffLen := int64(binary.LittleEndian.Uint64(header[24:]))
+	if newSize < 0 || ctrlLen < 0 || diffLen < 0 || int64(deltaHeaderSize)+ctrlLen+diffLen > patchSize {
+		return fmt.Errorf("corrupt patch header")
+	}
+
+	blockAt := func(off, n int64) (io.Reader, error) {
+		return zlib.NewReader(io.NewSectionReader(patch, off, n))
+	}
+	ctrl, err := blockAt(int64(deltaHeaderSize), ctrlLen)
+	if err != nil {
+		return fmt.Errorf("open ctrl block: %w", err)
+	}
+	diff, err := blockAt(int64(deltaHeaderSize)+ctrlLen, diffLen)
+	if err != nil {
+		return fmt.Errorf("open diff block: %w", err)
+	}
+	extra, err := blockAt(int64(deltaHeaderSize)+ctrlLen+diffLen, patchSize-int64(deltaHeaderSize)-ctrlLen-diffLen)
+	if err != nil {
+		return fmt.Errorf("open extra block: %w", err)
+	}
+	ctrl, diff, extra = bufio.NewReader(ctrl), bufio.NewReader(diff), bufio.NewReader(extra)
+
+	out := bufio.NewWriter(w)
+	buf := make([]byte, 32*1024)
+	oldBuf := make([]byte, 32*1024)
+	var triple [3]int64
+	var newPos, oldPos int64
+	for newPos < newSize {
+		if err := binary.Read(ctrl, binary.LittleEndian, &triple); err != nil {
+			return fmt.Errorf("read ctrl: %w", err)
+		}
+		addLen, copyLen, seek := triple[0], triple[1], triple[2]
+		if addLen < 0 || copyLen < 0 || newPos+addLen+copyLen > newSize {
+			return fmt.Errorf("corrupt patch control data")
+		}
+
+		// diff bytes are added to the old bytes at oldPos
+		for remaining := addLen; remaining > 0; {
+			n := int64(len(buf))
+			if remaining < n {
+				n = remaining
+			}
+			if _, err := io.ReadFull(diff, buf[:n]); err != nil {
+				return fmt.Errorf("read diff: %w", err)
+			}
+			for i := range oldBuf[:n] {
+				oldBuf[i] = 0
+			}
+			// bytes outside the old file count as zero
+			if lo, hi := max(oldPos, 0), min(oldPos+n, oldSize); lo < hi {
+				if _, err := old.ReadAt(oldBuf[lo-oldPos:hi-oldPos], lo); err != nil && err != io.EOF {
+					return fmt.Errorf("read old: %w", err)
+				}
+			}
+			for i := int64(0); i < n; i++ {
+				buf[i] += oldBuf[i]
+			}
+			if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+			remaining -= n
+			oldPos += n
+			newPos += n
+		}
+
+		// extra bytes are copied verbatim
+		if _, err := io.CopyN(out, extra, copyLen); err != nil {
+			return fmt.Errorf("read extra: %w", err)
+		}
+		newPos += copyLen
+		oldPos += seek
+	}
+	return out.Flush()
+}
+
+// createPatch computes a bsdiff delta from old to new
+func createPatch(old, new []byte) ([]byte, error) {
+	var ctrlBuf, diffBuf, extraBuf bytes.Buffer
+	ctrlW := zlib.NewWriter(&ctrlBuf)
+	diffW, _ := zlib.NewWriterLevel(&diffBuf, zlib.BestCompression)
+	extraW, _ := zlib.NewWriterLevel(&extraBuf, zlib.BestCompression)
+
+	I := qsufsort(old)
+	oldSize, newSize := len(old), len(new)
+	db := make([]byte, 0, 32*1024)
+
+	var scan, pos, length int
+	var lastScan, lastPos, lastOffset int
+	for scan < newSize {
+		oldScore := 0
+		scan += length
+		for scsc := scan; scan < newSize; scan++ {
+			pos, length = search(I, old, new[scan:], 0, oldSize)
+			for ; scsc < scan+length; scsc++ {
+				if scsc+lastOffset < oldSize && old[scsc+lastOffset] == new[scsc] {
+					oldScore++
+				}
+			}
+			if (length == oldScore && length != 0) || length > oldScore+8 {
+				break
+			}
+			if scan+lastOffset < oldSize && old[scan+lastOffset] == new[scan] {
+				oldScore--
+			}
+		}
+
+		if length == oldScore && scan != newSize {
+			continue
+		}
+
+		// extend the previous match forwards
+		var lenf int
+		for i, s, sf := 0, 0, 0; lastScan+i < scan && lastPos+i < oldSize; {
+			if old[lastPos+i] == new[lastScan+i] {
+				s++
+			}
+			i++
+			if s*2-i > sf*2-lenf {
+				sf, lenf = s, i
+			}
+		}
+
+		// extend the new match backwards
+		var lenb int
+		if scan < newSize {
+			for i, s, sb := 1, 0, 0; scan >= lastScan+i && pos >= i; i++ {
+				if old[pos-i] == new[scan-i] {
+					s++
+				}
+				if s*2-i > sb*2-lenb {
+					sb, lenb = s, i
+				}
+			}
+		}
+
+		// resolve overlap between the two extensions
+		if lastScan+lenf > scan-lenb {
+			overlap := (lastScan + lenf) - (scan - lenb)
+			var s, ss, lens int
+			for i := 0; i < overlap; i++ {
+				if new[lastScan+lenf-overlap+i] == old[lastPos+lenf-overlap+i] {
+					s++
+				}
+				if new[scan-lenb+i] == old[pos-lenb+i] {
+					s--
+				}
+				if s > ss {
+					ss, lens = s, i+1
+				}
+			}
+			lenf += lens - overlap
+			lenb -= lens
+		}
+
+		db = db[:0]
+		for i := 0; i < lenf; i++ {
+			db = append(db, new[lastScan+i]-old[lastPos+i])
+		}
+		if _, err := diffW.Write(db); err != nil {
+			return nil, err
+		}
+		extraLen := (scan - lenb) - (lastScan + lenf)
+		if _, err := extraW.Write(new[lastScan+lenf : lastScan+lenf+extraLen]); err != nil {
+			return nil, err
+		}
+		triple := [3]int64{int64(lenf), int64(extraLen), int64((pos - lenb) - (lastPos + lenf))}
+		if err := binary.Write(ctrlW, binary.LittleEndian, triple); err != nil {
+			return nil, err
+		}
+
+		lastScan = scan - lenb
+		lastPos = pos - lenb
+		lastOffset = pos - scan
+	}
+
+	for _, w := range []io.Closer{ctrlW, diffW, extraW} {
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	var out bytes.Buffer
+	out.WriteString(deltaMagic)
+	for _, v := range []int64{int64(newSize), int64(ctrlBuf.Len()), int64(diffBuf.Len())} {
+		binary.Write(&out, binary.LittleEndian, v)
+	}
+	out.Write(ctrlBuf.Bytes())
+	out.Write(diffBuf.Bytes())
+	out.Write(extraBuf.Bytes())
+	return out.Bytes(), nil
+}
+
+// qsufsort builds the suffix array of buf (Larsson-Sadakane, as in bsdiff)
+func qsufsort(buf []byte) []int {
+	var buckets [256]int
+	n := len(buf)
+	I := make([]int, n+1)
+	V := make([]int, n+1)
+
+	for _, c := range buf {
+		buckets[c]++
+	}
+	for i := 1; i < 256; i++ {
+		buckets[i] += buckets[i-1]
+	}
+	copy(buckets[1:], buckets[:255])
+	buckets[0] = 0
+
+	for i, c := range buf {
+		buckets[c]++
+		I[buckets[c]] = i
+	}
+	I[0] = n
+	for i, c := range buf {
+		V[i] = buckets[c]
+	}
+	V[n] = 0
+	for i := 1; i < 256; i++ {
+		if buckets[i] == buckets[i-1]+1 {
+			I[buckets[i]] = -1
+		}
+	}
+	I[0] = -1
+
+	for h := 1; I[0] != -(n + 1); h += h {
+		var length int
+		i := 0
+		for i < n+1 {
+			if I[i] < 0 {
+				length -= I[i]
+				i -= I[i]
+			} else {
+				if length != 0 {
+					I[i-length] = -length
+				}
+				length = V[I[i]] + 1 - i
+				split(I, V, i, length, h)
+				i += length
+				length = 0
+			}
+		}
+		if length != 0 {
+			I[i-length] = -length
+		}
+	}
+
+	for i := 0; i < n+1; i++ {
+		I[V[i]] = i
+	}
+	return I
+}
+
+func split(I, V []int, start, length, h int) {
+	if length < 16 {
+		for k := start; k < start+length; {
+			j := 1
+			x := V[I[k]+h]
+			for i := 1; k+i < start+length; i++ {
+				if V[I[k+i]+h] < x {
+					x = V[I[k+i]+h]
+					j = 0
+				}
+				if V[I[k+i]+h] == x {
+					I[k+j], I[k+i] = I[k+i], I[k+j]
+					j++
+				}
+			}
+			for i := 0; i < j; i++ {
+				V[I[k+i]] = k + j - 1
+			}
+			if j == 1 {
+				I[k] = -1
+			}
+			k += j
+		}
+		return
+	}
+
+	x := V[I[start+length/2]+h]
+	var jj, kk int
+	for i := start; i < start+length; i++ {
+		if V[I[i]+h] < x {
+			jj++
+		}
+		if V[I[i]+h] == x {
+			kk++
+		}
+	}
+	jj += start
+	kk += jj
+
+	i, j, k := start, 0, 0
+	for i < jj {
+		switch {
+		case V[I[i]+h] < x:
+			i++
+		case V[I[i]+h] == x:
+			I[i], I[jj+j] = I[jj+j], I[i]
+			j++
+		default:
+			I[i], I[kk+k] = I[kk+k], I[i]
+			k++
+		}
+	}
+	for jj+j < kk {
+		if V[I[jj+j]+h] == x {
+			j++
+		} else {
+			I[jj+j], I[kk+k] = I[kk+k], I[jj+j]
+			k++
+		}
+	}
+
+	if jj > start {
+		split(I, V, start, jj-start, h)
+	}
+	for i := 0; i < kk-jj; i++ {
+		V[I[jj+i]] = kk - 1
+	}
+	if jj == kk-1 {
+		I[jj] = -1
+	}
+	if start+length > kk {
+		split(I, V, kk, start+length-kk, h)
+	}
+}
+
+func matchLen(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// search finds the longest match of target in old using the suffix array
+func search(I []int, old, target []byte, st, en int) (pos, length int) {
+	for en-st >= 2 {
+		x := st + (en-st)/2
+		n := min(len(old)-I[x], len(target))
+		if bytes.Compare(old[I[x]:I[x]+n], target[:n]) < 0 {
+			st = x
+		} else {
+			en = x
+		}
+	}
+	x := matchLen(old[I[st]:], target)
+	y := matchLen(old[I[en]:], target)
+	if x > y {
+		return I[st], x
+	}
+	return I[en], y
+}
+
+// stageFromPatch tries to build the new version of file into dest from the
+// installed copy at base and a matching delta patch. It returns false when no
+// patch applies; any error means the caller should fall back to the full download.
+func stageFromPatch(file FileUpdate, base, dest string, agentID string, timeout time.Duration, maxRetries int, logger *Logger) (bool, error) {
+	if len(file.Patches) == 0 {
+		return false, nil
+	}
+	baseSum, err := fileSHA256(base)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("hash current target: %w", err)
+	}
+	var patch *Patch
+	for i := range file.Patches {
+		if strings.EqualFold(file.Patches[i].FromSHA256, baseSum) {
+			patch = &file.Patches[i]
+			break
+		}
+	}
+	if patch == nil {
+		logger.Info("no delta patch for %s from base %s", file.Name, baseSum)
+		return false, nil
+	}
+
+	patchFile := filepath.Join(filepath.Dir(dest), ".ota-patch-"+strings.ToLower(patch.SHA256))
+	defer os.Remove(patchFile)
+	logger.Info("downloading delta patch for %s (base %s)", file.Name, baseSum)
+	if err := downloadFile(patch.URL, patchFile, patch.SHA256, agentID, timeout, maxRetries, logger); err != nil {
+		return true, fmt.Errorf("download patch: %w", err)
+	}
+
+	oldF, err := os.Open(base)
+	if err != nil {
+		return true, err
+	}
+	defer oldF.Close()
+	oldInfo, err := oldF.Stat()
+	if err != nil {
+		return true, err
+	}
+	patchF, err := os.Open(patchFile)
+	if err != nil {
+		return true, err
+	}
+	defer patchF.Close()
+	patchInfo, err := patchF.Stat()
+	if err != nil {
+		return true, err
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return true, fmt.Errorf("create dest: %w", err)
+	}
+	defer out.Close()
+
+	hasher := sha256.New()
+	if err := applyPatch(oldF, oldInfo.Size(), patchF, patchInfo.Size(), io.MultiWriter(out, hasher)); err != nil {
+		return true, fmt.Errorf("apply patch: %w", err)
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(sum, file.SHA256) {
+		metrics.checksumMismatch()
+		return true, fmt.Errorf("patched file sha256 mismatch: got=%s want=%s", sum, file.SHA256)
+	}
+	return true, out.Close()
+}
+
+// runDelta implements the "delta" subcommand used to generate patches
+// between two releases. Given two files it writes one patch; given two
+// directories it writes a patch for every file present in both.
+func runDelta(args []string) error {
+	fs := flag.NewFlagSet("delta", flag.ExitOnError)
+	out := fs.String("out", "", "output patch file, or output directory when diffing directories (required)")
+	baseURL := fs.String("base-url", "", "URL prefix under which patches will be published (for the printed YAML)")
+	fs.Parse(args)
+	if *out == "" || fs.NArg() != 2 {
+		return fmt.Errorf("usage: ota-agent delta -out <patch|dir> [-base-url <url>] <old> <new>")
+	}
+	oldPath, newPath := fs.Arg(0), fs.Arg(1)
+
+	info, err := os.Stat(oldPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return writeDelta(oldPath, newPath, *out, *baseURL)
+	}
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(newPath)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		oldFile := filepath.Join(oldPath, e.Name())
+		if _, err := os.Stat(oldFile); err != nil {
+			fmt.Printf("# %s: not in old release, skipped\n", e.Name())
+			continue
+		}
+		dest := filepath.Join(*out, e.Name()+".patch")
+		if err := writeDelta(oldFile, filepath.Join(newPath, e.Name()), dest, *baseURL); err != nil {
+			return fmt.Errorf("%s: %w", e.Name(), err)
+		}
+	}
+	return nil
+}
+
+// writeDelta diffs one file pair and prints the manifest entry for the patch
+func writeDelta(oldPath, newPath, dest, baseURL string) error {
+	oldData, err := os.ReadFile(oldPath)
+	if err != nil {
+		return err
+	}
+	newData, err := os.ReadFile(newPath)
+	if err != nil {
+		return err
+	}
+	patch, err := createPatch(oldData, newData)
+	if err != nil {
+		return fmt.Errorf("create patch: %w", err)
+	}
+	if err := os.WriteFile(dest, patch, 0644); err != nil {
+		return err
+	}
+
+	sum := func(b []byte) string {
+		h := sha256.Sum256(b)
+		return hex.EncodeToString(h[:])
+	}
+	fmt.Printf("# %s: %d -> %d bytes, patch %d bytes (%.1f%%)\n",
+		filepath.Base(newPath), len(oldData), len(newData), len(patch), 100*float64(len(patch))/float64(max(len(newData), 1)))
+	fmt.Printf("- from_sha256: %q\n  url: %q\n  sha256: %q\n", sum(oldData), baseURL+filepath.Base(dest), sum(patch))
+	return nil
+}
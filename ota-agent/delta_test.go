@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// discardLogger returns a logger that drops everything
+func discardLogger() *Logger {
+	return &Logger{sink: &logSink{level: LevelError, stdout: io.Discard, stderr: io.Discard}}
+}
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+// edited returns a copy of b with some bytes changed, a block inserted and
+// a block removed, like a rebuilt binary
+func edited(r *rand.Rand, b []byte) []byte {
+	out := append([]byte(nil), b...)
+	for i := 0; i < len(out)/100; i++ {
+		out[r.Intn(len(out))]++
+	}
+	at := r.Intn(len(out))
+	out = append(out[:at], append(randomBytes(r, 300), out[at:]...)...)
+	cut := r.Intn(len(out) - 200)
+	return append(out[:cut], out[cut+200:]...)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestPatchRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	base := randomBytes(r, 64*1024)
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 500))
+	tests := []struct {
+		name     string
+		old, new []byte
+	}{
+		{name: "random", old: randomBytes(r, 10000), new: randomBytes(r, 12000)},
+		{name: "edited", old: base, new: edited(r, base)},
+		{name: "edited text", old: text, new: bytes.Replace(text, []byte("lazy"), []byte("sleepy"), 7)},
+		{name: "identical", old: base, new: base},
+		{name: "both empty", old: nil, new: nil},
+		{name: "empty old", old: nil, new: randomBytes(r, 5000)},
+		{name: "empty new", old: randomBytes(r, 5000), new: nil},
+		{name: "single byte", old: []byte{1}, new: []byte{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := createPatch(tt.old, tt.new)
+			if err != nil {
+				t.Fatalf("createPatch: %v", err)
+			}
+			var out bytes.Buffer
+			err = applyPatch(bytes.NewReader(tt.old), int64(len(tt.old)), bytes.NewReader(patch), int64(len(patch)), &out)
+			if err != nil {
+				t.Fatalf("applyPatch: %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), tt.new) {
+				t.Fatalf("patched output differs: got %d bytes, want %d", out.Len(), len(tt.new))
+			}
+		})
+	}
+}
+
+func TestPatchOfIdenticalFileIsSmall(t *testing.T) {
+	base := randomBytes(rand.New(rand.NewSource(2)), 256*1024)
+	patch, err := createPatch(base, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) > 1024 {
+		t.Errorf("patch between identical files is %d bytes", len(patch))
+	}
+}
+
+func TestQsufsort(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{name: "empty"},
+		{name: "banana", buf: []byte("banana")},
+		{name: "repeated byte", buf: bytes.Repeat([]byte{'a'}, 100)},
+		{name: "random", buf: randomBytes(r, 2000)},
+		{name: "binary alphabet", buf: []byte("abbabaabbaababbabaababbaabbabaab")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			I := qsufsort(tt.buf)
+			if len(I) != len(tt.buf)+1 {
+				t.Fatalf("suffix array has %d entries, want %d", len(I), len(tt.buf)+1)
+			}
+			want := make([]int, len(tt.buf)+1)
+			for i := range want {
+				want[i] = i
+			}
+			sort.Slice(want, func(a, b int) bool {
+				return bytes.Compare(tt.buf[want[a]:], tt.buf[want[b]:]) < 0
+			})
+			for i := range want {
+				if I[i] != want[i] {
+					t.Fatalf("suffix array = %v, want %v", I, want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyPatchRejectsCorruptPatch(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	old := randomBytes(r, 4096)
+	patch, err := createPatch(old, edited(r, old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withHeader := func(off int, v int64) []byte {
+		p := append([]byte(nil), patch...)
+		binary.LittleEndian.PutUint64(p[off:], uint64(v))
+		return p
+	}
+	tests := []struct {
+		name  string
+		patch []byte
+		want  string
+	}{
+		{name: "empty", patch: nil, want: "read patch header"},
+		{name: "truncated header", patch: patch[:deltaHeaderSize-1], want: "read patch header"},
+		{name: "bad magic", patch: append([]byte("BSDIFF40"), patch[len(deltaMagic):]...), want: "not a delta patch"},
+		{name: "negative new size", patch: withHeader(8, -1), want: "corrupt patch header"},
+		{name: "ctrl block past the end", patch: withHeader(16, int64(len(patch))), want: "corrupt patch header"},
+		{name: "diff block past the end", patch: withHeader(24, int64(len(patch))), want: "corrupt patch header"},
+		{name: "new size too large", patch: withHeader(8, int64(len(old))*10), want: "read ctrl"},
+		{name: "truncated body", patch: patch[:len(patch)-10], want: "read extra"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := applyPatch(bytes.NewReader(old), int64(len(old)), bytes.NewReader(tt.patch), int64(len(tt.patch)), io.Discard)
+			if err == nil {
+				t.Fatal("corrupt patch was applied")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStageFromPatch(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	old := randomBytes(r, 32*1024)
+	new := edited(r, old)
+	patch, err := createPatch(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(patch)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		from    string // from_sha256 of the patch
+		sha     string // sha256 of the new file in the config
+		applied bool
+		wantErr string
+	}{
+		{name: "applies", from: sha256Hex(old), sha: sha256Hex(new), applied: true},
+		{name: "other base", from: sha256Hex(new), sha: sha256Hex(new)},
+		{name: "wrong output sha256", from: sha256Hex(old), sha: sha256Hex(old), applied: true, wantErr: "patched file sha256 mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			base := filepath.Join(dir, "app")
+			if err := os.WriteFile(base, old, 0644); err != nil {
+				t.Fatal(err)
+			}
+			dest := filepath.Join(dir, ".app.new")
+			file := FileUpdate{
+				Name:    "app",
+				SHA256:  tt.sha,
+				Patches: []Patch{{FromSHA256: tt.from, URL: srv.URL + "/app.patch", SHA256: sha256Hex(patch)}},
+			}
+			applied, err := stageFromPatch(file, base, dest, "", 5*time.Second, 1, discardLogger())
+			if applied != tt.applied {
+				t.Errorf("applied = %v, want %v", applied, tt.applied)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("stageFromPatch: %v", err)
+			}
+			if !tt.applied {
+				return
+			}
+			got, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, new) {
+				t.Error("staged file differs from the new file")
+			}
+		})
+	}
+}
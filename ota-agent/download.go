@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// partialPrefix names in-progress downloads; the suffix is the expected sha256
+const partialPrefix = ".ota-partial-"
+
+// partialMeta is persisted next to a partial download so it can be resumed
+// after a retry or an agent restart
+type partialMeta struct {
+	URL       string `json:"url"`
+	Validator string `json:"validator,omitempty"`  // ETag or Last-Modified, sent as If-Range
+	Offset    int64  `json:"offset"`               // bytes covered by HashState
+	HashState []byte `json:"hash_state,omitempty"` // marshalled sha256 state at Offset
+}
+
+// partialPath returns the stable resume file for a download into dir
+func partialPath(dir, sha string) string {
+	return filepath.Join(dir, partialPrefix+strings.ToLower(sha))
+}
+
+func readPartialMeta(path string) partialMeta {
+	var meta partialMeta
+	if b, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(b, &meta)
+	}
+	return meta
+}
+
+func writePartialMeta(path string, meta partialMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// partialDownload tracks a resumable download and its running sha256
+type partialDownload struct {
+	path     string
+	metaPath string
+	meta     partialMeta
+	hasher   hash.Hash
+	size     int64
+}
+
+// openPartial restores the hash state of an existing partial download.
+// The bytes already covered by the saved state are not read again.
+func openPartial(path, url string) (*partialDownload, error) {
+	pd := &partialDownload{path: path, metaPath: path + ".meta", hasher: sha256.New()}
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			pd.meta = partialMeta{URL: url}
+			return pd, nil
+		}
+		return nil, err
+	}
+	pd.meta = readPartialMeta(pd.metaPath)
+	if pd.meta.URL != url {
+		// Same content (keyed by sha256) from a different URL: keep the
+		// bytes but the old validator does not apply
+		pd.meta.URL = url
+		pd.meta.Validator = ""
+	}
+
+	offset := int64(0)
+	if pd.meta.Offset > 0 && pd.meta.Offset <= info.Size() {
+		if u, ok := pd.hasher.(encoding.BinaryUnmarshaler); ok && u.UnmarshalBinary(pd.meta.HashState) == nil {
+			offset = pd.meta.Offset
+		} else {
+			pd.hasher.Reset()
+		}
+	}
+	// Hash whatever was written after the last saved state
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(pd.hasher, f)
+	if err != nil {
+		return nil, err
+	}
+	pd.size = offset + n
+	return pd, nil
+}
+
+// save persists the current offset and hash state
+func (pd *partialDownload) save() error {
+	m, ok := pd.hasher.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	state, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	pd.meta.Offset = pd.size
+	pd.meta.HashState = state
+	return writePartialMeta(pd.metaPath, pd.meta)
+}
+
+// reset throws away the partial data
+func (pd *partialDownload) reset() {
+	_ = os.Remove(pd.path)
+	_ = os.Remove(pd.metaPath)
+	pd.hasher.Reset()
+	pd.size = 0
+	pd.meta = partialMeta{URL: pd.meta.URL}
+}
+
+// sum returns the hex sha256 of the bytes downloaded so far
+func (pd *partialDownload) sum() string {
+	return hex.EncodeToString(pd.hasher.Sum(nil))
+}
+
+// attempt performs one GET, resuming from the current size when possible.
+// Returns nil once the server has sent the complete body.
+func (pd *partialDownload) attempt(client *http.Client, agentID string, logger *Logger) error {
+	req, err := http.NewRequest("GET", pd.meta.URL, nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	if agentID != "" {
+		req.Header.Set("X-Agent-ID", agentID)
+	}
+	logger.Debug("GET %s (have %d bytes)", pd.meta.URL, pd.size)
+	if pd.size > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", pd.size))
+		if pd.meta.Validator != "" {
+			req.Header.Set("If-Range", pd.meta.Validator)
+		}
+		logger.Info("resuming download at byte %d", pd.size)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if pd.size > 0 {
+			logger.Warn("server sent the full file, discarding %d partial bytes", pd.size)
+			pd.reset()
+		}
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != pd.size {
+			pd.reset()
+			return fmt.Errorf("unexpected Content-Range %q, restarting download", resp.Header.Get("Content-Range"))
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Nothing left to fetch if the partial file has the full size; the
+		// caller verifies the hash. Otherwise the file on the server changed.
+		var total int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &total); err == nil && total == pd.size {
+			return nil
+		}
+		pd.reset()
+		return fmt.Errorf("range not satisfiable (Content-Range %q), restarting download", resp.Header.Get("Content-Range"))
+	default:
+		return fmt.Errorf("bad status %d", resp.StatusCode)
+	}
+
+	if v := resp.Header.Get("ETag"); v != "" && !strings.HasPrefix(v, "W/") {
+		pd.meta.Validator = v
+	} else if v := resp.Header.Get("Last-Modified"); v != "" {
+		pd.meta.Validator = v
+	}
+
+	f, err := os.OpenFile(pd.path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open partial: %w", err)
+	}
+	defer f.Close()
+	// Drop any bytes a failed write left beyond what has been hashed
+	if err := f.Truncate(pd.size); err != nil {
+		return fmt.Errorf("truncate partial: %w", err)
+	}
+	if _, err := f.Seek(pd.size, io.SeekStart); err != nil {
+		return fmt.Errorf("seek partial: %w", err)
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = pd.size + resp.ContentLength
+	}
+	pw := &progressWriter{
+		writer:    io.MultiWriter(f, pd.hasher),
+		total:     total,
+		written:   pd.size,
+		lastPrint: time.Now(),
+		logger:    logger,
+	}
+	_, err = io.Copy(pw, resp.Body)
+	pd.size = pw.written
+	if err != nil {
+		return fmt.Errorf("write partial: %w", err)
+	}
+	if pw.total > 0 {
+		logger.Info("download complete: %d bytes", pw.written)
+	}
+	return nil
+}
+
+// downloadFile downloads url into dest and verifies it against the expected sha256.
+// Data is accumulated in a partial file keyed by the expected sha256 next to
+// dest; failed attempts keep what was received so that later retries, and
+// later agent runs, resume with an HTTP Range request instead of starting over.
+// The hash is computed while writing, so the result is never read back.
+func downloadFile(url, dest, expectedSHA string, agentID string, timeout time.Duration, maxRetries int, logger *Logger) error {
+	client := &http.Client{Timeout: timeout}
+	start := time.Now()
+	pd, err := openPartial(partialPath(filepath.Dir(dest), expectedSHA), url)
+	if err != nil {
+		return fmt.Errorf("open partial download: %w", err)
+	}
+	if maxRetries < 1 {
+		maxRetries = 1
+	}
+
+	var lastErr error
+	for i := 0; i < maxRetries; i++ {
+		if i > 0 {
+			time.Sleep(2 * time.Second)
+		}
+		resumed := pd.size > 0
+		lastErr = pd.attempt(client, agentID, logger)
+		if lastErr == nil {
+			if strings.EqualFold(pd.sum(), expectedSHA) {
+				break
+			}
+			got := pd.sum()
+			pd.reset()
+			metrics.checksumMismatch()
+			lastErr = fmt.Errorf("sha256 mismatch: got=%s want=%s", got, expectedSHA)
+			if !resumed {
+				return lastErr
+			}
+			// The kept bytes may be from an older file behind the same
+			// URL; try again from the start
+			logger.Warn("resumed download does not match, restarting: %v", lastErr)
+			continue
+		}
+		if serr := pd.save(); serr != nil {
+			logger.Warn("failed to save partial download state: %v", serr)
+		}
+		logger.Warn("download attempt %d/%d failed (%d bytes kept): %v", i+1, maxRetries, pd.size, lastErr)
+	}
+	if lastErr != nil {
+		return fmt.Errorf("after %d retries: %w", maxRetries, lastErr)
+	}
+
+	metrics.observeDownload(time.Since(start))
+	logger.With("duration", time.Since(start)).Debug("download of %s finished", url)
+
+	_ = os.Remove(pd.metaPath)
+	if err := os.Rename(pd.path, dest); err != nil {
+		return fmt.Errorf("move download into place: %w", err)
+	}
+	return nil
+}
+
+// prunePartials removes partial downloads in dir that are not in keep
+func prunePartials(dir string, keep map[string]bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, partialPrefix) {
+			continue
+		}
+		sha := strings.TrimSuffix(strings.TrimPrefix(name, partialPrefix), ".meta")
+		if !keep[sha] {
+			_ = os.Remove(filepath.Join(dir, name))
+		}
+	}
+}
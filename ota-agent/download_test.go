@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveFile serves content with an ETag and honours Range and If-Range
+func serveFile(content []byte, etag string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}
+}
+
+// serveIgnoringRange always sends the whole file with 200
+func serveIgnoringRange(content []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content)
+	}
+}
+
+// serveInterrupted announces the whole file but drops the connection after n bytes
+func serveInterrupted(content []byte, etag string, n int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:n])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+}
+
+type rangeRequest struct {
+	Range, IfRange string
+}
+
+// scriptedServer answers the nth request with handlers[n], repeating the
+// last one, and records the Range headers of every request
+func scriptedServer(handlers ...http.HandlerFunc) (*httptest.Server, func() []rangeRequest) {
+	var mu sync.Mutex
+	var seen []rangeRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		h := handlers[min(len(seen), len(handlers)-1)]
+		seen = append(seen, rangeRequest{r.Header.Get("Range"), r.Header.Get("If-Range")})
+		mu.Unlock()
+		h(w, r)
+	}))
+	return srv, func() []rangeRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]rangeRequest(nil), seen...)
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	r := rand.New(rand.NewSource(6))
+	new := randomBytes(r, 8000)
+	old := randomBytes(r, 8000)
+	resumeAt := "bytes=1000-"
+	atEnd := "bytes=" + strconv.Itoa(len(new)) + "-"
+	tests := []struct {
+		name     string
+		partial  []byte           // left by an earlier run, without saved state
+		first    http.HandlerFunc // answers an earlier run that fails
+		then     []http.HandlerFunc
+		retries  int
+		wantReqs []rangeRequest // requests of the last run
+		wantErr  string
+	}{
+		{
+			name:     "fresh",
+			then:     []http.HandlerFunc{serveFile(new, `"b"`)},
+			wantReqs: []rangeRequest{{}},
+		},
+		{
+			name:     "resume after interrupted body",
+			first:    serveInterrupted(new, `"b"`, 1000),
+			then:     []http.HandlerFunc{serveFile(new, `"b"`)},
+			wantReqs: []rangeRequest{{resumeAt, `"b"`}},
+		},
+		{
+			name:     "server ignores range",
+			first:    serveInterrupted(new, `"b"`, 1000),
+			then:     []http.HandlerFunc{serveIgnoringRange(new)},
+			wantReqs: []rangeRequest{{resumeAt, `"b"`}},
+		},
+		{
+			name:     "changed etag",
+			first:    serveInterrupted(old, `"a"`, 1000),
+			then:     []http.HandlerFunc{serveFile(new, `"b"`)},
+			wantReqs: []rangeRequest{{resumeAt, `"a"`}},
+		},
+		{
+			name:     "changed file without validator",
+			first:    serveInterrupted(old, "", 1000),
+			then:     []http.HandlerFunc{serveFile(new, "")},
+			retries:  2,
+			wantReqs: []rangeRequest{{resumeAt, ""}, {}},
+		},
+		{
+			name:     "416 with the complete file",
+			partial:  new,
+			then:     []http.HandlerFunc{serveFile(new, `"b"`)},
+			wantReqs: []rangeRequest{{atEnd, ""}},
+		},
+		{
+			name:     "416 with other content of the same size",
+			partial:  old,
+			then:     []http.HandlerFunc{serveFile(new, `"b"`)},
+			retries:  2,
+			wantReqs: []rangeRequest{{atEnd, ""}, {}},
+		},
+		{
+			name:     "416 with a longer partial file",
+			partial:  append(append([]byte(nil), new...), 1, 2, 3),
+			then:     []http.HandlerFunc{serveFile(new, `"b"`)},
+			retries:  2,
+			wantReqs: []rangeRequest{{"bytes=8003-", ""}, {}},
+		},
+		{
+			name:     "416 is not retried forever",
+			partial:  old,
+			then:     []http.HandlerFunc{serveFile(new, `"b"`)},
+			retries:  1,
+			wantReqs: []rangeRequest{{atEnd, ""}},
+			wantErr:  "sha256 mismatch",
+		},
+		{
+			name:     "wrong file",
+			then:     []http.HandlerFunc{serveFile(old, `"a"`)},
+			retries:  2,
+			wantReqs: []rangeRequest{{}},
+			wantErr:  "sha256 mismatch",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlers := tt.then
+			if tt.first != nil {
+				handlers = append([]http.HandlerFunc{tt.first}, handlers...)
+			}
+			srv, requests := scriptedServer(handlers...)
+			defer srv.Close()
+
+			dir := t.TempDir()
+			dest := filepath.Join(dir, ".app.new")
+			sha := sha256Hex(new)
+			if tt.partial != nil {
+				if err := os.WriteFile(partialPath(dir, sha), tt.partial, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.first != nil {
+				if err := downloadFile(srv.URL+"/app", dest, sha, "", 5*time.Second, 1, discardLogger()); err == nil {
+					t.Fatal("interrupted download succeeded")
+				}
+				if info, err := os.Stat(partialPath(dir, sha)); err != nil || info.Size() != 1000 {
+					t.Fatalf("partial download not kept: %v", err)
+				}
+			}
+			skip := len(requests())
+
+			retries := tt.retries
+			if retries == 0 {
+				retries = 1
+			}
+			err := downloadFile(srv.URL+"/app", dest, sha, "", 5*time.Second, retries, discardLogger())
+
+			got := requests()[skip:]
+			if len(got) != len(tt.wantReqs) {
+				t.Errorf("requests = %q, want %q", got, tt.wantReqs)
+			} else {
+				for i := range got {
+					if got[i] != tt.wantReqs[i] {
+						t.Errorf("request %d = %q, want %q", i, got[i], tt.wantReqs[i])
+					}
+				}
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if _, err := os.Stat(partialPath(dir, sha)); !os.IsNotExist(err) {
+					t.Error("bad partial download was kept")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("downloadFile: %v", err)
+			}
+			b, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, new) {
+				t.Error("downloaded file differs")
+			}
+			for _, p := range []string{partialPath(dir, sha), partialPath(dir, sha) + ".meta"} {
+				if _, err := os.Stat(p); !os.IsNotExist(err) {
+					t.Errorf("%s left behind", filepath.Base(p))
+				}
+			}
+		})
+	}
+}
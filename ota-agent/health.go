@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// HealthCheck describes how to verify a freshly restarted build
+type HealthCheck struct {
+	MinUptime *time.Duration `yaml:"min_uptime"` // process must stay alive this long, 0 disables (default: -health-min-uptime)
+	HTTP      string         `yaml:"http"`       // optional: URL that must answer 2xx
+	TCP       string         `yaml:"tcp"`        // optional: host:port that must accept connections
+	Exec      Command        `yaml:"exec"`       // optional: command that must exit 0
+	Timeout   time.Duration  `yaml:"timeout"`    // per probe attempt timeout (default 5s)
+	Retries   int            `yaml:"retries"`    // probe attempts before giving up (default 3)
+	Interval  time.Duration  `yaml:"interval"`   // delay between probe attempts (default 2s)
+}
+
+// hasProbe reports whether any active probe is configured
+func (hc *HealthCheck) hasProbe() bool {
+	return hc.HTTP != "" || hc.TCP != "" || !hc.Exec.IsZero()
+}
+
+// withDefaults returns a copy of hc with unset fields filled in. An
+// explicit min_uptime of 0s is kept.
+func (hc *HealthCheck) withDefaults(minUptime time.Duration) HealthCheck {
+	out := HealthCheck{MinUptime: &minUptime}
+	if hc != nil {
+		out = *hc
+		if out.MinUptime == nil {
+			out.MinUptime = &minUptime
+		}
+	}
+	if out.Timeout <= 0 {
+		out.Timeout = 5 * time.Second
+	}
+	if out.Retries <= 0 {
+		out.Retries = 3
+	}
+	if out.Interval <= 0 {
+		out.Interval = 2 * time.Second
+	}
+	return out
+}
+
+// minUptime returns how long the restarted processes must stay up, 0 if
+// they are not watched
+func (hc *HealthCheck) minUptime() time.Duration {
+	if hc.MinUptime == nil {
+		return 0
+	}
+	return *hc.MinUptime
+}
+
+// runHealthGate waits for the restarted processes to stay up for MinUptime
+// and then runs the configured probes. pms is empty when nothing was restarted.
+func runHealthGate(pms []*ProcessManager, hc HealthCheck, logger *Logger) error {
+	minUptime := hc.minUptime()
+	if len(pms) > 0 && minUptime > 0 {
+		logger.Info("health gate: waiting %v for %d process(es) to stay alive", minUptime, len(pms))
+		startExits := make([]int, len(pms))
+		for i, pm := range pms {
+			startExits[i] = pm.ExitCount()
+		}
+		deadline := time.Now().Add(minUptime)
+		for time.Now().Before(deadline) {
+			time.Sleep(500 * time.Millisecond)
+			for i, pm := range pms {
+				if !pm.IsRunning() {
+					return fmt.Errorf("process %s is no longer running", pm.name)
+				}
+				if pm.ExitCount() > startExits[i] {
+					return fmt.Errorf("process %s exited within %v", pm.name, minUptime)
+				}
+			}
+		}
+	}
+
+	if !hc.hasProbe() {
+		return nil
+	}
+	var lastErr error
+	for i := 0; i < hc.Retries; i++ {
+		if i > 0 {
+			time.Sleep(hc.Interval)
+		}
+		logger.Debug("health gate: probe attempt %d/%d", i+1, hc.Retries)
+		if lastErr = probe(hc); lastErr == nil {
+			logger.Info("health gate: probe passed")
+			return nil
+		}
+		logger.Warn("health gate: probe attempt %d/%d failed: %v", i+1, hc.Retries, lastErr)
+	}
+	return fmt.Errorf("probe failed: %w", lastErr)
+}
+
+// probe runs every configured probe once
+func probe(hc HealthCheck) error {
+	if hc.HTTP != "" {
+		client := &http.Client{Timeout: hc.Timeout}
+		resp, err := client.Get(hc.HTTP)
+		if err != nil {
+			return fmt.Errorf("http: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("http: status %d", resp.StatusCode)
+		}
+	}
+	if hc.TCP != "" {
+		conn, err := net.DialTimeout("tcp", hc.TCP, hc.Timeout)
+		if err != nil {
+			return fmt.Errorf("tcp: %w", err)
+		}
+		conn.Close()
+	}
+	if !hc.Exec.IsZero() {
+		cmd, err := CommandSpec{Command: hc.Exec}.build(context.Background())
+		if err != nil {
+			return fmt.Errorf("exec: %w", err)
+		}
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("exec: %w", err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err := <-done:
+			if err != nil {
+				return fmt.Errorf("exec: %w", err)
+			}
+		case <-time.After(hc.Timeout):
+			cmd.Process.Kill()
+			<-done
+			return fmt.Errorf("exec: timed out after %v", hc.Timeout)
+		}
+	}
+	return nil
+}
+
+// ReplacedFile records a target replaced during an update and its backup
+type ReplacedFile struct {
+	Target string // replaced file
+	Backup string // .bak copy of the previous file, empty if there was none
+}
+
+// restoreBackups puts the previous files back in place, newest first.
+// Targets without a backup were created by the update and are removed.
+func restoreBackups(replaced []ReplacedFile, logger *Logger) error {
+	var firstErr error
+	for i := len(replaced) - 1; i >= 0; i-- {
+		r := replaced[i]
+		var err error
+		if r.Backup == "" {
+			err = os.Remove(r.Target)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = renameFile(r.Backup, r.Target)
+		}
+		if err != nil {
+			logger.Error("rollback failed for %s: %v", r.Target, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		logger.Info("rolled back %s", r.Target)
+	}
+	return firstErr
+}
+
+// badVersionsFile returns the path that records versions which failed the health gate
+func badVersionsFile(versionFile string) string {
+	return versionFile + ".bad"
+}
+
+// isBadVersion reports whether version was previously rolled back, also
+// when it was recorded in another spelling of the same release such as
+// "v1.2.0" for "1.2.0"
+func isBadVersion(versionFile, version string) bool {
+	b, err := os.ReadFile(badVersionsFile(versionFile))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" && sameVersion(line, version) {
+			return true
+		}
+	}
+	return false
+}
+
+// markBadVersion records version so that it is not installed again
+func markBadVersion(versionFile, version string) error {
+	if isBadVersion(versionFile, version) {
+		return nil
+	}
+	f, err := os.OpenFile(badVersionsFile(versionFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, version)
+	return err
+}
+
+// rollbackUpdate undoes an applied update: restores the backups (or the
+// previous slot release), resets the version file to the previous version
+// and marks the new version as bad
+func rollbackUpdate(result UpdateResult, opts UpdateOptions, logger *Logger) error {
+	versionFile := opts.VersionFile
+	logger.Warn("rolling back %s to %q", result.RemoteVersion, result.PreviousVersion)
+	var err error
+	if opts.Slots != nil {
+		if err = opts.Slots.Rollback(result.PreviousRelease); err == nil {
+			logger.Info("current release switched back to %q", result.PreviousRelease)
+		}
+	} else {
+		err = restoreBackups(result.Replaced, logger)
+	}
+
+	if result.PreviousVersion != "" {
+		if werr := writeLocalVersion(versionFile, result.PreviousVersion); werr != nil {
+			logger.Error("restore version file failed: %v", werr)
+		}
+	} else if rerr := os.Remove(versionFile); rerr != nil && !os.IsNotExist(rerr) {
+		logger.Error("remove version file failed: %v", rerr)
+	}
+
+	if perr := writeProcessSpecs(versionFile, result.PrevProcesses); perr != nil {
+		logger.Error("restore processes file failed: %v", perr)
+	}
+
+	if merr := markBadVersion(versionFile, result.RemoteVersion); merr != nil {
+		logger.Error("failed to mark version %s as bad: %v", result.RemoteVersion, merr)
+	} else {
+		logger.Info("version %s marked as bad, it will not be retried", result.RemoteVersion)
+	}
+	return err
+}
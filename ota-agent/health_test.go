@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestIsBadVersion(t *testing.T) {
+	versionFile := filepath.Join(t.TempDir(), "version")
+	for _, v := range []string{"1.2.0", "v2.0.0+build.7", "build-42", badAgentKey("ABCDEF")} {
+		if err := markBadVersion(versionFile, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"1.2.0", true},
+		{"v1.2.0", true},
+		{"1.2.0+build.1", false},
+		{"1.2.0-rc.1", false},
+		{"2.0.0+build.7", true},
+		{"2.0.0+build.8", false},
+		{"build-42", true},
+		{"build-4", false},
+		{badAgentKey("abcdef"), true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isBadVersion(versionFile, tt.version); got != tt.want {
+			t.Errorf("isBadVersion(%q) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestHealthCheckMinUptime(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string // health_check of the config, "" if none
+		want time.Duration
+	}{
+		{name: "no health check", want: 10 * time.Second},
+		{name: "unset", yaml: "http: http://127.0.0.1/healthz", want: 10 * time.Second},
+		{name: "explicit zero", yaml: "min_uptime: 0s", want: 0},
+		{name: "set", yaml: "min_uptime: 30s", want: 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hc *HealthCheck
+			if tt.yaml != "" {
+				hc = &HealthCheck{}
+				if err := yaml.Unmarshal([]byte(tt.yaml), hc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := hc.withDefaults(10 * time.Second)
+			if got.minUptime() != tt.want {
+				t.Errorf("min uptime = %v, want %v", got.minUptime(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultHookTimeout bounds hooks and restart commands unless the config
+// sets hooks.timeout
+const defaultHookTimeout = 60 * time.Second
+
+// Hooks are release-wide lifecycle commands declared in the config
+type Hooks struct {
+	PreInstall  Command       `yaml:"pre_install"`  // optional: run before any file is replaced; failure aborts the update
+	PostInstall Command       `yaml:"post_install"` // optional: run after all files are committed
+	PreRestart  Command       `yaml:"pre_restart"`  // optional: run before processes are restarted after an update
+	OnRollback  Command       `yaml:"on_rollback"`  // optional: run after the files of a failed update were restored
+	Timeout     time.Duration `yaml:"timeout"`      // per hook (default 60s)
+}
+
+// withDefaults returns a copy of h with unset fields filled in
+func (h *Hooks) withDefaults() Hooks {
+	var out Hooks
+	if h != nil {
+		out = *h
+	}
+	if out.Timeout <= 0 {
+		out.Timeout = defaultHookTimeout
+	}
+	return out
+}
+
+// hookEnv describes an update to hook commands
+type hookEnv struct {
+	Dir        string        // working directory, empty for the agent's own
+	Timeout    time.Duration // per command
+	AgentID    string
+	OldVersion string   // version installed before the update
+	NewVersion string   // version being installed
+	Files      []string // targets of the files the update changes
+}
+
+// environ returns the variables describing the update
+func (e hookEnv) environ() []string {
+	return append([]string(nil),
+		"OTA_OLD_VERSION="+e.OldVersion,
+		"OTA_NEW_VERSION="+e.NewVersion,
+		"OTA_FILES="+strings.Join(e.Files, " "),
+		"OTA_AGENT_ID="+e.AgentID,
+	)
+}
+
+// run runs a one-shot command to completion, logging its output line by
+// line
+func (e hookEnv) run(c Command, logger *Logger) error {
+	if c.IsZero() {
+		return nil
+	}
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd, err := CommandSpec{Command: c, Dir: e.Dir}.build(ctx)
+	if err != nil {
+		return err
+	}
+	cmd.Env = append(cmd.Environ(), e.environ()...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Children left behind by a killed hook must not keep Run waiting on the pipe
+	cmd.WaitDelay = time.Second
+
+	logger.Info("running %s", c)
+	start := time.Now()
+	err = cmd.Run()
+	for _, line := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n") {
+		if line != "" {
+			logger.Info("| %s", line)
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s: timed out after %v", c, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", c, err)
+	}
+	logger.With("duration", time.Since(start)).Debug("%s finished", c)
+	return nil
+}
+
+// runNamed runs a release-wide hook; an empty command is a no-op
+func (e hookEnv) runNamed(name string, c Command, logger *Logger) error {
+	if c.IsZero() {
+		return nil
+	}
+	if err := e.run(c, logger.With("hook", name)); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// fileHooks returns the distinct hook commands of the changed files, in
+// file order. hook selects pre_hook or post_hook.
+func fileHooks(files []FileUpdate, changed map[string]bool, hook func(FileUpdate) Command) []Command {
+	var cmds []Command
+	seen := make(map[string]bool)
+	for _, f := range files {
+		cmd := hook(f)
+		if cmd.IsZero() || !changed[f.Name] || seen[cmd.String()] {
+			continue
+		}
+		seen[cmd.String()] = true
+		cmds = append(cmds, cmd)
+	}
+	return cmds
+}
+
+// runFileHooks runs the given hooks one after the other and stops at the
+// first failure
+func runFileHooks(cmds []Command, env hookEnv, logger *Logger) error {
+	for _, cmd := range cmds {
+		if err := env.run(cmd, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restartPlan works out what the changed files of a release restart.
+// Configs that set restart or restart_cmd on any file only restart what
+// those files ask for: the main command for files marked restart, and each
+// distinct per-file restart_cmd once. Older configs without per-file
+// settings restart the global restart_cmd after every update.
+func restartPlan(cfg *Config, changed map[string]bool) (restartMain bool, cmds []Command) {
+	perFile := false
+	for _, f := range cfg.Files {
+		if f.Restart || !f.RestartCmd.IsZero() {
+			perFile = true
+			break
+		}
+	}
+	if !perFile {
+		return !cfg.RestartCmd.IsZero(), nil
+	}
+	for _, f := range cfg.Files {
+		if f.Restart && changed[f.Name] {
+			restartMain = true
+		}
+	}
+	return restartMain, fileHooks(cfg.Files, changed, func(f FileUpdate) Command { return f.RestartCmd })
+}
+
+// runPostHooks runs the post_hook of every changed file once. A failing
+// hook does not undo the update; its error is recorded on the reports of
+// the files it belongs to.
+func runPostHooks(files []FileUpdate, reports []FileReport, env hookEnv, logger *Logger) {
+	changed := changedFiles(reports)
+	for _, cmd := range fileHooks(files, changed, func(f FileUpdate) Command { return f.PostHook }) {
+		err := env.run(cmd, logger)
+		if err == nil {
+			continue
+		}
+		logger.Error("post_hook failed: %v", err)
+		for i, f := range files {
+			if f.PostHook.Equal(cmd) && changed[f.Name] {
+				reports[i].Error = "post_hook: " + err.Error()
+			}
+		}
+	}
+}
+
+// fileTargets returns the targets of the reports with the given outcome
+func fileTargets(reports []FileReport, outcome string) []string {
+	var targets []string
+	for _, r := range reports {
+		if r.Outcome == outcome {
+			targets = append(targets, r.Target)
+		}
+	}
+	return targets
+}
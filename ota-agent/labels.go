@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var labelKeyRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// Labels describe the agent to the selectors of a config, e.g. arch=arm64
+// board=rpi4 region=eu
+type Labels map[string]string
+
+// builtinLabels returns the labels every agent has
+func builtinLabels() Labels {
+	return Labels{"arch": agentArch(), "os": runtime.GOOS}
+}
+
+// agentArch returns GOARCH, with the ARM version the agent was built for
+// on 32-bit ARM (armv6, armv7)
+func agentArch() string {
+	if runtime.GOARCH != "arm" {
+		return runtime.GOARCH
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "GOARM" && s.Value != "" {
+				return "armv" + s.Value[:1]
+			}
+		}
+	}
+	return "arm"
+}
+
+// parseLabel parses a "<key>=<value>" label
+func parseLabel(spec string) (string, string, error) {
+	key, value, ok := strings.Cut(spec, "=")
+	key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+	if !ok || !labelKeyRegex.MatchString(key) || value == "" {
+		return "", "", fmt.Errorf("label %q is not <key>=<value>", spec)
+	}
+	return key, value, nil
+}
+
+// loadLabels merges the builtin labels, the labels file (one key=value per
+// line, # starts a comment) and the -label flags; later ones win
+func loadLabels(specs []string, file string) (Labels, error) {
+	labels := builtinLabels()
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for n := 1; sc.Scan(); n++ {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, value, err := parseLabel(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", file, n, err)
+			}
+			labels[key] = value
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range specs {
+		key, value, err := parseLabel(spec)
+		if err != nil {
+			return nil, err
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// String returns the labels as sorted key=value pairs
+func (l Labels) String() string {
+	pairs := make([]string, 0, len(l))
+	for k, v := range l {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// labelValues is a label value or a list of alternatives
+type labelValues []string
+
+// UnmarshalYAML accepts a scalar or a sequence of scalars
+func (v *labelValues) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		*v = labelValues{n.Value}
+		return nil
+	}
+	var list []string
+	if err := n.Decode(&list); err != nil {
+		return err
+	}
+	*v = list
+	return nil
+}
+
+// Selector matches agents having every key with one of the listed values.
+// An empty selector matches every agent.
+type Selector map[string]labelValues
+
+// Matches reports whether an agent with labels is selected
+func (s Selector) Matches(labels Labels) bool {
+	for key, values := range s {
+		have, ok := labels[key]
+		if !ok {
+			return false
+		}
+		match := false
+		for _, v := range values {
+			if v == have {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks the keys and values of a selector
+func (s Selector) validate() error {
+	for key, values := range s {
+		if !labelKeyRegex.MatchString(key) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("%s: no values", key)
+		}
+	}
+	return nil
+}
+
+// Variant adds files, processes or an agent binary for the agents its
+// selector matches. A file or process with the name of one already
+// selected replaces it. A file of a variant with its own selector is only
+// added for the agents both selectors match.
+type Variant struct {
+	Selector  Selector      `yaml:"selector"`
+	Files     []FileUpdate  `yaml:"files"`
+	Processes []ProcessSpec `yaml:"processes"`
+	Self      *SelfUpdate   `yaml:"self"` // replaces the self entry of the config
+}
+
+// selectFor narrows cfg to the files, processes and agent binary that
+// apply to an agent with labels. Variants are applied in order.
+func (cfg *Config) selectFor(labels Labels) error {
+	files := make([]FileUpdate, 0, len(cfg.Files))
+	for i, f := range cfg.Files {
+		if err := f.Selector.validate(); err != nil {
+			return fmt.Errorf("files[%d].selector: %w", i, err)
+		}
+		if f.Selector.Matches(labels) {
+			files = append(files, f)
+		}
+	}
+	processes := append([]ProcessSpec(nil), cfg.Processes...)
+	declared := len(cfg.Files)
+	for i, v := range cfg.Variants {
+		if err := v.Selector.validate(); err != nil {
+			return fmt.Errorf("variants[%d].selector: %w", i, err)
+		}
+		for j, f := range v.Files {
+			if err := f.Selector.validate(); err != nil {
+				return fmt.Errorf("variants[%d].files[%d].selector: %w", i, j, err)
+			}
+		}
+		declared += len(v.Files)
+		if !v.Selector.Matches(labels) {
+			continue
+		}
+		for _, f := range v.Files {
+			if !f.Selector.Matches(labels) {
+				continue
+			}
+			j := 0
+			for j < len(files) && files[j].Name != f.Name {
+				j++
+			}
+			if j < len(files) {
+				files[j] = f
+			} else {
+				files = append(files, f)
+			}
+		}
+		for _, p := range v.Processes {
+			j := 0
+			for j < len(processes) && processes[j].Name != p.Name {
+				j++
+			}
+			if j < len(processes) {
+				processes[j] = p
+			} else {
+				processes = append(processes, p)
+			}
+		}
+		if v.Self != nil {
+			cfg.Self = v.Self
+		}
+	}
+	if declared > 0 && len(files) == 0 {
+		return fmt.Errorf("no files are selected for the agent labels %s", labels)
+	}
+	cfg.Files, cfg.Processes, cfg.Variants = files, processes, nil
+	return nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseLabel(t *testing.T) {
+	tests := []struct {
+		spec       string
+		key, value string
+		wantErr    bool
+	}{
+		{spec: "board=rpi4", key: "board", value: "rpi4"},
+		{spec: " region = eu ", key: "region", value: "eu"},
+		{spec: "example.com/site=sh-01", key: "example.com/site", value: "sh-01"},
+		{spec: "k=a=b", key: "k", value: "a=b"},
+		{spec: "board", wantErr: true},
+		{spec: "board=", wantErr: true},
+		{spec: "=rpi4", wantErr: true},
+		{spec: "-board=rpi4", wantErr: true},
+		{spec: "bo ard=rpi4", wantErr: true},
+	}
+	for _, tt := range tests {
+		key, value, err := parseLabel(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseLabel(%q) = %q, %q, want an error", tt.spec, key, value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLabel(%q): %v", tt.spec, err)
+			continue
+		}
+		if key != tt.key || value != tt.value {
+			t.Errorf("parseLabel(%q) = %q, %q, want %q, %q", tt.spec, key, value, tt.key, tt.value)
+		}
+	}
+}
+
+func TestLoadLabels(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "labels")
+	content := "# device labels\nboard=rpi4\n\nregion=eu\narch=armv7\n"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	labels, err := loadLabels([]string{"region=cn", "site=sh-01"}, file)
+	if err != nil {
+		t.Fatalf("loadLabels: %v", err)
+	}
+	want := builtinLabels()
+	want["board"] = "rpi4"
+	want["region"] = "cn"  // flags win over the file
+	want["arch"] = "armv7" // the file wins over the builtin labels
+	want["site"] = "sh-01"
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("loadLabels = %v, want %v", labels, want)
+	}
+
+	bad := filepath.Join(t.TempDir(), "labels")
+	if err := os.WriteFile(bad, []byte("board=rpi4\nregion\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadLabels(nil, bad); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("loadLabels of a bad line = %v, want an error naming line 2", err)
+	}
+	if _, err := loadLabels([]string{"board"}, ""); err == nil {
+		t.Errorf("loadLabels of a bad flag succeeded, want an error")
+	}
+}
+
+func TestSelectorUnmarshal(t *testing.T) {
+	tests := []struct {
+		yaml    string
+		want    Selector
+		wantErr bool
+	}{
+		{yaml: "{arch: amd64}", want: Selector{"arch": {"amd64"}}},
+		{yaml: "{arch: [arm64, armv7], os: linux}", want: Selector{"arch": {"arm64", "armv7"}, "os": {"linux"}}},
+		{yaml: "{}", want: Selector{}},
+		{yaml: "{arch: {a: b}}", wantErr: true},
+	}
+	for _, tt := range tests {
+		var got Selector
+		err := yaml.Unmarshal([]byte(tt.yaml), &got)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("unmarshal %s = %v, want an error", tt.yaml, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unmarshal %s: %v", tt.yaml, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("unmarshal %s = %v, want %v", tt.yaml, got, tt.want)
+		}
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := Labels{"arch": "arm64", "os": "linux", "region": "eu"}
+	tests := []struct {
+		selector Selector
+		want     bool
+	}{
+		{nil, true},
+		{Selector{}, true},
+		{Selector{"arch": {"arm64"}}, true},
+		{Selector{"arch": {"amd64"}}, false},
+		{Selector{"arch": {"amd64", "arm64"}}, true},
+		{Selector{"arch": {"arm64"}, "region": {"eu"}}, true},
+		{Selector{"arch": {"arm64"}, "region": {"cn"}}, false},
+		{Selector{"board": {"rpi4"}}, false},
+		{Selector{"arch": {"ARM64"}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.selector.Matches(labels); got != tt.want {
+			t.Errorf("%v.Matches(%v) = %v, want %v", tt.selector, labels, got, tt.want)
+		}
+	}
+}
+
+func TestSelectorValidate(t *testing.T) {
+	tests := []struct {
+		selector Selector
+		wantErr  bool
+	}{
+		{Selector{"arch": {"amd64"}}, false},
+		{Selector{"example.com/site": {"a", "b"}}, false},
+		{Selector{"": {"amd64"}}, true},
+		{Selector{"bad key": {"amd64"}}, true},
+		{Selector{"arch": {}}, true},
+	}
+	for _, tt := range tests {
+		err := tt.selector.validate()
+		if tt.wantErr != (err != nil) {
+			t.Errorf("%v.validate() error = %v, want error %v", tt.selector, err, tt.wantErr)
+		}
+	}
+}
+
+// selectedNames returns the names and targets of the selected files and the
+// names of the selected processes
+func selectedNames(cfg *Config) (files, processes []string) {
+	for _, f := range cfg.Files {
+		files = append(files, f.Name+":"+f.Target)
+	}
+	for _, p := range cfg.Processes {
+		processes = append(processes, p.Name)
+	}
+	return files, processes
+}
+
+func TestSelectFor(t *testing.T) {
+	const config = `
+version: "1.3.0"
+files:
+  - name: app
+    selector: {arch: amd64}
+    target: /usr/bin/app-amd64
+  - name: app
+    selector: {arch: [arm64, armv7]}
+    target: /usr/bin/app-arm
+  - name: app.conf
+    target: /etc/app.conf
+processes:
+  - name: app
+    command: ["/usr/bin/app"]
+variants:
+  - selector: {region: cn}
+    files:
+      - name: app.conf
+        target: /etc/app-cn.conf
+      - name: extra
+        target: /usr/bin/extra
+    processes:
+      - name: extra
+        command: ["/usr/bin/extra"]
+  - selector: {region: cn, arch: amd64}
+    files:
+      - name: app
+        target: /usr/bin/app-amd64-cn
+    self:
+      url: http://server.com/agent-amd64
+`
+	tests := []struct {
+		name          string
+		labels        Labels
+		wantFiles     []string
+		wantProcesses []string
+		wantSelf      string
+		wantErr       string
+	}{
+		{
+			name:          "amd64",
+			labels:        Labels{"arch": "amd64", "os": "linux"},
+			wantFiles:     []string{"app:/usr/bin/app-amd64", "app.conf:/etc/app.conf"},
+			wantProcesses: []string{"app"},
+		},
+		{
+			name:          "one of several values",
+			labels:        Labels{"arch": "armv7", "os": "linux"},
+			wantFiles:     []string{"app:/usr/bin/app-arm", "app.conf:/etc/app.conf"},
+			wantProcesses: []string{"app"},
+		},
+		{
+			name:          "variant replaces and adds",
+			labels:        Labels{"arch": "arm64", "region": "cn"},
+			wantFiles:     []string{"app:/usr/bin/app-arm", "app.conf:/etc/app-cn.conf", "extra:/usr/bin/extra"},
+			wantProcesses: []string{"app", "extra"},
+		},
+		{
+			name:          "variants apply in order",
+			labels:        Labels{"arch": "amd64", "region": "cn"},
+			wantFiles:     []string{"app:/usr/bin/app-amd64-cn", "app.conf:/etc/app-cn.conf", "extra:/usr/bin/extra"},
+			wantProcesses: []string{"app", "extra"},
+			wantSelf:      "http://server.com/agent-amd64",
+		},
+		{
+			name:          "no file for the arch",
+			labels:        Labels{"arch": "riscv64"},
+			wantFiles:     []string{"app.conf:/etc/app.conf"},
+			wantProcesses: []string{"app"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			if err := yaml.Unmarshal([]byte(config), &cfg); err != nil {
+				t.Fatal(err)
+			}
+			if err := cfg.selectFor(tt.labels); err != nil {
+				t.Fatalf("selectFor: %v", err)
+			}
+			files, processes := selectedNames(&cfg)
+			if !reflect.DeepEqual(files, tt.wantFiles) {
+				t.Errorf("files = %v, want %v", files, tt.wantFiles)
+			}
+			if !reflect.DeepEqual(processes, tt.wantProcesses) {
+				t.Errorf("processes = %v, want %v", processes, tt.wantProcesses)
+			}
+			self := ""
+			if cfg.Self != nil {
+				self = cfg.Self.URL
+			}
+			if self != tt.wantSelf {
+				t.Errorf("self = %q, want %q", self, tt.wantSelf)
+			}
+			if cfg.Variants != nil {
+				t.Errorf("variants left in the selected config")
+			}
+		})
+	}
+}
+
+func TestSelectForErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:    "nothing selected",
+			config:  "files:\n  - name: app\n    selector: {arch: amd64}\n",
+			wantErr: "no files are selected",
+		},
+		{
+			name:    "bad file selector",
+			config:  "files:\n  - name: app\n    selector: {\"bad key\": x}\n",
+			wantErr: "files[0].selector",
+		},
+		{
+			name:    "bad variant selector",
+			config:  "files:\n  - name: app\nvariants:\n  - selector: {arch: []}\n",
+			wantErr: "variants[0].selector",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			if err := yaml.Unmarshal([]byte(tt.config), &cfg); err != nil {
+				t.Fatal(err)
+			}
+			err := cfg.selectFor(Labels{"arch": "arm64"})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("selectFor error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSelectForVariantFileSelectors(t *testing.T) {
+	const config = `
+files:
+  - name: app
+    target: /usr/bin/app
+variants:
+  - selector: {region: cn}
+    files:
+      - name: app
+        selector: {arch: arm64}
+        target: /usr/bin/app-cn-arm64
+      - name: tool
+        selector: {arch: amd64}
+        target: /usr/bin/tool-amd64
+`
+	tests := []struct {
+		labels    Labels
+		wantFiles []string
+	}{
+		{Labels{"arch": "arm64", "region": "cn"}, []string{"app:/usr/bin/app-cn-arm64"}},
+		{Labels{"arch": "amd64", "region": "cn"}, []string{"app:/usr/bin/app", "tool:/usr/bin/tool-amd64"}},
+		{Labels{"arch": "arm64", "region": "eu"}, []string{"app:/usr/bin/app"}},
+	}
+	for _, tt := range tests {
+		var cfg Config
+		if err := yaml.Unmarshal([]byte(config), &cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.selectFor(tt.labels); err != nil {
+			t.Fatalf("selectFor(%v): %v", tt.labels, err)
+		}
+		if files, _ := selectedNames(&cfg); !reflect.DeepEqual(files, tt.wantFiles) {
+			t.Errorf("selectFor(%v) files = %v, want %v", tt.labels, files, tt.wantFiles)
+		}
+	}
+
+	// A bad selector is rejected even where the variant does not apply
+	bad := "files:\n  - name: app\nvariants:\n  - selector: {region: cn}\n    files:\n      - name: app\n        selector: {\"\": x}\n"
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(bad), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.selectFor(Labels{"region": "eu"}); err == nil || !strings.Contains(err.Error(), "variants[0].files[0].selector") {
+		t.Errorf("selectFor error = %v, want the bad variant file selector", err)
+	}
+}
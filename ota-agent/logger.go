@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is a log severity
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (lv Level) String() string {
+	return levelNames[lv]
+}
+
+// parseLevel parses debug, info, warn or error
+func parseLevel(s string) (Level, error) {
+	for lv, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return lv, nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
+// LogOptions selects the log format, level and destination
+type LogOptions struct {
+	Format     string // text or json
+	Level      string // debug, info, warn or error
+	File       string // log file path, empty for stdout/stderr
+	MaxSize    int64  // rotate the file once it exceeds this many bytes (0 disables rotation)
+	MaxBackups int    // rotated files kept as <file>.1 ... <file>.N
+}
+
+// logSink is the output shared by a logger and all loggers derived from it
+type logSink struct {
+	mu     sync.Mutex
+	json   bool
+	level  Level
+	stdout io.Writer // debug and info
+	stderr io.Writer // warn and error
+}
+
+// Logger writes leveled log lines, as text or as JSON objects, carrying
+// the context fields attached with With
+type Logger struct {
+	sink   *logSink
+	fields []logField
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// newLogger builds a logger from command line options. Without a file,
+// debug and info go to stdout and warnings and errors to stderr.
+func newLogger(opts LogOptions) (*Logger, error) {
+	level, err := parseLevel(opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	sink := &logSink{level: level, stdout: os.Stdout, stderr: os.Stderr}
+	switch opts.Format {
+	case "", "text":
+	case "json":
+		sink.json = true
+	default:
+		return nil, fmt.Errorf("unknown log format %q (want text or json)", opts.Format)
+	}
+	if opts.File != "" {
+		f, err := openRotatingFile(opts.File, opts.MaxSize, opts.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sink.stdout, sink.stderr = f, f
+	}
+	return &Logger{sink: sink}, nil
+}
+
+// With returns a logger that adds the given key/value pairs to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]logField, len(l.fields), len(l.fields)+len(kv)/2)
+	copy(fields, l.fields)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		replaced := false
+		for j := range fields {
+			if fields[j].key == key {
+				fields[j].value = kv[i+1]
+				replaced = true
+			}
+		}
+		if !replaced {
+			fields = append(fields, logField{key, kv[i+1]})
+		}
+	}
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+func (l *Logger) Debug(format string, v ...interface{}) {
+	l.output(LevelDebug, format, v...)
+}
+
+func (l *Logger) Info(format string, v ...interface{}) {
+	l.output(LevelInfo, format, v...)
+}
+
+func (l *Logger) Warn(format string, v ...interface{}) {
+	l.output(LevelWarn, format, v...)
+}
+
+func (l *Logger) Error(format string, v ...interface{}) {
+	l.output(LevelError, format, v...)
+}
+
+func (l *Logger) output(level Level, format string, v ...interface{}) {
+	if level < l.sink.level {
+		return
+	}
+	now := time.Now()
+	msg := fmt.Sprintf(format, v...)
+
+	var buf bytes.Buffer
+	if l.sink.json {
+		buf.WriteString(`{"time":`)
+		writeJSONValue(&buf, now.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSONValue(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSONValue(&buf, msg)
+		for _, f := range l.fields {
+			buf.WriteByte(',')
+			writeJSONValue(&buf, f.key)
+			buf.WriteByte(':')
+			if d, ok := f.value.(time.Duration); ok {
+				// Durations are exported in seconds
+				writeJSONValue(&buf, d.Seconds())
+			} else {
+				writeJSONValue(&buf, f.value)
+			}
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "[%s] %s %s", strings.ToUpper(level.String()), now.Format("2006/01/02 15:04:05"), msg)
+		for _, f := range l.fields {
+			s := fmt.Sprint(f.value)
+			if s == "" || strings.ContainsAny(s, " \t\"=") {
+				s = strconv.Quote(s)
+			}
+			fmt.Fprintf(&buf, " %s=%s", f.key, s)
+		}
+		buf.WriteByte('\n')
+	}
+
+	out := l.sink.stdout
+	if level >= LevelWarn {
+		out = l.sink.stderr
+	}
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	_, _ = out.Write(buf.Bytes())
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// rotatingFile is an append-only log file rotated by size, and optionally
+// by age. On rotation <path> becomes <path>.1, <path>.1 becomes <path>.2
+// and so on; files beyond maxBackups are removed.
+type rotatingFile struct {
+	mu          sync.Mutex
+	path        string
+	maxSize     int64
+	maxBackups  int
+	rotateEvery time.Duration // rotate once the file has been open this long (0 disables)
+	file        *os.File
+	size        int64
+	openedAt    time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("create log directory: %w", err)
+	}
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat log file: %w", err)
+	}
+	rf.file, rf.size, rf.openedAt = f, info.Size(), time.Now()
+	return nil
+}
+
+// backupPath returns the name of the n-th rotated file
+func (rf *rotatingFile) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", rf.path, n)
+}
+
+func (rf *rotatingFile) rotate() error {
+	err := rf.file.Close()
+	rf.file = nil
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(rf.backupPath(rf.maxBackups + 1))
+	for n := rf.maxBackups - 1; n >= 1; n-- {
+		_ = os.Rename(rf.backupPath(n), rf.backupPath(n+1))
+	}
+	if rf.maxBackups > 0 {
+		_ = os.Rename(rf.path, rf.backupPath(1))
+	} else {
+		_ = os.Remove(rf.path)
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	tooBig := rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize
+	tooOld := rf.rotateEvery > 0 && time.Since(rf.openedAt) >= rf.rotateEvery
+	if rf.file != nil && rf.size > 0 && (tooBig || tooOld) {
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+	if rf.file == nil {
+		// Reopen after a failed rotation
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
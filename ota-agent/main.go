@@ -1,20 +1,21 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -23,45 +24,35 @@ import (
 
 // FileUpdate represents a single file update
 type FileUpdate struct {
-	Name    string `yaml:"name"`    // file name/identifier
-	URL     string `yaml:"url"`     // download URL
-	SHA256  string `yaml:"sha256"`  // file sha256 hex
-	Target  string `yaml:"target"`  // target path to replace
-	Version string `yaml:"version"` // file version (optional, defaults to config version)
+	Name       string   `yaml:"name"`        // file name/identifier
+	URL        string   `yaml:"url"`         // download URL
+	SHA256     string   `yaml:"sha256"`      // file sha256 hex
+	Target     string   `yaml:"target"`      // target path to replace
+	Version    string   `yaml:"version"`     // file version (optional, defaults to config version)
+	Patches    []Patch  `yaml:"patches"`     // optional: delta patches keyed by base sha256
+	Restart    bool     `yaml:"restart"`     // optional: restart the main process when this file changes
+	RestartCmd Command  `yaml:"restart_cmd"` // optional: command run once after commit when this file changes
+	PreHook    Command  `yaml:"pre_hook"`    // optional: command run before the file is replaced; failure aborts the update
+	PostHook   Command  `yaml:"post_hook"`   // optional: command run after all files are committed
+	Selector   Selector `yaml:"selector"`    // optional: agent labels the file is for, e.g. {arch: arm64}
 }
 
 // Config represents the structure of version.yaml on the server
 type Config struct {
-	Version    string       `yaml:"version"`     // e.g. "1.2.0"
-	Files      []FileUpdate `yaml:"files"`       // list of files to update
-	RestartCmd string       `yaml:"restart_cmd"` // optional: global restart command after all updates
-}
-
-// Logger wraps log functions for structured logging
-type Logger struct {
-	info  *log.Logger
-	warn  *log.Logger
-	error *log.Logger
-}
-
-func newLogger() *Logger {
-	return &Logger{
-		info:  log.New(os.Stdout, "[INFO] ", log.LstdFlags),
-		warn:  log.New(os.Stderr, "[WARN] ", log.LstdFlags),
-		error: log.New(os.Stderr, "[ERROR] ", log.LstdFlags),
-	}
-}
-
-func (l *Logger) Info(format string, v ...interface{}) {
-	l.info.Printf(format, v...)
-}
-
-func (l *Logger) Warn(format string, v ...interface{}) {
-	l.warn.Printf(format, v...)
-}
-
-func (l *Logger) Error(format string, v ...interface{}) {
-	l.error.Printf(format, v...)
+	Version     string        `yaml:"version"`      // e.g. "1.2.0"
+	Files       []FileUpdate  `yaml:"files"`        // list of files to update
+	RestartCmd  CommandSpec   `yaml:"restart_cmd"`  // optional: global restart command after all updates
+	HealthCheck *HealthCheck  `yaml:"health_check"` // optional: post-update health gate
+	Hooks       *Hooks        `yaml:"hooks"`        // optional: lifecycle hook commands
+	Processes   []ProcessSpec `yaml:"processes"`    // optional: supervised processes and the files they depend on
+	Self        *SelfUpdate   `yaml:"self"`         // optional: ota-agent binary, installed before the files
+	Schedule    *Schedule     `yaml:"schedule"`     // optional: update windows, replacing the local -update-window schedule
+	Variants    []Variant     `yaml:"variants"`     // optional: files, processes and agent binary per group of agent labels
+
+	AllowDowngrade bool   `yaml:"allow_downgrade"` // optional: install even if version is lower than the installed one
+	MinVersion     string `yaml:"min_version"`     // optional: raise the local minimum version floor to this version
+
+	Rollout *Rollout `yaml:"rollout"` // optional: install on a share of the agents only
 }
 
 // retryHTTPRequest executes an HTTP request with retry logic
@@ -86,7 +77,8 @@ func retryHTTPRequest(maxRetries int, delay time.Duration, fn func() (*http.Resp
 	return nil, fmt.Errorf("after %d retries: %w", maxRetries, lastErr)
 }
 
-func fetchConfig(url string, agentID string, localVer string, timeout time.Duration, maxRetries int, logger *Logger) (*Config, error) {
+// fetchBytes GETs a URL and returns the full response body
+func fetchBytes(url string, agentID string, localVer string, timeout time.Duration, maxRetries int) ([]byte, error) {
 	client := &http.Client{Timeout: timeout}
 	var resp *http.Response
 	var err error
@@ -124,23 +116,116 @@ func fetchConfig(url string, agentID string, localVer string, timeout time.Durat
 			req.Header.Set("X-Local-Version", localVer)
 		}
 		resp, err = client.Do(req)
+		if err == nil && resp.StatusCode != 200 {
+			resp.Body.Close()
+			err = fmt.Errorf("bad status %d", resp.StatusCode)
+		}
 	}
 
 	if err != nil {
-		return nil, fmt.Errorf("fetch config: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// fetchConfig downloads version.yaml and verifies its detached signature
+// before decoding it. When url serves a manifest index, the config of
+// channel is fetched and verified the same way, and the channel is
+// returned; it is "" for a plain config.
+func fetchConfig(url string, sigURL string, keys TrustedKeys, skipVerify bool, channel string, agentID string, localVer string, timeout time.Duration, maxRetries int, logger *Logger) (*Config, string, error) {
+	body, err := fetchSigned(url, sigURL, keys, skipVerify, agentID, localVer, timeout, maxRetries, logger)
+	if err != nil {
+		return nil, "", err
+	}
+	idx, err := parseManifestIndex(body)
+	if err != nil {
+		return nil, "", err
+	}
+	version := ""
+	if idx != nil {
+		var cfgURL string
+		if version, cfgURL, err = idx.resolve(channel, url); err != nil {
+			return nil, "", err
+		}
+		logger.Info("channel %s is at version %s", channel, version)
+		if body, err = fetchSigned(cfgURL, "", keys, skipVerify, agentID, localVer, timeout, maxRetries, logger); err != nil {
+			return nil, "", err
+		}
+	}
 
 	var cfg Config
-	dec := yaml.NewDecoder(resp.Body)
-	if err := dec.Decode(&cfg); err != nil {
-		return nil, fmt.Errorf("decode yaml: %w", err)
+	if err := yaml.Unmarshal(body, &cfg); err != nil {
+		return nil, "", fmt.Errorf("decode yaml: %w", err)
 	}
-	return &cfg, nil
+	if idx == nil {
+		return &cfg, "", nil
+	}
+	// The index is signed apart from the configs it lists
+	if !sameVersion(cfg.Version, version) {
+		return nil, "", fmt.Errorf("config of channel %s has version %q, the manifest index lists %s", channel, cfg.Version, version)
+	}
+	return &cfg, channel, nil
+}
+
+// fetchSigned downloads url and verifies its detached signature at sigURL
+// (default: url + ".sig"). Without trusted keys the body is only returned
+// if skipVerify is set.
+func fetchSigned(url string, sigURL string, keys TrustedKeys, skipVerify bool, agentID string, localVer string, timeout time.Duration, maxRetries int, logger *Logger) ([]byte, error) {
+	if len(keys) == 0 && !skipVerify {
+		return nil, fmt.Errorf("no trusted keys configured, refusing to fetch an unsigned config")
+	}
+	logger.Debug("fetching config %s", url)
+	body, err := fetchBytes(url, agentID, localVer, timeout, maxRetries)
+	if err != nil {
+		return nil, fmt.Errorf("fetch config: %w", err)
+	}
+
+	if len(keys) > 0 {
+		if sigURL == "" {
+			sigURL = url + ".sig"
+		}
+		logger.Debug("fetching signature %s", sigURL)
+		sig, err := fetchBytes(sigURL, agentID, localVer, timeout, maxRetries)
+		if err != nil {
+			return nil, fmt.Errorf("fetch signature %s: %w", sigURL, err)
+		}
+		keyID, err := keys.Verify(body, sig)
+		if err != nil {
+			return nil, fmt.Errorf("verify signature: %w", err)
+		}
+		logger.Info("config signature verified (key: %s)", keyID)
+	}
+	return body, nil
+}
+
+// appFromConfigURL extracts the application name from a config URL of the
+// form .../ota/<app>/version.yaml, or returns "" for other layouts
+func appFromConfigURL(configURL string) string {
+	u, err := url.Parse(configURL)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "ota" {
+			return parts[i+1]
+		}
+	}
+	return ""
 }
 
 // 获取可执行文件所在目录（更健壮的版本）
 func getExecutableDir() (string, error) {
+	exePath, err := getExecutablePath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Dir(exePath), nil
+}
+
+// 获取可执行文件的绝对路径（已解析符号链接）
+func getExecutablePath() (string, error) {
 	exePath, err := os.Executable()
 	if err != nil {
 		return "", fmt.Errorf("failed to get executable path: %w", err)
@@ -158,7 +243,7 @@ func getExecutableDir() (string, error) {
 		return "", fmt.Errorf("failed to get absolute path: %w", err)
 	}
 
-	return filepath.Dir(exePath), nil
+	return exePath, nil
 }
 
 // 获取相对于可执行文件的路径
@@ -213,6 +298,7 @@ type progressWriter struct {
 func (pw *progressWriter) Write(p []byte) (int, error) {
 	n, err := pw.writer.Write(p)
 	pw.written += int64(n)
+	metrics.addDownloadBytes(n)
 
 	// Print progress every 500ms
 	now := time.Now()
@@ -228,71 +314,6 @@ func (pw *progressWriter) Write(p []byte) (int, error) {
 	return n, err
 }
 
-func downloadFile(url, dest string, agentID string, timeout time.Duration, maxRetries int, logger *Logger) error {
-	client := &http.Client{Timeout: timeout}
-	var resp *http.Response
-	var err error
-
-	if maxRetries > 1 {
-		resp, err = retryHTTPRequest(maxRetries, 2*time.Second, func() (*http.Response, error) {
-			req, e := http.NewRequest("GET", url, nil)
-			if e != nil {
-				return nil, e
-			}
-			if agentID != "" {
-				req.Header.Set("X-Agent-ID", agentID)
-			}
-			r, e := client.Do(req)
-			if e != nil {
-				return nil, e
-			}
-			if r.StatusCode != 200 {
-				return r, fmt.Errorf("status %d", r.StatusCode)
-			}
-			return r, nil
-		})
-	} else {
-		req, e := http.NewRequest("GET", url, nil)
-		if e != nil {
-			return fmt.Errorf("create request: %w", e)
-		}
-		if agentID != "" {
-			req.Header.Set("X-Agent-ID", agentID)
-		}
-		resp, err = client.Do(req)
-	}
-
-	if err != nil {
-		return fmt.Errorf("download: %w", err)
-	}
-	defer resp.Body.Close()
-
-	f, err := os.Create(dest)
-	if err != nil {
-		return fmt.Errorf("create dest: %w", err)
-	}
-	defer f.Close()
-
-	// Create progress writer
-	pw := &progressWriter{
-		writer:    f,
-		total:     resp.ContentLength,
-		written:   0,
-		lastPrint: time.Now(),
-		logger:    logger,
-	}
-
-	_, err = io.Copy(pw, resp.Body)
-	if err != nil {
-		return fmt.Errorf("write dest: %w", err)
-	}
-
-	if pw.total > 0 {
-		logger.Info("download complete: %d bytes", pw.written)
-	}
-	return nil
-}
-
 func fileSHA256(path string) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -307,12 +328,14 @@ func fileSHA256(path string) (string, error) {
 }
 
 // runCommand runs a command once (backward compatibility)
-func runCommand(cmdline string) error {
-	parts := strings.Fields(cmdline)
-	if len(parts) == 0 {
+func runCommand(spec CommandSpec) error {
+	if spec.IsZero() {
 		return nil
 	}
-	cmd := exec.Command(parts[0], parts[1:]...)
+	cmd, err := spec.build(context.Background())
+	if err != nil {
+		return err
+	}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
@@ -360,7 +383,7 @@ func atomicReplace(newPath, targetPath string, logger *Logger) (backupPath strin
 	if targetDir != newDir {
 		// move new file into target dir first
 		tmp := filepath.Join(targetDir, filepath.Base(newPath))
-		if err := os.Rename(newPath, tmp); err != nil {
+		if err := renameFile(newPath, tmp); err != nil {
 			return "", fmt.Errorf("move into same dir: %w", err)
 		}
 		newPath = tmp
@@ -370,17 +393,17 @@ func atomicReplace(newPath, targetPath string, logger *Logger) (backupPath strin
 	if _, err := os.Stat(targetPath); err == nil {
 		// remove previous .bak if exists
 		_ = os.Remove(backup)
-		if err := os.Rename(targetPath, backup); err != nil {
+		if err := renameFile(targetPath, backup); err != nil {
 			return "", fmt.Errorf("backup existing: %w", err)
 		}
 	} else {
 		backup = ""
 	}
 	// atomic replace
-	if err := os.Rename(newPath, targetPath); err != nil {
+	if err := renameFile(newPath, targetPath); err != nil {
 		// try to restore backup if rename failed
 		if backup != "" {
-			_ = os.Rename(backup, targetPath)
+			_ = renameFile(backup, targetPath)
 		}
 		return backup, fmt.Errorf("rename new->target: %w", err)
 	}
@@ -403,6 +426,14 @@ func validateConfig(cfg *Config) error {
 	if len(cfg.Version) > 100 {
 		return fmt.Errorf("version too long (max 100 chars)")
 	}
+	if cfg.MinVersion != "" {
+		if _, err := parseSemVer(cfg.MinVersion); err != nil {
+			return fmt.Errorf("min_version: %w", err)
+		}
+		if c, err := compareVersions(cfg.Version, cfg.MinVersion); err != nil || c < 0 {
+			return fmt.Errorf("version %s must be a semantic version not below min_version %s", cfg.Version, cfg.MinVersion)
+		}
+	}
 
 	// Validate files array
 	if len(cfg.Files) == 0 {
@@ -410,6 +441,7 @@ func validateConfig(cfg *Config) error {
 	}
 
 	sha256Regex := regexp.MustCompile(`^[a-fA-F0-9]{64}$`)
+	targets := make(map[string]int, len(cfg.Files))
 	for i, file := range cfg.Files {
 		if file.Name == "" {
 			return fmt.Errorf("files[%d].name is required", i)
@@ -423,6 +455,12 @@ func validateConfig(cfg *Config) error {
 		if file.SHA256 == "" {
 			return fmt.Errorf("files[%d].sha256 is required", i)
 		}
+		// Each target is staged next to itself, so targets must be unique
+		target := filepath.Clean(file.Target)
+		if j, dup := targets[target]; dup {
+			return fmt.Errorf("files[%d].target duplicates files[%d].target: %s", i, j, file.Target)
+		}
+		targets[target] = i
 		// URL validation
 		if _, err := url.Parse(file.URL); err != nil {
 			return fmt.Errorf("files[%d].url is invalid: %w", i, err)
@@ -434,90 +472,95 @@ func validateConfig(cfg *Config) error {
 		if !sha256Regex.MatchString(file.SHA256) {
 			return fmt.Errorf("files[%d].sha256 must be 64 hex characters", i)
 		}
+		for j, p := range file.Patches {
+			if !strings.HasPrefix(p.URL, "http://") && !strings.HasPrefix(p.URL, "https://") {
+				return fmt.Errorf("files[%d].patches[%d].url must be http:// or https://", i, j)
+			}
+			if !sha256Regex.MatchString(p.FromSHA256) || !sha256Regex.MatchString(p.SHA256) {
+				return fmt.Errorf("files[%d].patches[%d] from_sha256 and sha256 must be 64 hex characters", i, j)
+			}
+		}
 	}
 
-	return nil
-}
-
-// updateFile updates a single file
-func updateFile(file FileUpdate, restartCmd string, agentID string, timeout time.Duration, maxRetries int, logger *Logger) (bool, error) {
-	logger.Info("updating file %s (target: %s)", file.Name, file.Target)
-
-	// Check write permission
-	if err := checkWritePermission(file.Target); err != nil {
-		return false, fmt.Errorf("permission check failed for %s: %w", file.Target, err)
-	}
-
-	// Download
-	tmpDir := filepath.Dir(file.Target)
-	tmpFile := filepath.Join(tmpDir, fmt.Sprintf(".tmp-%s-%d", file.Name, time.Now().Unix()))
-	logger.Info("downloading %s to %s", file.Name, tmpFile)
-	if err := downloadFile(file.URL, tmpFile, agentID, timeout, maxRetries, logger); err != nil {
-		_ = os.Remove(tmpFile)
-		return false, fmt.Errorf("download error: %w", err)
+	if _, err := cfg.Schedule.compile(); err != nil {
+		return fmt.Errorf("schedule.%w", err)
 	}
-
-	// Verify checksum
-	logger.Info("verifying checksum for %s...", file.Name)
-	sum, err := fileSHA256(tmpFile)
-	if err != nil {
-		_ = os.Remove(tmpFile)
-		return false, fmt.Errorf("checksum error: %w", err)
+	if cfg.Rollout != nil {
+		if err := cfg.Rollout.validate(); err != nil {
+			return err
+		}
 	}
-	if !strings.EqualFold(sum, file.SHA256) {
-		_ = os.Remove(tmpFile)
-		return false, fmt.Errorf("sha256 mismatch: got=%s want=%s", sum, file.SHA256)
+	if cfg.Self != nil {
+		if err := cfg.Self.validate(); err != nil {
+			return err
+		}
 	}
-	logger.Info("checksum verified for %s", file.Name)
 
-	// Atomic replace
-	logger.Info("replacing %s...", file.Target)
-	backup, err := atomicReplace(tmpFile, file.Target, logger)
-	if err != nil {
-		_ = os.Remove(tmpFile)
-		return false, fmt.Errorf("replace error: %w", err)
+	if err := cfg.RestartCmd.Privileges.validate(); err != nil {
+		return fmt.Errorf("restart_cmd: %w", err)
 	}
-	if backup != "" {
-		logger.Info("replaced %s (backup=%s)", file.Target, backup)
-	} else {
-		logger.Info("replaced %s (no previous version)", file.Target)
-	}
-
-	// Restart if needed
-	if restartCmd != "" {
-		logger.Info("restarting after %s update...", file.Name)
-		if err := runCommand(restartCmd); err != nil {
-			logger.Error("restart failed after %s update: %v", file.Name, err)
-			// Rollback
-			if backup != "" {
-				logger.Info("attempting rollback for %s", file.Name)
-				if err := os.Rename(backup, file.Target); err != nil {
-					logger.Error("rollback failed for %s: %v", file.Name, err)
-				} else {
-					logger.Info("rollback successful for %s", file.Name)
-					_ = runCommand(restartCmd)
-				}
-			}
-			return false, fmt.Errorf("restart failed: %w", err)
-		}
+	if err := cfg.RestartCmd.Lifecycle.validate(); err != nil {
+		return fmt.Errorf("restart_cmd.%w", err)
 	}
-
-	return true, nil
+	return validateProcesses(cfg.Processes, cfg.Files)
 }
 
 // UpdateResult represents the result of an update check
 type UpdateResult struct {
-	Updated       bool   // Whether files were updated
-	RestartCmd    string // Restart command from remote config (empty if not provided)
-	RemoteVersion string // Remote version
-	Error         error  // Error if update check failed
+	Updated         bool           // Whether files were updated
+	RestartCmd      CommandSpec    // Restart command from remote config (empty if not provided)
+	RemoteVersion   string         // Remote version
+	PreviousVersion string         // Local version before the update
+	Channel         string         // Release channel the remote version was resolved for, "" without a manifest index
+	RestartMain     bool           // Whether the main process (restart_cmd or -start-cmd) must be restarted
+	RestartCmds     []Command      // Per-file restart commands to run once each
+	Replaced        []ReplacedFile // Files replaced by the update, for rollback
+	PreviousRelease string         // Slot mode: release current pointed to before the update
+	HealthCheck     *HealthCheck   // Health gate from remote config (nil if not provided)
+	Hooks           Hooks          // Lifecycle hooks from remote config
+	Processes       []ProcessSpec  // Processes of the new release
+	PrevProcesses   []ProcessSpec  // Processes of the release installed before the update
+	Outcome         string         // One of the Outcome* constants
+	Files           []FileReport   // Per-file outcome, empty when no install was attempted
+	Warnings        []string       // Problems that did not fail the update, e.g. a failed post_install hook
+	DeferredUntil   time.Time      // Deferred by the update schedule: when the next window opens
+	Agent           *AgentReport   // Agent self-update, nil when the agent binary was not touched
+	SelfStaged      *stagedFile    // Verified agent binary waiting to be installed, see SelfUpdate
+	Self            *SelfUpdate    // Self entry of the remote config
+	Error           error          // Error if update check failed
+}
+
+// restartsMain reports whether the update restarts the main process, which
+// currently runs prevCmd
+func (r UpdateResult) restartsMain(prevCmd CommandSpec) bool {
+	return r.RestartMain || !r.RestartCmd.IsZero() && !r.RestartCmd.Equal(prevCmd)
+}
+
+// UpdateOptions holds the agent settings used by every update check
+type UpdateOptions struct {
+	ConfigURL    string          // URL to version.yaml
+	SignatureURL string          // URL to the detached signature (default: ConfigURL + ".sig")
+	TrustedKeys  TrustedKeys     // keys the config signature must come from
+	SkipVerify   bool            // apply unsigned configs when no keys are trusted (-insecure-skip-verify)
+	VersionFile  string          // local version file
+	AgentID      string          // sent as X-Agent-ID
+	Timeout      time.Duration   // HTTP timeout
+	MaxRetries   int             // HTTP retries
+	Slots        *SlotLayout     // A/B slot installation, nil to replace files in place
+	SelfUpdate   bool            // apply the self entry of the config
+	Channel      channelSelector // release channel resolved when ConfigURL serves a manifest index
+	Schedule     *Schedule       // local update windows, nil to install at any time
+	Labels       Labels          // agent labels matched against the selectors of the config
 }
 
 // checkUpdate checks for updates and applies them
 // Returns UpdateResult with update status and restart command
 // This function only handles file updates, not process management
-func checkUpdate(cfgURL string, versionFile string, agentID string, timeout time.Duration, maxRetries int, logger *Logger) UpdateResult {
-	logger.Info("checking for updates from %s", cfgURL)
+func checkUpdate(opts UpdateOptions, logger *Logger) UpdateResult {
+	versionFile, agentID, timeout, maxRetries := opts.VersionFile, opts.AgentID, opts.Timeout, opts.MaxRetries
+	start := time.Now()
+	logger = logger.With("phase", "check")
+	logger.Info("checking for updates from %s", opts.ConfigURL)
 	// Read local version
 	localVer, err := readLocalVersion(versionFile)
 	if err != nil {
@@ -525,84 +568,420 @@ func checkUpdate(cfgURL string, versionFile string, agentID string, timeout time
 		localVer = ""
 	}
 	// Fetch remote configuration
-	remoteCfg, err := fetchConfig(cfgURL, agentID, localVer, timeout, maxRetries, logger)
+	channel, err := opts.Channel.Current()
+	if err != nil {
+		logger.Error("failed to read release channel: %v", err)
+		return UpdateResult{PreviousVersion: localVer, Outcome: OutcomeFailed, Error: fmt.Errorf("read channel: %w", err)}
+	}
+	remoteCfg, channel, err := fetchConfig(opts.ConfigURL, opts.SignatureURL, opts.TrustedKeys, opts.SkipVerify, channel, agentID, localVer, timeout, maxRetries, logger)
 	if err != nil {
 		logger.Error("failed to fetch remote config: %v", err)
-		return UpdateResult{Error: fmt.Errorf("fetch config: %w", err)}
+		return UpdateResult{PreviousVersion: localVer, Outcome: OutcomeFailed, Error: fmt.Errorf("fetch config: %w", err)}
 	}
 
-	// Validate configuration
+	// Keep what the config selects for this agent, then validate that
+	if err := remoteCfg.selectFor(opts.Labels); err != nil {
+		logger.Error("invalid remote config: %v", err)
+		return UpdateResult{PreviousVersion: localVer, Channel: channel, Outcome: OutcomeFailed, Error: fmt.Errorf("invalid remote config: %w", err)}
+	}
 	if err := validateConfig(remoteCfg); err != nil {
 		logger.Error("invalid remote config: %v", err)
-		return UpdateResult{Error: fmt.Errorf("invalid remote config: %w", err)}
+		return UpdateResult{PreviousVersion: localVer, Channel: channel, Outcome: OutcomeFailed, Error: fmt.Errorf("invalid remote config: %w", err)}
+	}
+
+	logger = logger.With("version", remoteCfg.Version)
+	if channel != "" {
+		logger = logger.With("channel", channel)
+	}
+	// Agents outside the rollout cohort leave the config alone until the
+	// rollout reaches them. A config that only updates the agent binary is
+	// rolled out as a release of the agent.
+	rolloutOf := ""
+	if !sameVersion(remoteCfg.Version, localVer) {
+		rolloutOf = remoteCfg.Version
+	} else if remoteCfg.Self != nil && opts.SelfUpdate && selfPending(remoteCfg.Self, versionFile) {
+		rolloutOf = remoteCfg.Self.rolloutKey()
+	}
+	if remoteCfg.Rollout != nil && rolloutOf != "" {
+		id := agentID
+		if id == "" {
+			id, _ = os.Hostname()
+		}
+		if reason := remoteCfg.Rollout.excludes(rolloutOf, id); reason != "" {
+			logger.Info("%s, deferring", reason)
+			return UpdateResult{
+				RestartCmd:      remoteCfg.RestartCmd,
+				RemoteVersion:   remoteCfg.Version,
+				PreviousVersion: localVer,
+				Channel:         channel,
+				Outcome:         OutcomeDeferred,
+				Warnings:        []string{reason},
+			}
+		}
 	}
+	// Nothing of a config below the local floor or downgrading the
+	// release is applied, not even its agent binary
+	floor, err := readVersionFloor(versionFile)
+	if err != nil {
+		logger.Error("failed to read minimum version: %v", err)
+		return UpdateResult{PreviousVersion: localVer, Channel: channel, Outcome: OutcomeFailed, Error: fmt.Errorf("read minimum version: %w", err)}
+	}
+	if remoteCfg.MinVersion != "" {
+		if raised, err := raiseVersionFloor(versionFile, remoteCfg.MinVersion); err != nil {
+			logger.Warn("failed to raise minimum version: %v", err)
+		} else if raised {
+			logger.Info("minimum version raised from %q to %s", floor, remoteCfg.MinVersion)
+			floor = remoteCfg.MinVersion
+		}
+	}
+	if reason := checkVersionPolicy(remoteCfg, localVer, floor); reason != "" {
+		logger.Warn("%s, skipping", reason)
+		return UpdateResult{
+			RestartCmd:      remoteCfg.RestartCmd,
+			RemoteVersion:   remoteCfg.Version,
+			PreviousVersion: localVer,
+			Channel:         channel,
+			Outcome:         OutcomeSkipped,
+			Warnings:        []string{reason},
+		}
+	}
+	var warnings []string
 
+	// Outside the update window files are staged but not installed; the
+	// schedule of the config replaces the local one
+	schedule := opts.Schedule
+	if remoteCfg.Schedule != nil {
+		schedule = remoteCfg.Schedule
+	}
+	window, err := schedule.compile()
+	if err != nil {
+		logger.Error("invalid update schedule: %v", err)
+		return UpdateResult{PreviousVersion: localVer, Channel: channel, Outcome: OutcomeFailed, Error: fmt.Errorf("schedule: %w", err)}
+	}
+	deferred := func(files []FileReport) UpdateResult {
+		reason := "outside the update window, no window opens within a year"
+		next, ok := window.NextOpen(time.Now())
+		if ok {
+			reason = "outside the update window, next window opens at " + next.Format(time.RFC3339)
+		}
+		logger.Info("%s, install deferred", reason)
+		return UpdateResult{
+			RestartCmd:      remoteCfg.RestartCmd,
+			RemoteVersion:   remoteCfg.Version,
+			PreviousVersion: localVer,
+			Channel:         channel,
+			Outcome:         OutcomeDeferred,
+			Files:           files,
+			Warnings:        append(warnings, reason),
+			DeferredUntil:   next,
+		}
+	}
+
+	// The agent updates itself first; the new agent installs the release.
+	// Outside the update window the new binary is only staged.
+	if remoteCfg.Self != nil && opts.SelfUpdate {
+		slog := logger.With("phase", "self")
+		sf, err := stageSelf(remoteCfg.Self, versionFile, agentID, timeout, maxRetries, slog)
+		if err != nil {
+			slog.Error("agent update failed: %v", err)
+			warnings = append(warnings, fmt.Sprintf("agent update: %v", err))
+		} else if sf != nil && !window.Open(time.Now()) {
+			slog.Info("agent binary staged, switching to it once the update window opens")
+			return deferred(nil)
+		} else if sf != nil {
+			return UpdateResult{
+				RestartCmd:      remoteCfg.RestartCmd,
+				RemoteVersion:   remoteCfg.Version,
+				PreviousVersion: localVer,
+				Channel:         channel,
+				Outcome:         OutcomeAgentUpdated,
+				SelfStaged:      sf,
+				Self:            remoteCfg.Self,
+			}
+		}
+	}
 	logger.Info("remote version=%s, local version=%s", remoteCfg.Version, localVer)
 
 	// Check if update needed
-	if remoteCfg.Version == localVer {
+	if sameVersion(remoteCfg.Version, localVer) {
 		logger.Info("versions equal, no update needed")
 		return UpdateResult{
-			Updated:       false,
-			RestartCmd:    remoteCfg.RestartCmd,
-			RemoteVersion: remoteCfg.Version,
+			Updated:         false,
+			RestartCmd:      remoteCfg.RestartCmd,
+			RemoteVersion:   remoteCfg.Version,
+			PreviousVersion: localVer,
+			Channel:         channel,
+			Outcome:         OutcomeUpToDate,
+			Warnings:        warnings,
 		}
 	}
 
-	// Get files from config
-	files := remoteCfg.Files
+	if isBadVersion(versionFile, remoteCfg.Version) {
+		logger.Warn("version %s previously failed its health check, skipping", remoteCfg.Version)
+		return UpdateResult{
+			Updated:         false,
+			RestartCmd:      remoteCfg.RestartCmd,
+			RemoteVersion:   remoteCfg.Version,
+			PreviousVersion: localVer,
+			Channel:         channel,
+			Outcome:         OutcomeSkipped,
+			Warnings:        warnings,
+		}
+	}
 
-	// Update each file
-	updated := false
-	var lastErr error
-	for _, file := range files {
-		success, err := updateFile(file, "", agentID, timeout, maxRetries, logger)
-		if err != nil {
-			logger.Error("failed to update %s: %v", file.Name, err)
-			lastErr = err
-			continue
+	failed := func(files []FileReport, err error) UpdateResult {
+		return UpdateResult{
+			RestartCmd:      remoteCfg.RestartCmd,
+			RemoteVersion:   remoteCfg.Version,
+			PreviousVersion: localVer,
+			Channel:         channel,
+			Outcome:         OutcomeFailed,
+			Files:           files,
+			Warnings:        warnings,
+			Error:           err,
+		}
+	}
+
+	hooks := remoteCfg.Hooks.withDefaults()
+	env := hookEnv{Timeout: hooks.Timeout, AgentID: agentID, OldVersion: localVer, NewVersion: remoteCfg.Version}
+	if opts.Slots != nil {
+		env.Dir = opts.Slots.releaseDir(remoteCfg.Version)
+	}
+	// preInstall runs pre_install and the pre_hook of every file about to
+	// change; either may still veto the update. Outside the update window
+	// it returns errOutsideWindow instead.
+	preInstall := func(reports []FileReport) error {
+		if !window.Open(time.Now()) {
+			return errOutsideWindow
+		}
+		env := env
+		env.Files = fileTargets(reports, "staged")
+		if err := env.runNamed("pre_install", hooks.PreInstall, logger.With("phase", "pre_install")); err != nil {
+			return err
 		}
-		if success {
-			updated = true
+		preHooks := fileHooks(remoteCfg.Files, stagedFiles(reports), func(f FileUpdate) Command { return f.PreHook })
+		if err := runFileHooks(preHooks, env, logger.With("phase", "pre_hook")); err != nil {
+			return fmt.Errorf("pre_hook: %w", err)
 		}
+		return nil
 	}
 
-	// Update main version file
-	if updated {
-		if err := writeLocalVersion(versionFile, remoteCfg.Version); err != nil {
-			logger.Warn("write version file error: %v (non-fatal)", err)
-		} else {
-			logger.Info("version file updated to %s", remoteCfg.Version)
+	var replaced []ReplacedFile
+	var files []FileReport
+	prevRelease := ""
+	if opts.Slots != nil {
+		// Install into a fresh release directory and flip the symlink
+		prevRelease, files, err = opts.Slots.Install(remoteCfg, agentID, timeout, maxRetries, preInstall, logger.With("phase", "install"))
+		if errors.Is(err, errOutsideWindow) {
+			return deferred(files)
+		}
+		if err != nil {
+			logger.Error("release install failed, current release unchanged: %v", err)
+			return failed(files, err)
+		}
+		if prevRelease == remoteCfg.Version {
+			// Only the version file is behind the current release
+			reason := fmt.Sprintf("release %s is already current, version file was %q", remoteCfg.Version, localVer)
+			logger.Warn("%s, updating it", reason)
+			if err := writeProcessSpecs(versionFile, remoteCfg.Processes); err != nil {
+				logger.Warn("write processes file error: %v (non-fatal)", err)
+			}
+			if err := writeLocalVersion(versionFile, remoteCfg.Version); err != nil {
+				return failed(files, fmt.Errorf("write version file: %w", err))
+			}
+			return UpdateResult{
+				RestartCmd:      remoteCfg.RestartCmd,
+				RemoteVersion:   remoteCfg.Version,
+				PreviousVersion: localVer,
+				Channel:         channel,
+				Outcome:         OutcomeUpToDate,
+				Files:           files,
+				Warnings:        append(warnings, reason),
+			}
 		}
-		logger.Info("update to %s complete", remoteCfg.Version)
+	} else {
+		// Phase 1: download and verify every file into the staging area
+		var staged []stagedFile
+		staged, files, err = stageAll(remoteCfg.Files, agentID, timeout, maxRetries, logger.With("phase", "stage"))
+		if err != nil {
+			logger.Error("staging failed, nothing was changed: %v", err)
+			return failed(files, err)
+		}
+		logger.Info("all %d file(s) staged and verified", len(staged))
+
+		if err := preInstall(files); errors.Is(err, errOutsideWindow) {
+			// The staged files are picked up again once the window opens
+			return deferred(files)
+		} else if err != nil {
+			logger.Error("%v, nothing was changed", err)
+			discardStaged(staged)
+			setOutcome(files, "not_attempted")
+			return failed(files, err)
+		}
+
+		// Phase 2: swap everything in, all or nothing
+		replaced, err = commitStaged(staged, logger.With("phase", "commit"))
+		if err != nil {
+			logger.Error("commit failed, install left at %q: %v", localVer, err)
+			setOutcome(files, "reverted")
+			return failed(files, err)
+		}
+		setOutcome(files, "updated")
+	}
+	env.Files = fileTargets(files, "updated")
+	runPostHooks(remoteCfg.Files, files, env, logger.With("phase", "post_hook"))
+	if err := env.runNamed("post_install", hooks.PostInstall, logger.With("phase", "post_install")); err != nil {
+		logger.Error("%v", err)
+		warnings = append(warnings, err.Error())
 	}
+	restartMain, restartCmds := restartPlan(remoteCfg, changedFiles(files))
 
-	result := UpdateResult{
-		Updated:       updated,
-		RestartCmd:    remoteCfg.RestartCmd,
-		RemoteVersion: remoteCfg.Version,
+	// Update main version file only once the whole set is committed
+	prevProcesses, err := readProcessSpecs(versionFile)
+	if err != nil {
+		logger.Warn("read installed processes: %v", err)
+	}
+	if err := writeProcessSpecs(versionFile, remoteCfg.Processes); err != nil {
+		logger.Warn("write processes file error: %v (non-fatal)", err)
+	}
+	if err := writeLocalVersion(versionFile, remoteCfg.Version); err != nil {
+		logger.Warn("write version file error: %v (non-fatal)", err)
+	} else {
+		logger.Info("version file updated to %s", remoteCfg.Version)
 	}
-	if lastErr != nil {
-		result.Error = lastErr
+	logger.With("duration", time.Since(start)).Info("update to %s complete", remoteCfg.Version)
+
+	return UpdateResult{
+		Updated:         true,
+		RestartCmd:      remoteCfg.RestartCmd,
+		RemoteVersion:   remoteCfg.Version,
+		PreviousVersion: localVer,
+		Channel:         channel,
+		RestartMain:     restartMain,
+		RestartCmds:     restartCmds,
+		Replaced:        replaced,
+		PreviousRelease: prevRelease,
+		HealthCheck:     remoteCfg.HealthCheck,
+		Hooks:           hooks,
+		Processes:       remoteCfg.Processes,
+		PrevProcesses:   prevProcesses,
+		Outcome:         OutcomeUpdated,
+		Files:           files,
+		Warnings:        warnings,
 	}
+}
 
-	return result
+// subcommands are release tooling entry points selected by the first argument
+var subcommands = map[string]func(args []string) error{
+	"keygen": runKeygen,
+	"sign":   runSign,
+	"delta":  runDelta,
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == privHelperArg {
+		runPrivHelper(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == outputRelayArg {
+		runOutputRelay(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == selfProbeArg {
+		return
+	}
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	runAgent()
+}
+
+func runAgent() {
 	defaultVersionFile, _ := getExecutableRelativePath("version")
 	// flags / env
 	cfgURL := flag.String("config-url", "", "URL to version.yaml (required)")
 	versionFile := flag.String("version-file", defaultVersionFile, "local version file path")
 	agentID := flag.String("agent-id", "", "Agent identifier (sent as X-Agent-ID header)")
-	startCmd := flag.String("start-cmd", "", "Local command for initial process start (used when no update needed)")
+	startCmd := flag.String("start-cmd", "", "Local command for initial process start (used when no update needed); shell-style quoting and leading NAME=value assignments are supported")
+	startDir := flag.String("start-dir", "", "working directory for -start-cmd")
+	startUser := flag.String("start-user", "", "run -start-cmd as this user (name or uid)")
+	startGroup := flag.String("start-group", "", "run -start-cmd as this group (name or gid, default: the user's primary group)")
+	startGroups := flag.String("start-groups", "", "comma-separated supplementary groups for -start-cmd (default: the groups of -start-user)")
+	startUmask := flag.String("start-umask", "", "octal umask for -start-cmd, e.g. 027")
+	startNoNewPrivs := flag.Bool("start-no-new-privs", false, "run -start-cmd with no_new_privs set (Linux)")
+	startCaps := flag.String("start-caps", "", "comma-separated capabilities kept in the bounding set of -start-cmd, or \"none\" (Linux)")
+	startStopSignal := flag.String("start-stop-signal", "", "signal asking -start-cmd to exit (default SIGTERM)")
+	startStopTimeout := flag.Duration("start-stop-timeout", 0, "grace period after the stop signal before -start-cmd is killed (default 5s)")
+	startKillGroup := flag.Bool("start-kill-group", false, "run -start-cmd in its own process group and stop the whole group")
+	startReload := flag.Bool("start-reload", false, "send SIGHUP to -start-cmd instead of restarting it when updated files ask for a restart")
 	timeout := flag.Duration("timeout", 30*time.Second, "http timeout")
 	maxRetries := flag.Int("max-retries", 3, "maximum number of retries for HTTP requests")
 	checkInterval := flag.Duration("check-interval", 5*time.Minute, "check interval for daemon mode")
 	daemon := flag.Bool("daemon", true, "run as daemon (default: true)")
+	sigURL := flag.String("signature-url", "", "URL to the detached config signature (default: <config-url>.sig)")
+	var trustedKeySpecs keyFlag
+	flag.Var(&trustedKeySpecs, "trusted-key", "trusted Ed25519 public key as <key-id>:<base64> (repeatable)")
+	trustedKeysFile := flag.String("trusted-keys-file", "", "file with one trusted <key-id>:<base64> public key per line")
+	insecureSkipVerify := flag.Bool("insecure-skip-verify", false, "apply configs without verifying their signature when no trusted keys are configured (testing only)")
+	installMode := flag.String("install-mode", "replace", "how releases are installed: replace (files in place) or slots (releases/<version> + current symlink)")
+	slotsDir := flag.String("slots-dir", "", "base directory for slot mode (holds releases/ and the current symlink)")
+	keepReleases := flag.Int("keep-releases", 3, "number of releases kept on disk in slot mode")
+	healthMinUptime := flag.Duration("health-min-uptime", 10*time.Second, "how long a restarted process must stay alive after an update (0 disables)")
+	reportURL := flag.String("report-url", "", "URL to POST an update report to after every check (empty disables reporting)")
+	reportSpoolDir := flag.String("report-spool-dir", "", "directory holding reports not yet delivered (default: <version-file dir>/reports)")
+	controlAddr := flag.String("control-addr", "", "local control API address: 127.0.0.1:<port> or unix:<socket path> (empty disables)")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve Prometheus metrics on, e.g. :9464 (empty disables)")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	logFile := flag.String("log-file", "", "write logs to this file instead of stdout/stderr")
+	logMaxSize := flag.Int64("log-max-size", 10, "rotate the log file when it exceeds this many MB (0 disables rotation)")
+	logMaxBackups := flag.Int("log-max-backups", 5, "number of rotated log files to keep")
+	processLogDir := flag.String("process-log-dir", "", "capture managed process output to <dir>/<process name>.log (empty passes it through to the agent output)")
+	processLogMaxSize := flag.Int64("process-log-max-size", 10, "rotate a process log when it exceeds this many MB (0 disables)")
+	processLogMaxBackups := flag.Int("process-log-max-backups", 5, "number of rotated process logs to keep")
+	processLogRotateEvery := flag.Duration("process-log-rotate-every", 0, "also rotate process logs after this long, e.g. 24h (0 disables)")
+	processLogTail := flag.Int("process-log-tail", 100, "lines of process output kept for crash reports")
+	restartDelay := flag.Duration("restart-delay", DefaultRestartPolicy.Delay, "delay before restarting a crashed process, doubled on every consecutive crash")
+	restartMaxDelay := flag.Duration("restart-max-delay", DefaultRestartPolicy.MaxDelay, "upper bound of the restart delay")
+	restartStableAfter := flag.Duration("restart-stable-after", DefaultRestartPolicy.StableAfter, "uptime after which a process' restart count and delay are reset")
+	crashLoopRestarts := flag.Int("crash-loop-restarts", DefaultRestartPolicy.CrashLoop, "consecutive restarts after which a process is considered crash looping (0 disables)")
+	crashLoopWindow := flag.Duration("crash-loop-window", 10*time.Minute, "roll back an update when a process starts crash looping within this time of it being applied (0 disables)")
+	pidDir := flag.String("pid-dir", "", "directory of the managed process pidfiles used to adopt processes still running after an agent restart (default: <version-file>.pids)")
+	keepProcesses := flag.Bool("keep-processes", false, "leave managed processes running when the agent exits, for the next agent run to adopt")
+	selfUpdate := flag.Bool("self-update", true, "update the agent binary from the self entry of the config (daemon mode only)")
+	channel := flag.String("channel", defaultChannel, "release channel to follow when -config-url serves a manifest index")
+	channelFile := flag.String("channel-file", "", "file overriding -channel, re-read on every check and written by the control API (default: <version-file>.channel)")
+	var updateWindows, updateBlackouts listFlag
+	flag.Var(&updateWindows, "update-window", "window in which updates are installed as \"<minute> <hour> <day of month> <month> <day of week> <duration>\", e.g. \"0 2 * * 1-5 3h\" (repeatable; default: always)")
+	flag.Var(&updateBlackouts, "update-blackout", "date or inclusive date range without updates, e.g. 2026-12-24 or 2026-12-20..2027-01-02 (repeatable)")
+	updateTimeZone := flag.String("update-timezone", "", "IANA time zone of -update-window and -update-blackout (default: local time)")
+	var labelSpecs listFlag
+	flag.Var(&labelSpecs, "label", "agent label as <key>=<value>, e.g. region=eu, matched against config selectors (repeatable; overrides -labels-file and the built-in arch and os)")
+	labelsFile := flag.String("labels-file", "", "file with one <key>=<value> agent label per line")
+	minVersion := flag.String("min-version", "", "raise the minimum version floor kept in <version-file>.floor to this version; lower versions are never installed")
 	flag.Parse()
 
-	logger := newLogger()
+	logger, err := newLogger(LogOptions{
+		Format:     *logFormat,
+		Level:      *logLevel,
+		File:       *logFile,
+		MaxSize:    *logMaxSize * 1024 * 1024,
+		MaxBackups: *logMaxBackups,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid logging options: %v\n", err)
+		os.Exit(1)
+	}
+	if *agentID != "" {
+		logger = logger.With("agent_id", *agentID)
+	}
+	if app := appFromConfigURL(*cfgURL); app != "" {
+		logger = logger.With("app", app)
+	}
 
 	// Ensure version file directory exists
 	if err := os.MkdirAll(filepath.Dir(*versionFile), 0755); err != nil {
@@ -616,26 +995,504 @@ func main() {
 	logger.Info("check interval: %v", *checkInterval)
 	logger.Info("version file: %s", *versionFile)
 	logger.Info("daemon mode: %t", *daemon)
-	if *startCmd != "" {
-		logger.Info("start command: %s (for initial process start)", *startCmd)
+
+	if *minVersion != "" {
+		if _, err := raiseVersionFloor(*versionFile, *minVersion); err != nil {
+			logger.Error("invalid -min-version: %v", err)
+			os.Exit(1)
+		}
+	}
+	if *channelFile == "" {
+		*channelFile = *versionFile + ".channel"
+	}
+	if !channelNameRegex.MatchString(*channel) {
+		logger.Error("invalid -channel %q", *channel)
+		os.Exit(1)
+	}
+	if current, err := (channelSelector{Default: *channel, File: *channelFile}).Current(); err != nil {
+		logger.Warn("%v", err)
+	} else {
+		logger.Info("release channel: %s", current)
+	}
+	labels, err := loadLabels(labelSpecs, *labelsFile)
+	if err != nil {
+		logger.Error("failed to load agent labels: %v", err)
+		os.Exit(1)
+	}
+	logger.Info("agent labels: %s", labels)
+	var schedule *Schedule
+	if len(updateWindows) > 0 || len(updateBlackouts) > 0 || *updateTimeZone != "" {
+		schedule = &Schedule{Windows: updateWindows, TimeZone: *updateTimeZone, Blackout: updateBlackouts}
+		if _, err := schedule.compile(); err != nil {
+			logger.Error("invalid update schedule: %v", err)
+			os.Exit(1)
+		}
+		logger.Info("update windows: %s (time zone %q, blackout %s)", strings.Join(schedule.Windows, "; "), schedule.TimeZone, strings.Join(schedule.Blackout, ", "))
+	}
+	if floor, err := readVersionFloor(*versionFile); err == nil && floor != "" {
+		logger.Info("minimum version: %s", floor)
 	}
 
-	runCmd := *startCmd
+	keys, err := loadTrustedKeys(trustedKeySpecs, *trustedKeysFile)
+	if err != nil {
+		logger.Error("failed to load trusted keys: %v", err)
+		os.Exit(1)
+	}
+	switch {
+	case len(keys) > 0:
+		logger.Info("config signature required, trusted keys: %s", strings.Join(keys.IDs(), ", "))
+		if *insecureSkipVerify {
+			logger.Warn("-insecure-skip-verify is ignored, trusted keys are configured")
+		}
+	case *insecureSkipVerify:
+		logger.Warn("config signature verification disabled by -insecure-skip-verify")
+	default:
+		logger.Error("no trusted keys configured: set -trusted-key or -trusted-keys-file, or -insecure-skip-verify to apply unsigned configs")
+		os.Exit(1)
+	}
 
-	result := checkUpdate(*cfgURL, *versionFile, *agentID, *timeout, *maxRetries, logger)
+	opts := UpdateOptions{
+		ConfigURL:    *cfgURL,
+		SignatureURL: *sigURL,
+		TrustedKeys:  keys,
+		SkipVerify:   *insecureSkipVerify && len(keys) == 0,
+		VersionFile:  *versionFile,
+		AgentID:      *agentID,
+		Timeout:      *timeout,
+		MaxRetries:   *maxRetries,
+		SelfUpdate:   *selfUpdate && *daemon,
+		Channel:      channelSelector{Default: *channel, File: *channelFile},
+		Schedule:     schedule,
+		Labels:       labels,
+	}
+	switch *installMode {
+	case "replace":
+	case "slots":
+		if *slotsDir == "" {
+			logger.Error("-slots-dir is required with -install-mode=slots")
+			os.Exit(1)
+		}
+		if *keepReleases < 2 {
+			logger.Error("-keep-releases must be at least 2 to allow rollback")
+			os.Exit(1)
+		}
+		opts.Slots = &SlotLayout{Dir: *slotsDir, Keep: *keepReleases}
+		logger.Info("slot mode: %s (keeping %d releases)", *slotsDir, *keepReleases)
+	default:
+		logger.Error("unknown -install-mode %q", *installMode)
+		os.Exit(1)
+	}
+	startCommand, err := ParseCommand(*startCmd)
+	if err != nil {
+		logger.Error("invalid -start-cmd: %v", err)
+		os.Exit(1)
+	}
+	startPriv := Privileges{User: *startUser, Group: *startGroup, Umask: *startUmask, NoNewPrivs: *startNoNewPrivs}
+	if *startGroups != "" {
+		startPriv.Groups = strings.Split(*startGroups, ",")
+	}
+	if *startCaps == "none" {
+		startPriv.Capabilities = Capabilities{}
+	} else if *startCaps != "" {
+		startPriv.Capabilities = strings.Split(*startCaps, ",")
+	}
+	if err := startPriv.validate(); err != nil {
+		logger.Error("invalid -start-cmd privileges: %v", err)
+		os.Exit(1)
+	}
+	startLifecycle := Lifecycle{StopSignal: *startStopSignal, StopTimeout: *startStopTimeout, KillGroup: *startKillGroup, Reload: *startReload}
+	if err := startLifecycle.validate(); err != nil {
+		logger.Error("invalid -start-stop-signal: %v", err)
+		os.Exit(1)
+	}
+	startSpec := CommandSpec{Command: startCommand, Dir: *startDir, Privileges: startPriv, Lifecycle: startLifecycle}
+	if !startSpec.IsZero() {
+		logger.Info("start command: %s (for initial process start)", startSpec)
+	}
+	registry := NewProcessRegistry(logger)
+
+	// updateEnv describes an applied update to hooks and restart commands
+	updateEnv := func(result UpdateResult) hookEnv {
+		return hookEnv{
+			Timeout:    result.Hooks.Timeout,
+			AgentID:    *agentID,
+			OldVersion: result.PreviousVersion,
+			NewVersion: result.RemoteVersion,
+			Files:      fileTargets(result.Files, "updated"),
+		}
+	}
+	registry.SetOutputOptions(ProcessOutputOptions{
+		Dir:         *processLogDir,
+		MaxSize:     *processLogMaxSize * 1024 * 1024,
+		MaxBackups:  *processLogMaxBackups,
+		RotateEvery: *processLogRotateEvery,
+		TailLines:   *processLogTail,
+	})
+	registry.SetRestartPolicy(RestartPolicy{
+		Delay:       *restartDelay,
+		MaxDelay:    *restartMaxDelay,
+		StableAfter: *restartStableAfter,
+		CrashLoop:   *crashLoopRestarts,
+		MaxRestarts: -1,
+	})
+	if *processLogDir != "" {
+		logger.Info("managed process output captured in %s", *processLogDir)
+	}
+	if *pidDir == "" {
+		*pidDir = *versionFile + ".pids"
+	}
+	registry.SetPidDir(*pidDir)
+
+	var reporter *Reporter
+	if *reportURL != "" {
+		if *reportSpoolDir == "" {
+			*reportSpoolDir = filepath.Join(filepath.Dir(*versionFile), "reports")
+		}
+		if reporter, err = NewReporter(*reportURL, *reportSpoolDir, *agentID, *timeout, logger); err != nil {
+			logger.Error("failed to set up reporting: %v", err)
+			os.Exit(1)
+		}
+		// Deliver what the last check reported before exiting
+		defer reporter.Close()
+		logger.Info("reporting to %s (spool: %s)", *reportURL, *reportSpoolDir)
+	}
+	state := newAgentState()
+	state.labels = labels
+	// The last applied update stays available for rollback across agent restarts
+	if last, err := readAppliedUpdate(*versionFile); err != nil {
+		logger.Warn("not offering the last applied update for rollback: %v", err)
+		removeAppliedUpdate(*versionFile)
+	} else if last != nil {
+		state.restoreApplied(last)
+		logger.Info("update to %s applied at %s can be rolled back to %q", last.Result.RemoteVersion,
+			last.AppliedAt.Format(time.RFC3339), last.Result.PreviousVersion)
+	}
+	finishCheck := func(result UpdateResult, restart *RestartReport, started time.Time, applied *appliedUpdate) {
+		report := newUpdateReport(*agentID, result, restart, started, *versionFile)
+		report.Labels = labels
+		state.finishCheck(report, applied)
+		if applied != nil {
+			if err := writeAppliedUpdate(*versionFile, applied); err != nil {
+				logger.Warn("failed to record the applied update for rollback: %v", err)
+			}
+		} else if result.Outcome == OutcomeRolledBack {
+			removeAppliedUpdate(*versionFile)
+		}
+		metrics.checkFinished(result.Outcome)
+		if reporter != nil {
+			reporter.Submit(report)
+		}
+	}
+
+	// revertAgent discards a new agent binary that did not start up in
+	// time and re-executes the previous one if the new one is running
+	revertAgent := func(st *selfUpdateState, reason error) {
+		slog := logger.With("phase", "self")
+		slog.Error("%v, reverting to the previous agent binary", reason)
+		if reporter != nil {
+			current, _ := readLocalVersion(*versionFile)
+			report := newUpdateReport(*agentID, UpdateResult{
+				PreviousVersion: current,
+				RemoteVersion:   current,
+				Outcome:         OutcomeRolledBack,
+				Agent:           &AgentReport{Version: st.Version, SHA256: st.SHA256, PreviousSHA256: st.Previous, Outcome: "rolled_back", Error: reason.Error()},
+			}, nil, time.Now(), *versionFile)
+			report.Labels = labels
+			reporter.Submit(report)
+		}
+		revertSelf(st, *versionFile, slog)
+		if exe, _ := getExecutablePath(); exe == st.Exe {
+			return
+		}
+		if err := reexec(st.Exe); err != nil {
+			// The supervisor of the agent starts the previous binary
+			slog.Error("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	// An agent binary installed by a self-update must start up before
+	// its deadline, otherwise the previous binary is put back. The
+	// probation ends once, either at the deadline or when the new agent
+	// confirms before its first check, so that a revert never re-executes
+	// the agent in the middle of an install.
+	var endProbation func(confirmed bool)
+	if *daemon {
+		st, err := beginSelfProbation(*versionFile)
+		switch {
+		case err != nil && st == nil:
+			logger.Warn("agent update state: %v", err)
+		case err != nil:
+			revertAgent(st, err)
+		case st != nil:
+			slog := logger.With("phase", "self")
+			slog.Info("new agent on probation until %s", st.Deadline.Format(time.RFC3339))
+			var once sync.Once
+			var deadline *time.Timer
+			endProbation = func(confirmed bool) {
+				once.Do(func() {
+					if !confirmed {
+						revertAgent(st, fmt.Errorf("new agent did not start up within its health timeout"))
+						return
+					}
+					deadline.Stop()
+					if err := confirmSelf(st, *versionFile, slog); err != nil {
+						revertAgent(st, fmt.Errorf("install new agent binary: %w", err))
+						return
+					}
+					slog.Info("new agent started up, update confirmed")
+				})
+			}
+			deadline = time.AfterFunc(time.Until(st.Deadline), func() { endProbation(false) })
+		}
+	}
+
+	// updateAgent re-executes the agent with a staged agent binary. It
+	// only returns if the update failed.
+	updateAgent := func(result UpdateResult, started time.Time) UpdateResult {
+		slog := logger.With("phase", "self")
+		result.Agent = &AgentReport{Version: result.Self.Version, SHA256: strings.ToLower(result.Self.SHA256)}
+		st, err := prepareSelf(result.SelfStaged, result.Self, *versionFile, slog)
+		if err == nil {
+			result.Agent.PreviousSHA256 = st.Previous
+			result.Agent.Outcome = "installed"
+			finishCheck(result, nil, started, nil)
+			slog.Info("re-executing the agent with the new binary, must start up within %v", result.Self.healthTimeout())
+			err = reexec(st.New)
+			revertSelf(st, *versionFile, slog)
+		}
+		slog.Error("agent update failed: %v", err)
+		result.Agent.Outcome = "failed"
+		result.Agent.Error = err.Error()
+		result.Outcome = OutcomeFailed
+		result.Error = fmt.Errorf("agent update: %w", err)
+		return result
+	}
+
+	var control *ControlServer
+	var checkNow <-chan struct{}
+	var controlRequests <-chan controlRequest
+	if *controlAddr != "" && *daemon {
+		control = NewControlServer(*controlAddr, *agentID, *versionFile, opts.Channel, state, registry, logger)
+		if err := control.Start(); err != nil {
+			logger.Error("%v", err)
+			os.Exit(1)
+		}
+		defer control.Close()
+		checkNow, controlRequests = control.CheckNow(), control.Requests()
+	}
+	if *metricsAddr != "" && *daemon {
+		if err := serveMetrics(*metricsAddr, *agentID, *versionFile, registry, logger); err != nil {
+			logger.Error("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	// restartPrevious brings the previous build back after a rollback:
+	// the configured processes of the previous release, restarting those
+	// whose files were put back, the per-file restart commands, and the
+	// previous default command if the update restarted it
+	restartPrevious := func(result UpdateResult, prevCmd CommandSpec) error {
+		env := updateEnv(result)
+		if err := env.runNamed("on_rollback", result.Hooks.OnRollback, logger.With("phase", "rollback")); err != nil {
+			logger.Error("%v", err)
+		}
+		var firstErr error
+		if *daemon && (len(result.Processes) > 0 || len(result.PrevProcesses) > 0) {
+			if _, err := registry.Apply(result.PrevProcesses, changedFiles(result.Files)); err != nil {
+				firstErr = err
+			}
+		}
+		for _, c := range result.RestartCmds {
+			if err := env.run(c, logger.With("phase", "rollback")); err != nil {
+				logger.Error("restart command failed: %v", err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		// In single-run mode the previous command runs after the check
+		if !*daemon || !result.restartsMain(prevCmd) {
+			return firstErr
+		}
+		if prevCmd.IsZero() {
+			if err := registry.Stop(defaultProcessName); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			return firstErr
+		}
+		if _, err := registry.Restart(defaultProcess(prevCmd)); err != nil {
+			logger.Error("failed to restart previous build: %v", err)
+			return err
+		}
+		logger.Info("previous build restarted: %s", prevCmd)
+		return firstErr
+	}
+
+	// Process management function, returns nil when nothing was restarted
+	handleProcessManagement := func(result UpdateResult, prevCmd CommandSpec) *RestartReport {
+		if result.Error != nil || !result.Updated {
+			return nil
+		}
+
+		ulog := logger.With("version", result.RemoteVersion)
+		env := updateEnv(result)
+		report := &RestartReport{}
+		var pms []*ProcessManager
+		var gateErr error
+		hasProcesses := *daemon && (len(result.Processes) > 0 || len(result.PrevProcesses) > 0)
+		// In single-run mode the start command runs after the check, so
+		// every update restarts it
+		restartsMain := result.restartsMain(prevCmd) || !*daemon
+		if hasProcesses || restartsMain || len(result.RestartCmds) > 0 {
+			gateErr = env.runNamed("pre_restart", result.Hooks.PreRestart, ulog.With("phase", "pre_restart"))
+		}
+		if hasProcesses && gateErr == nil {
+			// Only processes depending on the replaced files are restarted
+			started, err := registry.Apply(result.Processes, changedFiles(result.Files))
+			pms = append(pms, started...)
+			for _, pm := range started {
+				report.Processes = append(report.Processes, pm.name)
+			}
+			if err != nil {
+				gateErr = err
+			}
+		}
+		if restartsMain && gateErr == nil && *daemon {
+			cmd := result.RestartCmd
+			if cmd.IsZero() {
+				cmd = prevCmd
+			}
+			if cmd.IsZero() {
+				ulog.With("phase", "restart").Warn("updated files ask for a restart but there is no restart_cmd or -start-cmd")
+			} else {
+				ulog.With("phase", "restart").Info("restarting managed process after update: %s", cmd)
+				report.Command = cmd.String()
+				pm, err := registry.Restart(defaultProcess(cmd))
+				if err != nil {
+					gateErr = fmt.Errorf("start managed process: %w", err)
+				} else {
+					pms = append(pms, pm)
+					report.Processes = append(report.Processes, defaultProcessName)
+				}
+			}
+		}
+		// Each per-file restart command runs once, after every file is in place
+		for _, c := range result.RestartCmds {
+			if gateErr != nil {
+				break
+			}
+			report.Commands = append(report.Commands, c.String())
+			if err := env.run(c, ulog.With("phase", "restart")); err != nil {
+				gateErr = fmt.Errorf("restart command: %w", err)
+			}
+		}
+		report.Started = gateErr == nil && (len(pms) > 0 || len(report.Commands) > 0)
+
+		hc := result.HealthCheck.withDefaults(*healthMinUptime)
+		if gateErr == nil {
+			if len(pms) == 0 && len(report.Commands) == 0 && !hc.hasProbe() {
+				return nil
+			}
+			report.HealthCheck = "passed"
+			if gateErr = runHealthGate(pms, hc, ulog.With("phase", "health")); gateErr != nil {
+				report.HealthCheck = "failed"
+			}
+		}
+		if gateErr == nil {
+			ulog.With("phase", "health").Info("version %s passed health check", result.RemoteVersion)
+			return report
+		}
+
+		ulog.With("phase", "health").Error("version %s failed health check: %v", result.RemoteVersion, gateErr)
+		report.Error = gateErr.Error()
+		report.RolledBack = true
+		for _, pm := range pms {
+			for _, line := range pm.RecentOutput() {
+				if len(pms) > 1 {
+					line = pm.name + ": " + line
+				}
+				report.Output = append(report.Output, line)
+			}
+		}
+		if err := rollbackUpdate(result, opts, ulog.With("phase", "rollback")); err != nil {
+			ulog.With("phase", "rollback").Error("rollback incomplete: %v", err)
+		}
+		restartPrevious(result, prevCmd)
+		return report
+	}
+
+	// A new agent that got this far has started up; a revert that is
+	// already running re-executes the previous binary before this returns
+	if endProbation != nil {
+		endProbation(true)
+	}
+
+	started := time.Now()
+	state.beginCheck()
+	result := checkUpdate(opts, logger)
+	if result.SelfStaged != nil {
+		result = updateAgent(result, started)
+	}
 	if result.Error != nil {
 		logger.Error("Start OTA agent checkUpdate failed: %v", result.Error)
 	}
+	updated := result.Error == nil && result.Updated
+
+	// Start the processes of the installed release; after an update the
+	// health gate below starts them
+	if specs, err := readProcessSpecs(*versionFile); err != nil {
+		logger.Error("failed to load installed processes: %v", err)
+	} else if len(specs) > 0 {
+		if !*daemon {
+			logger.Warn("%d configured process(es) are only supervised in daemon mode", len(specs))
+		} else if !updated {
+			if _, err := registry.Apply(specs, nil); err != nil {
+				logger.Error("failed to start processes: %v", err)
+			}
+		}
+	}
 
-	if result.Error == nil && result.Updated && result.RestartCmd != "" {
-		runCmd = result.RestartCmd
+	// Supervised from the start; an instance left running by the previous
+	// agent run is adopted unless the update restarts it
+	var runErr error
+	if *daemon && !startSpec.IsZero() && !(updated && result.restartsMain(startSpec)) {
+		logger.Info("runCmd: %s", startSpec)
+		_, runErr = registry.Adopt(defaultProcess(startSpec))
 	}
 
-	logger.Info("runCmd: %s", runCmd)
-	if err := runCommand(runCmd); err != nil {
-		logger.Error("Start OTA agent runCommand failed: %v", err)
+	// The update installed at startup passes the same restart, health gate
+	// and rollback as one installed by the daemon
+	var startup *RestartReport
+	var applied *appliedUpdate
+	runCmd := startSpec
+	if updated {
+		if startup = handleProcessManagement(result, startSpec); startup != nil && startup.RolledBack {
+			result.Outcome = OutcomeRolledBack
+		} else {
+			applied = &appliedUpdate{Result: result, PrevCmd: startSpec, AppliedAt: time.Now()}
+			if !result.RestartCmd.IsZero() {
+				runCmd = result.RestartCmd
+			}
+		}
+	}
+	if startup == nil && !runCmd.IsZero() {
+		startup = &RestartReport{Command: runCmd.String(), Started: true}
 	}
 
+	if !*daemon {
+		logger.Info("runCmd: %s", runCmd)
+		runErr = runCommand(runCmd)
+	}
+	if runErr != nil {
+		logger.Error("Start OTA agent runCommand failed: %v", runErr)
+		if startup != nil {
+			startup.Started = false
+			startup.Error = runErr.Error()
+		}
+	}
+	finishCheck(result, startup, started, applied)
+
 	// Run once or as daemon
 	if !*daemon {
 		logger.Info("single-run mode, exiting")
@@ -647,12 +1504,101 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// Process management function
-	handleProcessManagement := func(result UpdateResult) {
-		if result.Error == nil && result.Updated && result.RestartCmd != "" {
-			if _, err := ensureManagedProcess(result.RestartCmd, "after update (from remote config)", logger); err != nil {
-				logger.Error("failed to ensure managed process: %v", err)
-			}
+	// A check deferred by the update schedule runs again as soon as the
+	// next window opens
+	var windowOpens <-chan time.Time
+	retryAtWindow := func(result UpdateResult) {
+		windowOpens = nil
+		if !result.DeferredUntil.IsZero() {
+			windowOpens = time.After(time.Until(result.DeferredUntil))
+		}
+	}
+	retryAtWindow(result)
+
+	// runCheck runs one update check including restart and health gate
+	runCheck := func() {
+		started := time.Now()
+		state.beginCheck()
+		prevCmd := startSpec
+		if spec, _, ok := registry.Get(defaultProcessName); ok {
+			prevCmd = spec.commandSpec()
+		}
+		result := checkUpdate(opts, logger)
+		if result.SelfStaged != nil {
+			result = updateAgent(result, started)
+		}
+		var restart *RestartReport
+		var applied *appliedUpdate
+		if result.Error != nil {
+			logger.Error("update check failed: %v", result.Error)
+		} else if restart = handleProcessManagement(result, prevCmd); restart != nil && restart.RolledBack {
+			result.Outcome = OutcomeRolledBack
+		} else if result.Updated {
+			applied = &appliedUpdate{Result: result, PrevCmd: prevCmd, AppliedAt: time.Now()}
+		}
+		finishCheck(result, restart, started, applied)
+		retryAtWindow(result)
+	}
+
+	// rollbackApplied undoes an applied update and restarts the previous
+	// build. looping is the process whose crash loop caused the rollback,
+	// nil when an operator asked for it.
+	rollbackApplied := func(last *appliedUpdate, looping *ProcessManager) error {
+		started := time.Now()
+		result := last.Result
+		if err := rollbackUpdate(result, opts, logger.With("phase", "rollback", "version", result.RemoteVersion)); err != nil {
+			return fmt.Errorf("rollback incomplete: %w", err)
+		}
+		restart := &RestartReport{Command: last.PrevCmd.String(), RolledBack: true}
+		var errs []string
+		if looping != nil {
+			restart.HealthCheck = "failed"
+			restart.Output = looping.RecentOutput()
+			errs = append(errs, fmt.Sprintf("process %s is crash looping", looping.name))
+		}
+		if err := restartPrevious(result, last.PrevCmd); err != nil {
+			errs = append(errs, fmt.Sprintf("restart previous build: %v", err))
+		} else {
+			restart.Started = !last.PrevCmd.IsZero()
+		}
+		restart.Error = strings.Join(errs, "; ")
+		result.Outcome = OutcomeRolledBack
+		result.Files = nil
+		finishCheck(result, restart, started, nil)
+		return nil
+	}
+
+	// manualRollback undoes the last applied update on operator request
+	manualRollback := func() error {
+		last := state.takeApplied()
+		if last == nil {
+			return errNothingToRollBack
+		}
+		removeAppliedUpdate(*versionFile)
+		return rollbackApplied(last, nil)
+	}
+
+	// handleCrashLoop rolls back the last update when a process starts
+	// crash looping within -crash-loop-window of it being applied
+	handleCrashLoop := func(pm *ProcessManager) {
+		if !registry.Current(pm) || !pm.CrashLooping() {
+			return
+		}
+		plog := logger.With("process", pm.name)
+		if *crashLoopWindow <= 0 {
+			plog.Warn("process is crash looping")
+			return
+		}
+		last := state.takeRecentApplied(*crashLoopWindow)
+		if last == nil {
+			plog.Warn("process is crash looping, no update applied within %v to roll back", *crashLoopWindow)
+			return
+		}
+		removeAppliedUpdate(*versionFile)
+		plog.Error("process started crash looping %v after the update to %s, rolling back",
+			time.Since(last.AppliedAt).Round(time.Second), last.Result.RemoteVersion)
+		if err := rollbackApplied(last, pm); err != nil {
+			plog.Error("%v", err)
 		}
 	}
 
@@ -663,20 +1609,47 @@ func main() {
 	for {
 		select {
 		case <-ticker.C:
-			result := checkUpdate(*cfgURL, *versionFile, *agentID, *timeout, *maxRetries, logger)
-			if result.Error != nil {
-				logger.Error("update check failed: %v", result.Error)
-			} else {
-				handleProcessManagement(result)
+			if state.Paused() {
+				logger.Info("updates paused, skipping scheduled check")
+				continue
+			}
+			runCheck()
+
+		case <-checkNow:
+			runCheck()
+
+		case <-windowOpens:
+			windowOpens = nil
+			if state.Paused() {
+				logger.Info("updates paused, skipping check at window open")
+				continue
+			}
+			logger.Info("update window open, checking for updates")
+			runCheck()
+
+		case pm := <-registry.CrashLoops():
+			handleCrashLoop(pm)
+
+		case req := <-controlRequests:
+			switch req.action {
+			case "rollback":
+				req.reply <- manualRollback()
+			default:
+				req.reply <- fmt.Errorf("unknown action %q", req.action)
 			}
 
 		case sig := <-sigChan:
 			logger.Info("received signal %v, shutting down...", sig)
-			// Stop managed process gracefully
-			if err := stopManagedProcess(); err != nil {
-				logger.Error("failed to stop managed process: %v", err)
+			if *keepProcesses {
+				registry.ReleaseAll()
+				logger.Info("managed processes left running")
+				return
+			}
+			// Stop managed processes gracefully
+			if err := registry.StopAll(); err != nil {
+				logger.Error("failed to stop managed processes: %v", err)
 			} else {
-				logger.Info("managed process stopped")
+				logger.Info("managed processes stopped")
 			}
 			return
 		}
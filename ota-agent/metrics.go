@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// downloadDurationBuckets are the upper bounds, in seconds, of the
+// download duration histogram
+var downloadDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// agentMetrics holds the counters exported on /metrics
+type agentMetrics struct {
+	mu                 sync.Mutex
+	startTime          time.Time
+	checks             map[string]uint64 // by outcome
+	checkFailures      uint64
+	downloadBytes      uint64
+	downloadCount      []uint64 // cumulative per bucket, last is +Inf
+	downloadSum        float64
+	checksumMismatches uint64
+	rollbacks          uint64
+}
+
+// metrics is the process-wide metrics registry
+var metrics = &agentMetrics{
+	startTime:     time.Now(),
+	checks:        make(map[string]uint64),
+	downloadCount: make([]uint64, len(downloadDurationBuckets)+1),
+}
+
+// checkFinished counts a finished update check
+func (m *agentMetrics) checkFinished(outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checks[outcome]++
+	switch outcome {
+	case OutcomeFailed:
+		m.checkFailures++
+	case OutcomeRolledBack:
+		m.rollbacks++
+	}
+}
+
+// addDownloadBytes counts bytes received from the network
+func (m *agentMetrics) addDownloadBytes(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.downloadBytes += uint64(n)
+}
+
+// observeDownload records how long a completed download took
+func (m *agentMetrics) observeDownload(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	secs := d.Seconds()
+	m.downloadSum += secs
+	for i, le := range downloadDurationBuckets {
+		if secs <= le {
+			m.downloadCount[i]++
+		}
+	}
+	m.downloadCount[len(downloadDurationBuckets)]++
+}
+
+// checksumMismatch counts a downloaded or patched file that failed verification
+func (m *agentMetrics) checksumMismatch() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checksumMismatches++
+}
+
+// labelValue escapes a value for the Prometheus text format
+func labelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// writeMetric writes one metric family with a single unlabelled sample
+func writeMetric(w io.Writer, name, typ, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+}
+
+// write renders all metrics in the Prometheus text exposition format
+func (m *agentMetrics) write(w io.Writer, agentID, versionFile string, registry *ProcessRegistry) {
+	version, _ := readLocalVersion(versionFile)
+	fmt.Fprintf(w, "# HELP ota_agent_version_info Installed version of the managed application.\n")
+	fmt.Fprintf(w, "# TYPE ota_agent_version_info gauge\n")
+	fmt.Fprintf(w, "ota_agent_version_info{agent_id=\"%s\",version=\"%s\"} 1\n", labelValue(agentID), labelValue(version))
+
+	m.mu.Lock()
+	writeMetric(w, "ota_agent_start_time_seconds", "gauge", "Unix time the agent started.", m.startTime.Unix())
+	writeMetric(w, "ota_agent_uptime_seconds", "gauge", "Seconds since the agent started.", int64(time.Since(m.startTime).Seconds()))
+
+	fmt.Fprintf(w, "# HELP ota_agent_checks_total Update checks performed, by outcome.\n# TYPE ota_agent_checks_total counter\n")
+	outcomes := make([]string, 0, len(m.checks))
+	for o := range m.checks {
+		outcomes = append(outcomes, o)
+	}
+	sort.Strings(outcomes)
+	for _, o := range outcomes {
+		fmt.Fprintf(w, "ota_agent_checks_total{outcome=\"%s\"} %d\n", labelValue(o), m.checks[o])
+	}
+	writeMetric(w, "ota_agent_check_failures_total", "counter", "Update checks that failed to fetch, verify or install a release.", m.checkFailures)
+	writeMetric(w, "ota_agent_rollbacks_total", "counter", "Updates rolled back after a failed health check or on request.", m.rollbacks)
+	writeMetric(w, "ota_agent_download_bytes_total", "counter", "Bytes downloaded for releases and delta patches.", m.downloadBytes)
+	writeMetric(w, "ota_agent_checksum_mismatches_total", "counter", "Downloaded or patched files rejected because of a sha256 mismatch.", m.checksumMismatches)
+
+	fmt.Fprintf(w, "# HELP ota_agent_download_duration_seconds Time taken by completed downloads, including retries.\n# TYPE ota_agent_download_duration_seconds histogram\n")
+	for i, le := range downloadDurationBuckets {
+		fmt.Fprintf(w, "ota_agent_download_duration_seconds_bucket{le=\"%g\"} %d\n", le, m.downloadCount[i])
+	}
+	total := m.downloadCount[len(downloadDurationBuckets)]
+	fmt.Fprintf(w, "ota_agent_download_duration_seconds_bucket{le=\"+Inf\"} %d\n", total)
+	fmt.Fprintf(w, "ota_agent_download_duration_seconds_sum %g\n", m.downloadSum)
+	fmt.Fprintf(w, "ota_agent_download_duration_seconds_count %d\n", total)
+	m.mu.Unlock()
+
+	procs := registry.List()
+	writeProcessMetric(w, procs, "ota_agent_process_running", "Whether the managed process is running.", func(pm *ProcessManager) interface{} {
+		if pm.IsRunning() {
+			return 1
+		}
+		return 0
+	})
+	writeProcessMetric(w, procs, "ota_agent_process_restarts", "Consecutive restarts of the managed process since it last stayed up for the stable period.", func(pm *ProcessManager) interface{} {
+		return pm.GetRestartCount()
+	})
+	writeProcessMetric(w, procs, "ota_agent_process_crash_looping", "Whether the managed process is crash looping.", func(pm *ProcessManager) interface{} {
+		if pm.CrashLooping() {
+			return 1
+		}
+		return 0
+	})
+	writeProcessMetric(w, procs, "ota_agent_process_uptime_seconds", "Seconds the current managed process instance has been running.", func(pm *ProcessManager) interface{} {
+		return int64(pm.Uptime().Seconds())
+	})
+	writeProcessMetric(w, procs, "ota_agent_process_last_exit_code", "Exit code of the last managed process exit, -1 if it has not exited.", func(pm *ProcessManager) interface{} {
+		return pm.LastExitCode()
+	})
+}
+
+// writeProcessMetric writes a gauge with one sample per supervised process
+func writeProcessMetric(w io.Writer, procs []registeredProcess, name, help string, value func(*ProcessManager) interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, p := range procs {
+		fmt.Fprintf(w, "%s{process=\"%s\"} %v\n", name, labelValue(p.Spec.Name), value(p.PM))
+	}
+}
+
+// metricsHandler serves the metrics for this agent
+func metricsHandler(agentID, versionFile string, registry *ProcessRegistry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.write(w, agentID, versionFile, registry)
+	})
+}
+
+// serveMetrics exposes /metrics on addr in the background
+func serveMetrics(addr, agentID, versionFile string, registry *ProcessRegistry, logger *Logger) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(agentID, versionFile, registry))
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("metrics listen on %s: %w", addr, err)
+	}
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			logger.Error("metrics server stopped: %v", err)
+		}
+	}()
+	logger.Info("metrics available at http://%s/metrics", addr)
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pidRecord is the content of a process pidfile. The first line holds
+// only the pid so that other tools can read it; the second line holds
+// what is needed to tell the process apart from an unrelated one that
+// got the same pid later.
+type pidRecord struct {
+	PID       int       `json:"-"`
+	StartTime uint64    `json:"start_time"`        // kernel start time of the process
+	BootID    string    `json:"boot_id,omitempty"` // boot the start time belongs to
+	Exe       string    `json:"exe,omitempty"`     // resolved executable the command runs
+	Command   string    `json:"command"`
+	StartedAt time.Time `json:"started_at"`
+
+	Relay          int    `json:"relay,omitempty"`            // pid of the output relay
+	RelayStartTime uint64 `json:"relay_start_time,omitempty"` // kernel start time of the output relay
+}
+
+// writePidFile atomically writes rec to path
+func writePidFile(path string, rec pidRecord) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d\n%s\n", rec.PID, meta)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readPidFile reads a pidfile written by writePidFile
+func readPidFile(path string) (pidRecord, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return pidRecord{}, err
+	}
+	var rec pidRecord
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	if !sc.Scan() {
+		return pidRecord{}, fmt.Errorf("%s: empty pidfile", path)
+	}
+	if rec.PID, err = strconv.Atoi(strings.TrimSpace(sc.Text())); err != nil || rec.PID <= 0 {
+		return pidRecord{}, fmt.Errorf("%s: bad pid %q", path, sc.Text())
+	}
+	if sc.Scan() {
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return pidRecord{}, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return rec, nil
+}
+
+// newPidRecord describes the process pid started for spec
+func newPidRecord(pid int, spec CommandSpec) pidRecord {
+	rec := pidRecord{PID: pid, Exe: resolveExe(spec), Command: spec.String(), StartedAt: time.Now()}
+	rec.StartTime, _, _ = processStartTime(pid)
+	rec.BootID = bootID()
+	return rec
+}
+
+// alive reports whether the process rec describes is still running. A
+// pid reused by another process after a restart or reboot has a
+// different start time or boot id.
+func (rec pidRecord) alive() bool {
+	if rec.StartTime == 0 {
+		return false
+	}
+	start, zombie, err := processStartTime(rec.PID)
+	return err == nil && !zombie && start == rec.StartTime && bootID() == rec.BootID
+}
+
+// zombie reports whether the process rec describes has exited but was
+// not waited for yet
+func (rec pidRecord) zombie() bool {
+	start, zombie, err := processStartTime(rec.PID)
+	return err == nil && zombie && start == rec.StartTime && bootID() == rec.BootID
+}
+
+// mismatch returns why the live process rec describes cannot be adopted
+// for spec, or "" if it can: it must run the same command line from the
+// executable the command resolves to now, which fails once the
+// executable was replaced by an update
+func (rec pidRecord) mismatch(spec CommandSpec) string {
+	if rec.Command != spec.String() {
+		return fmt.Sprintf("it runs %s", rec.Command)
+	}
+	want := resolveExe(spec)
+	exe, err := processExe(rec.PID)
+	if err != nil {
+		return fmt.Sprintf("cannot read its executable: %v", err)
+	}
+	if want == "" || exe != want {
+		return fmt.Sprintf("its executable %s is not the current %s", exe, want)
+	}
+	return ""
+}
+
+// resolveExe returns the absolute, symlink-free path of the program spec
+// runs, or "" if it cannot be found
+func resolveExe(spec CommandSpec) string {
+	if spec.IsZero() {
+		return ""
+	}
+	path := spec.Command.Argv[0]
+	if !strings.ContainsRune(path, filepath.Separator) {
+		p, err := exec.LookPath(path)
+		if err != nil {
+			return ""
+		}
+		path = p
+	} else if !filepath.IsAbs(path) && spec.Dir != "" {
+		path = filepath.Join(spec.Dir, path)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return path
+}
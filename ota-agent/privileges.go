@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// privHelperArg is the first argument of the agent re-executed as the
+// helper that drops privileges before exec'ing a managed process
+const privHelperArg = "__ota-exec"
+
+// Privileges describes the identity and restrictions a command runs with.
+// The agent usually runs as root; without any of these set, commands
+// inherit the agent's privileges.
+type Privileges struct {
+	User         string       `yaml:"user,omitempty" json:"user,omitempty"`                 // run as this user (name or uid)
+	Group        string       `yaml:"group,omitempty" json:"group,omitempty"`               // run as this group (name or gid), default: the user's primary group
+	Groups       []string     `yaml:"groups,omitempty" json:"groups,omitempty"`             // supplementary groups, default: the user's groups
+	Umask        string       `yaml:"umask,omitempty" json:"umask,omitempty"`               // octal file mode creation mask, e.g. "027"
+	NoNewPrivs   bool         `yaml:"no_new_privs,omitempty" json:"no_new_privs,omitempty"` // forbid gaining privileges through setuid binaries or file capabilities
+	Capabilities Capabilities `yaml:"capabilities,omitempty" json:"capabilities,omitempty"` // capabilities kept in the bounding set; [] drops all
+}
+
+// Capabilities is a list of Linux capability names such as
+// "net_bind_service" or "CAP_NET_BIND_SERVICE". A nil list leaves the
+// capabilities alone, an empty one drops them all.
+type Capabilities []string
+
+// IsZero reports whether the capabilities are left alone, so that an
+// explicit empty list survives a round trip through YAML
+func (c Capabilities) IsZero() bool {
+	return c == nil
+}
+
+// IsZero reports whether the command keeps the agent's privileges
+func (p Privileges) IsZero() bool {
+	return p.User == "" && p.Group == "" && p.Groups == nil && p.Umask == "" && !p.NoNewPrivs && p.Capabilities == nil
+}
+
+// Equal reports whether both run with the same privileges
+func (p Privileges) Equal(o Privileges) bool {
+	return p.User == o.User && p.Group == o.Group && p.Umask == o.Umask && p.NoNewPrivs == o.NoNewPrivs &&
+		strings.Join(p.Groups, ",") == strings.Join(o.Groups, ",") &&
+		(p.Capabilities == nil) == (o.Capabilities == nil) &&
+		strings.Join(p.Capabilities, ",") == strings.Join(o.Capabilities, ",")
+}
+
+// needsHelper reports whether the restrictions go beyond what the kernel
+// applies on fork and must be set up by the re-exec helper
+func (p Privileges) needsHelper() bool {
+	return p.Umask != "" || p.NoNewPrivs || p.Capabilities != nil
+}
+
+// validate checks the privileges for syntax errors
+func (p Privileges) validate() error {
+	if p.Umask != "" {
+		if _, err := parseUmask(p.Umask); err != nil {
+			return err
+		}
+	}
+	for _, name := range p.Capabilities {
+		if _, err := capabilityNumber(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseUmask parses an octal umask such as "027" or "0o027"
+func parseUmask(s string) (int, error) {
+	m, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimPrefix(s, "0o"), "0O"), 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid umask %q: must be octal, e.g. 027", s)
+	}
+	return int(m), nil
+}
+
+// capabilityNames are the Linux capabilities by number
+var capabilityNames = []string{
+	"chown", "dac_override", "dac_read_search", "fowner", "fsetid", "kill", "setgid", "setuid",
+	"setpcap", "linux_immutable", "net_bind_service", "net_broadcast", "net_admin", "net_raw", "ipc_lock", "ipc_owner",
+	"sys_module", "sys_rawio", "sys_chroot", "sys_ptrace", "sys_pacct", "sys_admin", "sys_boot", "sys_nice",
+	"sys_resource", "sys_time", "sys_tty_config", "mknod", "lease", "audit_write", "audit_control", "setfcap",
+	"mac_override", "mac_admin", "syslog", "wake_alarm", "block_suspend", "audit_read", "perfmon", "bpf",
+	"checkpoint_restore",
+}
+
+// capabilityNumber returns the number of a capability name, with or
+// without the CAP_ prefix and in any case
+func capabilityNumber(name string) (int, error) {
+	n := strings.TrimPrefix(strings.ToLower(name), "cap_")
+	for i, c := range capabilityNames {
+		if c == n {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown capability %q", name)
+}
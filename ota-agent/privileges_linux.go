@@ -0,0 +1,213 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// prctl options and capability ABI, from <linux/prctl.h> and
+// <linux/capability.h>
+const (
+	prSetKeepCaps      = 8
+	prCapBSetDrop      = 24
+	prSetNoNewPrivs    = 38
+	prCapAmbient       = 47
+	prCapAmbientRaise  = 2
+	capabilityVersion3 = 0x20080522
+)
+
+// privilegeDrop is what the helper applies before exec'ing the command
+type privilegeDrop struct {
+	SetIDs     bool     `json:"set_ids"`
+	Uid        int      `json:"uid"`
+	Gid        int      `json:"gid"`
+	Groups     []int    `json:"groups"` // nil keeps the agent's groups
+	Umask      int      `json:"umask"`  // -1 keeps the agent's umask
+	NoNewPrivs bool     `json:"no_new_privs"`
+	Caps       []int    `json:"caps"` // nil keeps the bounding set
+	Path       string   `json:"path"` // resolved program
+	Argv       []string `json:"argv"`
+}
+
+// applyPrivileges makes cmd run with the privileges of p. User and groups
+// are set by the kernel on fork. Umask, no_new_privs and the capability
+// bounding set have no fork-time equivalent, so cmd is rewritten to
+// re-exec the agent as a helper that applies them and then execs the
+// command in place, keeping its pid.
+func applyPrivileges(cmd *exec.Cmd, p Privileges) error {
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+	cred, err := credential(p)
+	if err != nil {
+		return err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if !p.needsHelper() {
+		cmd.SysProcAttr.Credential = cred
+		return nil
+	}
+
+	d := privilegeDrop{Umask: -1, NoNewPrivs: p.NoNewPrivs, Path: cmd.Path, Argv: cmd.Args}
+	if p.User != "" || p.Group != "" || p.Groups != nil {
+		d.SetIDs = true
+		d.Uid, d.Gid = int(cred.Uid), int(cred.Gid)
+		if !cred.NoSetGroups {
+			d.Groups = make([]int, len(cred.Groups))
+			for i, g := range cred.Groups {
+				d.Groups[i] = int(g)
+			}
+		}
+	}
+	if p.Umask != "" {
+		if d.Umask, err = parseUmask(p.Umask); err != nil {
+			return err
+		}
+	}
+	if p.Capabilities != nil {
+		d.Caps = []int{}
+		for _, name := range p.Capabilities {
+			c, err := capabilityNumber(name)
+			if err != nil {
+				return err
+			}
+			d.Caps = append(d.Caps, c)
+		}
+	}
+	spec, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	// /proc/self/exe still works after the agent binary was replaced
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = []string{cmd.Args[0], privHelperArg, string(spec)}
+	return nil
+}
+
+// runPrivHelper is the entry point of the agent re-executed by
+// applyPrivileges. It only returns by exiting.
+func runPrivHelper(args []string) {
+	// prctl settings and capabilities are per thread; exec must happen on
+	// the thread they were applied to
+	runtime.LockOSThread()
+	var d privilegeDrop
+	err := fmt.Errorf("usage: %s <spec>", privHelperArg)
+	if len(args) == 1 {
+		if err = json.Unmarshal([]byte(args[0]), &d); err == nil {
+			err = d.exec()
+		}
+	}
+	fmt.Fprintf(os.Stderr, "ota-agent: %v\n", err)
+	os.Exit(126)
+}
+
+// exec drops privileges and replaces the helper with the command. It only
+// returns on error.
+func (d privilegeDrop) exec() error {
+	if d.Umask >= 0 {
+		syscall.Umask(d.Umask)
+	}
+	var keep [2]uint32
+	for _, c := range d.Caps {
+		keep[c/32] |= 1 << (c % 32)
+	}
+	if d.Caps != nil {
+		for c := 0; c <= lastCap(); c++ {
+			if keep[c/32]&(1<<(c%32)) != 0 {
+				continue
+			}
+			if err := prctl(prCapBSetDrop, uintptr(c), 0); err != nil {
+				return fmt.Errorf("drop capability %s: %w", capabilityName(c), err)
+			}
+		}
+	}
+
+	if d.SetIDs {
+		// Keep the permitted set across setuid to raise the kept
+		// capabilities as ambient below
+		if len(d.Caps) > 0 {
+			if err := prctl(prSetKeepCaps, 1, 0); err != nil {
+				return fmt.Errorf("keep capabilities: %w", err)
+			}
+		}
+		if d.Groups != nil {
+			if err := syscall.Setgroups(d.Groups); err != nil {
+				return fmt.Errorf("setgroups: %w", err)
+			}
+		}
+		if err := syscall.Setresgid(d.Gid, d.Gid, d.Gid); err != nil {
+			return fmt.Errorf("setgid %d: %w", d.Gid, err)
+		}
+		if err := syscall.Setresuid(d.Uid, d.Uid, d.Uid); err != nil {
+			return fmt.Errorf("setuid %d: %w", d.Uid, err)
+		}
+	}
+
+	// A non-root command only keeps capabilities that are ambient
+	if len(d.Caps) > 0 && syscall.Getuid() != 0 {
+		hdr := struct {
+			version uint32
+			pid     int32
+		}{capabilityVersion3, 0}
+		var data [2]struct{ effective, permitted, inheritable uint32 }
+		for i := range data {
+			data[i].effective, data[i].permitted, data[i].inheritable = keep[i], keep[i], keep[i]
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+			return fmt.Errorf("capset: %w", errno)
+		}
+		for _, c := range d.Caps {
+			if err := prctl(prCapAmbient, prCapAmbientRaise, uintptr(c)); err != nil {
+				return fmt.Errorf("raise ambient capability %s: %w", capabilityName(c), err)
+			}
+		}
+	}
+
+	if d.NoNewPrivs {
+		if err := prctl(prSetNoNewPrivs, 1, 0); err != nil {
+			return fmt.Errorf("set no_new_privs: %w", err)
+		}
+	}
+	if err := syscall.Exec(d.Path, d.Argv, os.Environ()); err != nil {
+		return fmt.Errorf("exec %s: %w", d.Path, err)
+	}
+	return nil
+}
+
+// prctl calls prctl(2) on the current thread
+func prctl(option, arg2, arg3 uintptr) error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, option, arg2, arg3, 0, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// lastCap returns the highest capability number the kernel knows
+func lastCap() int {
+	b, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && n < 64 {
+			return n
+		}
+	}
+	return len(capabilityNames) - 1
+}
+
+// capabilityName returns the CAP_ name of a capability number
+func capabilityName(c int) string {
+	if c < len(capabilityNames) {
+		return "CAP_" + strings.ToUpper(capabilityNames[c])
+	}
+	return strconv.Itoa(c)
+}
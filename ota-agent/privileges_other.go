@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// applyPrivileges is not supported on this platform
+func applyPrivileges(cmd *exec.Cmd, p Privileges) error {
+	return fmt.Errorf("running commands as another user or with restricted privileges is not supported on this platform")
+}
+
+// runPrivHelper is never invoked on this platform
+func runPrivHelper(args []string) {
+	fmt.Fprintln(os.Stderr, "ota-agent: privilege helper is not supported on this platform")
+	os.Exit(126)
+}
@@ -0,0 +1,33 @@
+//go:build unix && !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// applyPrivileges makes cmd run as the user and groups of p. Umask,
+// no_new_privs and capabilities are only supported on Linux.
+func applyPrivileges(cmd *exec.Cmd, p Privileges) error {
+	if p.needsHelper() {
+		return fmt.Errorf("umask, no_new_privs and capabilities are only supported on Linux")
+	}
+	cred, err := credential(p)
+	if err != nil {
+		return err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = cred
+	return nil
+}
+
+// runPrivHelper is never invoked on this platform
+func runPrivHelper(args []string) {
+	fmt.Fprintln(os.Stderr, "ota-agent: privilege helper is only supported on Linux")
+	os.Exit(126)
+}
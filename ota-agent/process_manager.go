@@ -3,41 +3,145 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
+// Defaults of the stop and reload policy
+const (
+	defaultStopSignal   = "SIGTERM"
+	defaultStopTimeout  = 5 * time.Second
+	defaultReloadSignal = "SIGHUP"
+)
+
+// RestartPolicy controls how a crashed process is restarted. The delay
+// doubles with every consecutive restart up to MaxDelay, with random
+// jitter so that processes crashing together do not restart in lockstep.
+// A process that stays up for StableAfter starts over with the initial
+// delay and a restart count of zero.
+type RestartPolicy struct {
+	Delay       time.Duration // delay before the first restart
+	MaxDelay    time.Duration // upper bound of the delay
+	StableAfter time.Duration // uptime after which the restart count is reset
+	CrashLoop   int           // consecutive restarts after which the process is crash looping, 0 disables
+	MaxRestarts int           // consecutive restarts before giving up, -1 for unlimited
+}
+
+// DefaultRestartPolicy is the restart policy of new process managers
+var DefaultRestartPolicy = RestartPolicy{
+	Delay:       3 * time.Second,
+	MaxDelay:    2 * time.Minute,
+	StableAfter: 5 * time.Minute,
+	CrashLoop:   5,
+	MaxRestarts: -1,
+}
+
+// backoff returns the delay before the given consecutive restart (1-based)
+func (p RestartPolicy) backoff(restart int) time.Duration {
+	delay := p.Delay
+	for i := 1; i < restart && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	// +/-20% jitter
+	return time.Duration(float64(delay) * (0.8 + 0.4*rand.Float64()))
+}
+
+// Lifecycle controls how a supervised process is stopped and reloaded
+type Lifecycle struct {
+	StopSignal   string        `yaml:"stop_signal,omitempty" json:"stop_signal,omitempty"`     // signal asking the process to exit (default SIGTERM)
+	StopTimeout  time.Duration `yaml:"stop_timeout,omitempty" json:"stop_timeout,omitempty"`   // grace period before SIGKILL (default 5s)
+	KillGroup    bool          `yaml:"kill_group,omitempty" json:"kill_group,omitempty"`       // run in its own process group and signal the whole group
+	Reload       bool          `yaml:"reload,omitempty" json:"reload,omitempty"`               // the process reloads its files on the reload signal instead of being restarted
+	ReloadSignal string        `yaml:"reload_signal,omitempty" json:"reload_signal,omitempty"` // signal asking the process to reload (default SIGHUP)
+}
+
+// withDefaults returns a copy of l with unset fields filled in
+func (l Lifecycle) withDefaults() Lifecycle {
+	if l.StopSignal == "" {
+		l.StopSignal = defaultStopSignal
+	}
+	if l.StopTimeout <= 0 {
+		l.StopTimeout = defaultStopTimeout
+	}
+	if l.ReloadSignal == "" {
+		l.ReloadSignal = defaultReloadSignal
+	}
+	return l
+}
+
+// validate checks the signal names
+func (l Lifecycle) validate() error {
+	l = l.withDefaults()
+	if _, err := parseSignal(l.StopSignal); err != nil {
+		return fmt.Errorf("stop_signal: %w", err)
+	}
+	if _, err := parseSignal(l.ReloadSignal); err != nil {
+		return fmt.Errorf("reload_signal: %w", err)
+	}
+	return nil
+}
+
+// parseSignal parses a signal name such as "SIGTERM" or "term", or a
+// signal number
+func parseSignal(name string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(name); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", name)
+}
+
 // ProcessManager manages a process with monitoring and auto-restart
 type ProcessManager struct {
-	cmdline      string
-	cmd          *exec.Cmd
+	name         string
+	spec         CommandSpec
+	proc         *os.Process   // current process instance, spawned or adopted
+	exited       chan struct{} // closed when the current process instance has exited
+	pidFile      string        // "" disables the pidfile and adoption
+	adopt        bool          // adopt a matching process left running by a previous agent
 	ctx          context.Context
 	cancel       context.CancelFunc
 	logger       *Logger
 	mu           sync.Mutex
 	running      bool
-	restartCount int
-	maxRestarts  int
-	restartDelay time.Duration
+	restartCount int // consecutive restarts, reset once the process is stable
+	exitCount    int // exits of the process, never reset
+	policy       RestartPolicy
+	crashLooping bool
+	onCrashLoop  func(*ProcessManager)
 	stopChan     chan struct{}
 	stopped      bool
+	startedAt    time.Time // start of the current process instance
+	lastExitCode int       // -1 until the process has exited once
+	outputOpts   ProcessOutputOptions
+	output       *processOutput
+	lastCrash    *CrashReport
 }
 
 // NewProcessManager creates a new process manager
-func NewProcessManager(cmdline string, logger *Logger) *ProcessManager {
+func NewProcessManager(name string, spec CommandSpec, logger *Logger) *ProcessManager {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &ProcessManager{
-		cmdline:      cmdline,
+		name:         name,
+		spec:         spec,
 		ctx:          ctx,
 		cancel:       cancel,
 		logger:       logger,
-		maxRestarts:  -1, // -1 means unlimited
-		restartDelay: 3 * time.Second,
+		policy:       DefaultRestartPolicy,
 		stopChan:     make(chan struct{}),
+		lastExitCode: -1,
 	}
 }
 
@@ -45,18 +149,60 @@ func NewProcessManager(cmdline string, logger *Logger) *ProcessManager {
 func (pm *ProcessManager) SetMaxRestarts(max int) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
-	pm.maxRestarts = max
+	pm.policy.MaxRestarts = max
 }
 
-// SetRestartDelay sets the delay before restarting after a crash
+// SetRestartDelay sets the delay before the first restart after a crash
 func (pm *ProcessManager) SetRestartDelay(delay time.Duration) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
-	pm.restartDelay = delay
+	pm.policy.Delay = delay
+}
+
+// SetRestartPolicy sets how crashes are handled
+func (pm *ProcessManager) SetRestartPolicy(policy RestartPolicy) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.policy = policy
+}
+
+// OnCrashLoop sets a function called when the process enters the crash
+// loop state
+func (pm *ProcessManager) OnCrashLoop(fn func(*ProcessManager)) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.onCrashLoop = fn
+}
+
+// SetOutputOptions sets where the process output is captured
+func (pm *ProcessManager) SetOutputOptions(opts ProcessOutputOptions) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.outputOpts = opts
+}
+
+// SetPidFile sets the pidfile recording the running process instance.
+// Before the first start, a process still running from the pidfile of a
+// previous agent run is stopped, or adopted by Adopt.
+func (pm *ProcessManager) SetPidFile(path string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.pidFile = path
 }
 
 // Start starts the process and begins monitoring
 func (pm *ProcessManager) Start() error {
+	return pm.start(false)
+}
+
+// Adopt begins monitoring the process recorded in the pidfile if it is
+// still running the same command from the same executable, and starts
+// the process otherwise
+func (pm *ProcessManager) Adopt() error {
+	return pm.start(true)
+}
+
+func (pm *ProcessManager) start(adopt bool) error {
 	pm.mu.Lock()
 	if pm.running {
 		pm.mu.Unlock()
@@ -64,13 +210,17 @@ func (pm *ProcessManager) Start() error {
 	}
 	pm.running = true
 	pm.stopped = false
+	pm.adopt = adopt
 	pm.mu.Unlock()
 
 	go pm.monitor()
 	return nil
 }
 
-// Stop stops the process gracefully
+// Stop stops the process gracefully: it sends the stop signal and kills
+// the process if it has not exited when the stop timeout expires. With
+// kill_group the signals go to the whole process group, and members that
+// outlive the main process are killed at the end of the timeout.
 func (pm *ProcessManager) Stop() error {
 	pm.mu.Lock()
 	if !pm.running || pm.stopped {
@@ -78,31 +228,34 @@ func (pm *ProcessManager) Stop() error {
 		return nil
 	}
 	pm.stopped = true
+	proc, exited := pm.proc, pm.exited
 	pm.mu.Unlock()
 
-	pm.cancel()
 	close(pm.stopChan)
 
-	pm.mu.Lock()
-	if pm.cmd != nil && pm.cmd.Process != nil {
-		// Try graceful shutdown first (SIGTERM)
-		pm.cmd.Process.Signal(syscall.SIGTERM)
-		pm.mu.Unlock()
-
-		// Wait a bit for graceful shutdown
+	if proc != nil && exited != nil && !isClosed(exited) {
+		lc := pm.spec.Lifecycle.withDefaults()
+		sig, err := parseSignal(lc.StopSignal)
+		if err != nil {
+			sig = syscall.SIGTERM
+		}
+		deadline := time.After(lc.StopTimeout)
+		if err := signalProcess(proc, sig, lc.KillGroup); err != nil {
+			pm.logger.Debug("send %s: %v", lc.StopSignal, err)
+		}
 		select {
-		case <-time.After(5 * time.Second):
-			pm.mu.Lock()
-			if pm.cmd != nil && pm.cmd.Process != nil {
-				// Force kill if still running
-				pm.cmd.Process.Kill()
+		case <-exited:
+			if lc.KillGroup {
+				pm.reapGroup(proc, deadline)
 			}
-			pm.mu.Unlock()
-		case <-pm.ctx.Done():
+		case <-deadline:
+			pm.logger.Warn("process did not exit within %v of %s, killing it", lc.StopTimeout, lc.StopSignal)
+			signalProcess(proc, syscall.SIGKILL, lc.KillGroup)
+			<-exited
 		}
-	} else {
-		pm.mu.Unlock()
 	}
+	pm.cancel()
+	pm.removePidFile()
 
 	pm.mu.Lock()
 	pm.running = false
@@ -111,6 +264,62 @@ func (pm *ProcessManager) Stop() error {
 	return nil
 }
 
+// isClosed reports whether ch is closed
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release stops monitoring the process without stopping it. The
+// pidfile is kept so that the next agent run can adopt the process.
+func (pm *ProcessManager) Release() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if !pm.running || pm.stopped {
+		return
+	}
+	pm.stopped = true
+	pm.running = false
+	close(pm.stopChan)
+}
+
+// reapGroup waits for the rest of the process group led by p to exit
+// and kills what is left when deadline fires
+func (pm *ProcessManager) reapGroup(p *os.Process, deadline <-chan time.Time) {
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for groupAlive(p) {
+		select {
+		case <-tick.C:
+		case <-deadline:
+			pm.logger.Warn("killing processes left in the process group")
+			signalProcess(p, syscall.SIGKILL, true)
+			return
+		}
+	}
+}
+
+// Reload asks the running process to reload by sending it the reload
+// signal
+func (pm *ProcessManager) Reload() error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if !pm.running || pm.stopped || pm.proc == nil || pm.startedAt.IsZero() {
+		return fmt.Errorf("process is not running")
+	}
+	lc := pm.spec.Lifecycle.withDefaults()
+	sig, err := parseSignal(lc.ReloadSignal)
+	if err != nil {
+		return err
+	}
+	pm.logger.Info("reloading process with %s", lc.ReloadSignal)
+	return signalProcess(pm.proc, sig, false)
+}
+
 // IsRunning returns whether the process is currently running
 func (pm *ProcessManager) IsRunning() bool {
 	pm.mu.Lock()
@@ -118,36 +327,375 @@ func (pm *ProcessManager) IsRunning() bool {
 	return pm.running && !pm.stopped
 }
 
-// GetRestartCount returns the number of times the process has been restarted
+// GetRestartCount returns the number of consecutive restarts since the
+// process last ran stably
 func (pm *ProcessManager) GetRestartCount() int {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 	return pm.restartCount
 }
 
+// ExitCount returns how often the process has exited, including exits
+// before the restart count was reset
+func (pm *ProcessManager) ExitCount() int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.exitCount
+}
+
+// CrashLooping reports whether the process keeps crashing shortly after
+// every restart
+func (pm *ProcessManager) CrashLooping() bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.crashLooping
+}
+
+// Pid returns the pid of the current process instance, or 0 if none is running
+func (pm *ProcessManager) Pid() int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if !pm.running || pm.stopped || pm.proc == nil {
+		return 0
+	}
+	return pm.proc.Pid
+}
+
+// Uptime returns how long the current process instance has been running
+func (pm *ProcessManager) Uptime() time.Duration {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if !pm.running || pm.stopped || pm.startedAt.IsZero() {
+		return 0
+	}
+	return time.Since(pm.startedAt)
+}
+
+// LastExitCode returns the exit code of the last process exit, -1 if none
+func (pm *ProcessManager) LastExitCode() int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.lastExitCode
+}
+
+// RecentOutput returns the last captured lines of process output
+func (pm *ProcessManager) RecentOutput() []string {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.output == nil {
+		return nil
+	}
+	return pm.output.Tail()
+}
+
+// LastCrash returns the most recent unexpected exit, or nil
+func (pm *ProcessManager) LastCrash() *CrashReport {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.lastCrash
+}
+
+// instance is a running process instance, spawned by the manager or
+// adopted from a previous agent run
+type instance struct {
+	proc *os.Process
+	// wait blocks until the instance has exited and returns its exit
+	// code, -1 if it is unknown
+	wait func() int
+}
+
+// openOutput returns the output of the process, set up on first use
+func (pm *ProcessManager) openOutput() *processOutput {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.output == nil {
+		// Kept across restarts so that the tail spans the previous instance
+		name := pm.name
+		if name == "" || name == defaultProcessName {
+			name = processLogName(pm.spec.Command)
+		}
+		out, err := newProcessOutput(name, pm.outputOpts, pm.pidFile)
+		if err != nil {
+			pm.logger.Warn("process log capture disabled: %v", err)
+			opts := pm.outputOpts
+			opts.Dir = ""
+			out, _ = newProcessOutput("", opts, "")
+		}
+		pm.output = out
+	}
+	return pm.output
+}
+
+// childOutput returns the stdout and stderr pipes for a new process
+// instance, to be closed once it has started, and starts reading them.
+// The returned function waits for the output to be written once the
+// process has exited; children outliving it must not keep it blocked, so
+// it gives up after a second.
+func (pm *ProcessManager) childOutput() (stdout, stderr *os.File, relayPid int, drain func(), err error) {
+	out := pm.openOutput()
+	var readers, writers []*os.File
+	closeAll := func() {
+		for _, f := range append(readers, writers...) {
+			f.Close()
+		}
+	}
+	for range outputStreams {
+		r, w, err := os.Pipe()
+		if err != nil {
+			closeAll()
+			return nil, nil, 0, nil, err
+		}
+		readers, writers = append(readers, r), append(writers, w)
+	}
+	if out.relay != nil {
+		pid, done, err := startOutputRelay(*out.relay, readers)
+		if err == nil {
+			// The relay has its own copies
+			for _, r := range readers {
+				r.Close()
+			}
+			return writers[0], writers[1], pid, func() { waitDrained(done) }, nil
+		}
+		pm.logger.Warn("output relay not started, the agent reads the process output: %v", err)
+	}
+	w, pass := out.readByAgent()
+	done := make(chan struct{})
+	go func() {
+		relayOutput([]io.Reader{readers[0], readers[1]}, w, pass)
+		close(done)
+	}()
+	return writers[0], writers[1], 0, func() {
+		if !waitDrained(done) {
+			for _, r := range readers {
+				r.Close()
+			}
+			<-done
+		}
+		for _, r := range readers {
+			r.Close()
+		}
+	}, nil
+}
+
+// waitDrained waits up to a second for done to be closed and reports
+// whether it was
+func waitDrained(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+// reapRelay waits for the output relay of an instance recorded by a
+// previous agent run. After the agent re-executed itself the relay is
+// still its child and would otherwise be left a zombie. The returned
+// channel is closed once the relay has exited, or right away if it is
+// not a child.
+func reapRelay(rec pidRecord) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if rec.Relay <= 0 {
+			return
+		}
+		// The pid may have been reused if the relay was not a child
+		if start, _, err := processStartTime(rec.Relay); err != nil || start != rec.RelayStartTime || bootID() != rec.BootID {
+			return
+		}
+		if p, err := os.FindProcess(rec.Relay); err == nil {
+			p.Wait()
+		}
+	}()
+	return done
+}
+
 // startProcess starts a new process instance
-func (pm *ProcessManager) startProcess() error {
-	parts := strings.Fields(pm.cmdline)
-	if len(parts) == 0 {
-		return fmt.Errorf("empty command")
+func (pm *ProcessManager) startProcess() (*instance, error) {
+	pm.mu.Lock()
+	cmd, err := pm.spec.build(pm.ctx)
+	killGroup := pm.spec.KillGroup
+	pm.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// The output is set up here rather than by exec.Cmd so that it is
+	// read by the relay, which survives the agent
+	stdout, stderr, relayPid, drain, err := pm.childOutput()
+	if err != nil {
+		return nil, fmt.Errorf("set up process output: %w", err)
+	}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if killGroup {
+		setProcessGroup(cmd)
 	}
 
+	pm.logger.Info("starting process: %s", pm.spec)
+	err = cmd.Start()
+	// The process has its own copies; without them the reader sees the
+	// end of the output
+	stdout.Close()
+	stderr.Close()
+	if err != nil {
+		drain()
+		return nil, fmt.Errorf("failed to start process: %w", err)
+	}
 	pm.mu.Lock()
-	pm.cmd = exec.CommandContext(pm.ctx, parts[0], parts[1:]...)
-	pm.cmd.Stdout = os.Stdout
-	pm.cmd.Stderr = os.Stderr
+	pm.proc = cmd.Process
+	pm.exited = make(chan struct{})
+	pm.startedAt = time.Now()
+	pidFile := pm.pidFile
 	pm.mu.Unlock()
+	if pidFile != "" {
+		rec := newPidRecord(cmd.Process.Pid, pm.spec)
+		if relayPid > 0 {
+			rec.Relay = relayPid
+			rec.RelayStartTime, _, _ = processStartTime(relayPid)
+		}
+		if err := writePidFile(pidFile, rec); err != nil {
+			pm.logger.Warn("failed to write pidfile: %v", err)
+		}
+	}
+
+	return &instance{proc: cmd.Process, wait: func() int {
+		err := cmd.Wait()
+		drain()
+		if exitError, ok := err.(*exec.ExitError); ok {
+			return exitError.ExitCode()
+		}
+		return 0
+	}}, nil
+}
 
-	pm.logger.Info("starting process: %s", pm.cmdline)
-	if err := pm.cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start process: %w", err)
+// takeOver handles a process recorded in the pidfile by a previous agent
+// run. A process that is still running is adopted if adopt is set and it
+// runs the current command and executable; otherwise it is stopped so
+// that it does not run next to the instance started in its place.
+func (pm *ProcessManager) takeOver(adopt bool) *instance {
+	pm.mu.Lock()
+	pidFile := pm.pidFile
+	pm.mu.Unlock()
+	if pidFile == "" {
+		return nil
+	}
+	rec, err := readPidFile(pidFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			pm.logger.Warn("ignoring pidfile: %v", err)
+		}
+		return nil
+	}
+	proc, err := os.FindProcess(rec.PID)
+	if err != nil {
+		return nil
+	}
+	relayDone := reapRelay(rec)
+	if !rec.alive() {
+		pm.logger.Debug("process %d from the pidfile is no longer running", rec.PID)
+		if rec.zombie() {
+			// Exited while the agent re-executed itself
+			proc.Wait()
+		}
+		pm.removePidFile()
+		return nil
+	}
+	reason := "the process is being restarted"
+	if adopt {
+		reason = rec.mismatch(pm.spec)
+	}
+	if reason != "" {
+		pm.logger.Warn("stopping process %d left by a previous run: %s", rec.PID, reason)
+		pm.stopStale(proc, rec)
+		pm.removePidFile()
+		return nil
 	}
 
-	return nil
+	// The output relay of the process keeps writing its output
+	pm.logger.Info("adopted running process %d: %s", rec.PID, pm.spec)
+	pm.openOutput()
+	pm.mu.Lock()
+	pm.proc = proc
+	pm.exited = make(chan struct{})
+	pm.startedAt = rec.StartedAt
+	pm.mu.Unlock()
+	return &instance{proc: proc, wait: func() int {
+		defer waitDrained(relayDone)
+		// Only a child can be waited for: the adopted process still is
+		// after the agent re-executed itself, otherwise its exit is
+		// polled and its exit code is unknown
+		if state, err := proc.Wait(); err == nil {
+			return state.ExitCode()
+		}
+		for rec.alive() {
+			time.Sleep(250 * time.Millisecond)
+		}
+		return -1
+	}}
+}
+
+// stopStale stops a process left by a previous agent run with the stop
+// policy of the process
+func (pm *ProcessManager) stopStale(proc *os.Process, rec pidRecord) {
+	lc := pm.spec.Lifecycle.withDefaults()
+	sig, err := parseSignal(lc.StopSignal)
+	if err != nil {
+		sig = syscall.SIGTERM
+	}
+	signalProcess(proc, sig, lc.KillGroup)
+	deadline := time.Now().Add(lc.StopTimeout)
+	for rec.alive() {
+		if time.Now().After(deadline) {
+			pm.logger.Warn("process %d did not exit within %v of %s, killing it", rec.PID, lc.StopTimeout, lc.StopSignal)
+			signalProcess(proc, syscall.SIGKILL, lc.KillGroup)
+			for i := 0; i < 20 && rec.alive(); i++ {
+				time.Sleep(50 * time.Millisecond)
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// removePidFile removes the pidfile
+func (pm *ProcessManager) removePidFile() {
+	pm.mu.Lock()
+	pidFile := pm.pidFile
+	pm.mu.Unlock()
+	if pidFile == "" {
+		return
+	}
+	if err := os.Remove(pidFile); err != nil && !os.IsNotExist(err) {
+		pm.logger.Warn("failed to remove pidfile: %v", err)
+	}
+}
+
+// markStable resets the restart count and the crash loop state of a
+// process that has stayed up for StableAfter
+func (pm *ProcessManager) markStable() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.restartCount == 0 && !pm.crashLooping {
+		return
+	}
+	pm.logger.Info("process has stayed up for %v, resetting restart count", pm.policy.StableAfter)
+	pm.restartCount = 0
+	pm.crashLooping = false
 }
 
 // monitor monitors the process and restarts it if it crashes
 func (pm *ProcessManager) monitor() {
+	defer func() {
+		pm.mu.Lock()
+		if pm.output != nil {
+			pm.output.Close()
+		}
+		pm.mu.Unlock()
+	}()
+	pm.mu.Lock()
+	adopt := pm.adopt
+	pm.mu.Unlock()
+	inst := pm.takeOver(adopt)
 	for {
 		// Check if we should stop
 		pm.mu.Lock()
@@ -158,54 +706,98 @@ func (pm *ProcessManager) monitor() {
 			return
 		}
 
-		// Start the process
-		if err := pm.startProcess(); err != nil {
-			pm.logger.Error("failed to start process: %v", err)
-			pm.mu.Lock()
-			pm.running = false
-			pm.mu.Unlock()
-			return
+		// Start the process, unless one was adopted
+		if inst == nil {
+			var err error
+			if inst, err = pm.startProcess(); err != nil {
+				pm.logger.Error("failed to start process: %v", err)
+				pm.removePidFile()
+				pm.mu.Lock()
+				pm.running = false
+				pm.mu.Unlock()
+				return
+			}
 		}
 
-		// Wait for process to exit
-		err := pm.cmd.Wait()
-		exitCode := 0
-		if err != nil {
-			if exitError, ok := err.(*exec.ExitError); ok {
-				exitCode = exitError.ExitCode()
-			}
+		// Wait for process to exit, starting over with the initial
+		// restart delay once it has stayed up for StableAfter
+		pm.mu.Lock()
+		exited := pm.exited
+		var stable *time.Timer
+		if pm.policy.StableAfter > 0 {
+			stable = time.AfterFunc(pm.policy.StableAfter-time.Since(pm.startedAt), pm.markStable)
+		}
+		pm.mu.Unlock()
+		exitCode := inst.wait()
+		if stable != nil {
+			stable.Stop()
 		}
+		close(exited)
+		proc := inst.proc
+		inst = nil
 
 		pm.mu.Lock()
 		shouldStop = pm.stopped
+		pm.lastExitCode = exitCode
+		pm.exitCount++
+		uptime := time.Since(pm.startedAt)
+		pm.startedAt = time.Time{}
 		pm.mu.Unlock()
 
 		if shouldStop {
 			pm.logger.Info("process stopped by user")
 			return
 		}
+		if pm.spec.KillGroup && groupAlive(proc) {
+			pm.logger.Warn("killing processes left in the process group")
+			signalProcess(proc, syscall.SIGKILL, true)
+		}
 
 		// Process exited unexpectedly
-		if exitCode != 0 {
-			pm.logger.Warn("process exited with code %d, will restart", exitCode)
-		} else {
+		switch exitCode {
+		case 0:
 			pm.logger.Warn("process exited normally, will restart")
+		case -1:
+			pm.logger.Warn("process exited, will restart")
+		default:
+			pm.logger.Warn("process exited with code %d, will restart", exitCode)
+		}
+		crash := &CrashReport{Time: time.Now(), ExitCode: exitCode, Output: pm.RecentOutput()}
+		pm.mu.Lock()
+		pm.lastCrash = crash
+		pm.mu.Unlock()
+		if len(crash.Output) > 0 {
+			pm.logger.Warn("crash report for %s (exit code %d), last %d line(s) of output:\n%s",
+				pm.spec, exitCode, len(crash.Output), strings.Join(crash.Output, "\n"))
 		}
 
-		// Check restart limit
+		if pm.policy.StableAfter > 0 && uptime >= pm.policy.StableAfter {
+			pm.markStable()
+		}
 		pm.mu.Lock()
-		if pm.maxRestarts >= 0 && pm.restartCount >= pm.maxRestarts {
-			pm.logger.Error("max restarts (%d) reached, stopping process", pm.maxRestarts)
+		// Check restart limit
+		if pm.policy.MaxRestarts >= 0 && pm.restartCount >= pm.policy.MaxRestarts {
+			pm.logger.Error("max restarts (%d) reached, stopping process", pm.policy.MaxRestarts)
 			pm.running = false
 			pm.mu.Unlock()
+			pm.removePidFile()
 			return
 		}
 		pm.restartCount++
-		restartDelay := pm.restartDelay
+		restartDelay := pm.policy.backoff(pm.restartCount)
+		var onCrashLoop func(*ProcessManager)
+		if pm.policy.CrashLoop > 0 && pm.restartCount >= pm.policy.CrashLoop && !pm.crashLooping {
+			pm.crashLooping = true
+			onCrashLoop = pm.onCrashLoop
+			pm.logger.Error("process is crash looping: %d restarts without staying up for %v", pm.restartCount, pm.policy.StableAfter)
+		}
 		pm.mu.Unlock()
+		if onCrashLoop != nil {
+			onCrashLoop(pm)
+		}
 
 		// Wait before restarting
-		pm.logger.Info("restarting process in %v (restart count: %d)", restartDelay, pm.restartCount)
+		pm.logger.Info("restarting process in %v (restart count: %d)", restartDelay.Round(time.Millisecond), pm.restartCount)
 		select {
 		case <-time.After(restartDelay):
 			// Continue to restart
@@ -216,84 +808,3 @@ func (pm *ProcessManager) monitor() {
 		}
 	}
 }
-
-// Global process manager instance
-var (
-	globalProcessManager *ProcessManager
-	globalProcessCmdline string
-	processManagerMutex  sync.Mutex
-)
-
-// startManagedProcess starts a process with monitoring and auto-restart
-// If the same command is already running, it will be restarted
-func startManagedProcess(cmdline string, logger *Logger) (*ProcessManager, error) {
-	if cmdline == "" {
-		return nil, fmt.Errorf("empty command")
-	}
-
-	processManagerMutex.Lock()
-	defer processManagerMutex.Unlock()
-
-	// If same command is already running, restart it
-	if globalProcessManager != nil && globalProcessCmdline == cmdline {
-		if globalProcessManager.IsRunning() {
-			logger.Info("process already running with same command, restarting...")
-			globalProcessManager.Stop()
-		}
-	} else if globalProcessManager != nil {
-		// Different command, stop old one
-		logger.Info("restart command changed, stopping old process...")
-		globalProcessManager.Stop()
-	}
-
-	// Create and start new process manager
-	pm := NewProcessManager(cmdline, logger)
-	if err := pm.Start(); err != nil {
-		return nil, err
-	}
-
-	globalProcessManager = pm
-	globalProcessCmdline = cmdline
-	return pm, nil
-}
-
-// ensureManagedProcess ensures the managed process is running
-// Returns true if process was started or already running, false if startCmd is empty
-func ensureManagedProcess(startCmd string, reason string, logger *Logger) (bool, error) {
-	if startCmd == "" {
-		return false, nil
-	}
-
-	processManagerMutex.Lock()
-	shouldStart := globalProcessManager == nil || !globalProcessManager.IsRunning() || globalProcessCmdline != startCmd
-	processManagerMutex.Unlock()
-
-	if !shouldStart {
-		logger.Info("managed process already running: %s", startCmd)
-		return true, nil
-	}
-
-	logger.Info("ensuring managed process is running (%s): %s", reason, startCmd)
-	pm, err := startManagedProcess(startCmd, logger)
-	if err != nil {
-		logger.Error("failed to start managed process: %v", err)
-		return false, fmt.Errorf("failed to start managed process: %w", err)
-	}
-	logger.Info("process manager started (restart count: %d)", pm.GetRestartCount())
-	return true, nil
-}
-
-// stopManagedProcess stops the managed process
-func stopManagedProcess() error {
-	processManagerMutex.Lock()
-	defer processManagerMutex.Unlock()
-
-	if globalProcessManager != nil {
-		err := globalProcessManager.Stop()
-		globalProcessManager = nil
-		globalProcessCmdline = ""
-		return err
-	}
-	return nil
-}
-
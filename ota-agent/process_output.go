@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProcessOutputOptions controls where managed process output goes
+type ProcessOutputOptions struct {
+	Dir         string        // per-process log files are written here; empty passes output through to the agent
+	MaxSize     int64         // rotate a log file once it exceeds this many bytes (0 disables)
+	MaxBackups  int           // rotated files kept per process
+	RotateEvery time.Duration // also rotate files older than this (0 disables)
+	TailLines   int           // lines of output in crash reports
+}
+
+// maxOutputLine bounds a line of output; longer lines are split
+const maxOutputLine = 64 * 1024
+
+// maxTailBytes bounds how much of a process log is read for its last lines
+const maxTailBytes = 256 * 1024
+
+// processOutput collects the output of a managed process. A process that
+// may outlive the agent writes to pipes read by an output relay, which
+// appends each line with a timestamp and its stream to the log file, or
+// without a log directory to a small file next to the pidfile while
+// passing the output through to the agent's stdout/stderr; the agent reads
+// the last lines of that file for crash reports. Otherwise the agent reads
+// the pipes itself and keeps the last lines in memory.
+type processOutput struct {
+	mu    sync.Mutex
+	relay *relaySpec    // nil when the agent reads the output itself
+	file  *rotatingFile // file written by the agent itself, if any
+	ring  []string
+	next  int
+	full  bool
+}
+
+// processLogName derives a log file name from a command
+func processLogName(c Command) string {
+	if c.IsZero() {
+		return "process"
+	}
+	return filepath.Base(c.Argv[0])
+}
+
+// newProcessOutput sets up the output of the named process. With a
+// pidfile the output goes through a relay.
+func newProcessOutput(name string, opts ProcessOutputOptions, pidFile string) (*processOutput, error) {
+	tail := opts.TailLines
+	if tail <= 0 {
+		tail = 1
+	}
+	o := &processOutput{ring: make([]string, tail)}
+	switch {
+	case relaySupported && pidFile != "":
+		spec := relaySpec{
+			Path:        strings.TrimSuffix(pidFile, ".pid") + ".out",
+			MaxSize:     maxTailBytes,
+			MaxBackups:  1,
+			Passthrough: true,
+		}
+		if opts.Dir != "" {
+			spec = relaySpec{
+				Path:        filepath.Join(opts.Dir, name+".log"),
+				MaxSize:     opts.MaxSize,
+				MaxBackups:  opts.MaxBackups,
+				RotateEvery: opts.RotateEvery,
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(spec.Path), 0755); err != nil {
+			return nil, fmt.Errorf("create log directory: %w", err)
+		}
+		o.relay = &spec
+	case opts.Dir != "":
+		rf, err := openRotatingFile(filepath.Join(opts.Dir, name+".log"), opts.MaxSize, opts.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		rf.rotateEvery = opts.RotateEvery
+		o.file = rf
+	}
+	return o, nil
+}
+
+// Write records one line of output formatted by relayOutput
+func (o *processOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ring[o.next] = strings.TrimSuffix(string(p), "\n")
+	o.next = (o.next + 1) % len(o.ring)
+	if o.next == 0 {
+		o.full = true
+	}
+	if o.file != nil {
+		return o.file.Write(p)
+	}
+	return len(p), nil
+}
+
+// readByAgent returns where the lines of output read by the agent itself
+// are written, and where they are passed through to. If the relay could
+// not be started they go where the relay would have written them.
+func (o *processOutput) readByAgent() (io.Writer, []io.Writer) {
+	pass := []io.Writer{os.Stdout, os.Stderr}
+	if o.relay == nil {
+		return o, pass
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.file == nil {
+		if rf, err := openRotatingFile(o.relay.Path, o.relay.MaxSize, o.relay.MaxBackups); err == nil {
+			rf.rotateEvery = o.relay.RotateEvery
+			o.file = rf
+		}
+	}
+	if !o.relay.Passthrough {
+		pass = nil
+	}
+	return o, pass
+}
+
+// Tail returns the most recent lines, oldest first
+func (o *processOutput) Tail() []string {
+	if o.relay != nil {
+		return tailFile(o.relay.Path, len(o.ring))
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.full {
+		return append([]string(nil), o.ring[:o.next]...)
+	}
+	return append(append([]string(nil), o.ring[o.next:]...), o.ring[:o.next]...)
+}
+
+// Close closes the log file written by the agent
+func (o *processOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.file != nil {
+		return o.file.Close()
+	}
+	return nil
+}
+
+// tailFile returns the last n lines of the log file at path, oldest first.
+// Lines from before the last rotation are read from <path>.1.
+func tailFile(path string, n int) []string {
+	lines := readTail(path)
+	if len(lines) < n {
+		lines = append(readTail(path+".1"), lines...)
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// readTail returns the lines in the last maxTailBytes of a file
+func readTail(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	offset := info.Size() - maxTailBytes
+	if offset < 0 {
+		offset = 0
+	}
+	b := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(b, offset); err != nil && err != io.EOF {
+		return nil
+	}
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	if offset > 0 {
+		// The first line is cut off
+		lines = lines[1:]
+	}
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	return lines
+}
+
+// CrashReport describes an unexpected exit of a managed process
+type CrashReport struct {
+	Time     time.Time `json:"time"`
+	ExitCode int       `json:"exit_code"`
+	Output   []string  `json:"output,omitempty"` // last lines of output before the exit
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultProcessName is the registry name of the process run by
+// -start-cmd / restart_cmd
+const defaultProcessName = "default"
+
+// ProcessSpec describes a supervised process in the config
+type ProcessSpec struct {
+	Name    string            `yaml:"name" json:"name"`                       // unique process name
+	Command Command           `yaml:"command" json:"command"`                 // command line or argv list
+	Env     map[string]string `yaml:"env,omitempty" json:"env,omitempty"`     // extra environment variables
+	Dir     string            `yaml:"dir,omitempty" json:"dir,omitempty"`     // working directory
+	Files   []string          `yaml:"files,omitempty" json:"files,omitempty"` // names of files whose update restarts it; empty means any file
+
+	Privileges `yaml:",inline"` // user, group and restrictions
+	Lifecycle  `yaml:",inline"` // stop and reload policy
+}
+
+// defaultProcess returns the spec of the process run by restart_cmd or -start-cmd
+func defaultProcess(cs CommandSpec) ProcessSpec {
+	return ProcessSpec{Name: defaultProcessName, Command: cs.Command, Env: cs.Env, Dir: cs.Dir, Privileges: cs.Privileges, Lifecycle: cs.Lifecycle}
+}
+
+// commandSpec returns how the process is spawned
+func (s ProcessSpec) commandSpec() CommandSpec {
+	return CommandSpec{Command: s.Command, Env: s.Env, Dir: s.Dir, Privileges: s.Privileges, Lifecycle: s.Lifecycle}
+}
+
+// sameRuntime reports whether two specs run the same command the same way
+func (s ProcessSpec) sameRuntime(o ProcessSpec) bool {
+	return s.commandSpec().Equal(o.commandSpec())
+}
+
+// triggeredBy reports whether an update of the named files restarts the process
+func (s ProcessSpec) triggeredBy(changed map[string]bool) bool {
+	if len(changed) == 0 {
+		return false
+	}
+	if len(s.Files) == 0 {
+		return true
+	}
+	for _, f := range s.Files {
+		if changed[f] {
+			return true
+		}
+	}
+	return false
+}
+
+// validateProcesses checks the processes section of a config
+func validateProcesses(specs []ProcessSpec, files []FileUpdate) error {
+	fileNames := make(map[string]bool, len(files))
+	for _, f := range files {
+		fileNames[f.Name] = true
+	}
+	seen := make(map[string]bool, len(specs))
+	for i, p := range specs {
+		if p.Name == "" {
+			return fmt.Errorf("processes[%d].name is required", i)
+		}
+		if p.Name == defaultProcessName {
+			return fmt.Errorf("processes[%d].name %q is reserved for restart_cmd", i, p.Name)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("processes[%d]: duplicate name %q", i, p.Name)
+		}
+		seen[p.Name] = true
+		if p.Command.IsZero() {
+			return fmt.Errorf("processes[%d].command is required", i)
+		}
+		if err := p.Privileges.validate(); err != nil {
+			return fmt.Errorf("processes[%d]: %w", i, err)
+		}
+		if err := p.Lifecycle.validate(); err != nil {
+			return fmt.Errorf("processes[%d].%w", i, err)
+		}
+		for _, f := range p.Files {
+			if !fileNames[f] {
+				return fmt.Errorf("processes[%d].files: unknown file %q", i, f)
+			}
+		}
+	}
+	return nil
+}
+
+// processesFile returns where the processes of the installed release are kept
+func processesFile(versionFile string) string {
+	return versionFile + ".processes.yaml"
+}
+
+// readProcessSpecs loads the processes of the installed release
+func readProcessSpecs(versionFile string) ([]ProcessSpec, error) {
+	b, err := os.ReadFile(processesFile(versionFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var specs []ProcessSpec
+	if err := yaml.Unmarshal(b, &specs); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", processesFile(versionFile), err)
+	}
+	return specs, nil
+}
+
+// writeProcessSpecs records the processes of the installed release
+func writeProcessSpecs(versionFile string, specs []ProcessSpec) error {
+	path := processesFile(versionFile)
+	if len(specs) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := yaml.Marshal(specs)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// errUnknownProcess is returned for names not in the registry
+var errUnknownProcess = errors.New("unknown process")
+
+// registeredProcess is a process in the registry
+type registeredProcess struct {
+	Spec ProcessSpec
+	PM   *ProcessManager
+}
+
+// ProcessRegistry supervises named processes, each with its own
+// ProcessManager
+type ProcessRegistry struct {
+	mu     sync.Mutex
+	procs  map[string]*registeredProcess
+	output ProcessOutputOptions
+	policy RestartPolicy
+	pidDir string
+	loops  chan *ProcessManager
+	logger *Logger
+}
+
+// NewProcessRegistry creates an empty registry
+func NewProcessRegistry(logger *Logger) *ProcessRegistry {
+	return &ProcessRegistry{
+		procs:  make(map[string]*registeredProcess),
+		output: ProcessOutputOptions{TailLines: 100},
+		policy: DefaultRestartPolicy,
+		loops:  make(chan *ProcessManager, 1),
+		logger: logger,
+	}
+}
+
+// SetOutputOptions sets the output capture used by processes started from now on
+func (r *ProcessRegistry) SetOutputOptions(opts ProcessOutputOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.output = opts
+}
+
+// SetRestartPolicy sets the restart policy of processes started from now on
+func (r *ProcessRegistry) SetRestartPolicy(policy RestartPolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.policy = policy
+}
+
+// SetPidDir sets the directory of the process pidfiles, "" disables them
+func (r *ProcessRegistry) SetPidDir(dir string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pidDir = dir
+}
+
+// CrashLoops receives processes entering the crash loop state. Only one
+// is buffered; further ones are dropped until it was received.
+func (r *ProcessRegistry) CrashLoops() <-chan *ProcessManager {
+	return r.loops
+}
+
+// Start (re)starts the process described by spec, stopping any process
+// already registered under the same name
+func (r *ProcessRegistry) Start(spec ProcessSpec) (*ProcessManager, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.startLocked(spec, false)
+}
+
+// Adopt starts the process described by spec like Start, but takes over
+// the instance left running by a previous agent run if its pidfile shows
+// that it still runs the same command from the same executable
+func (r *ProcessRegistry) Adopt(spec ProcessSpec) (*ProcessManager, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.startLocked(spec, true)
+}
+
+func (r *ProcessRegistry) startLocked(spec ProcessSpec, adopt bool) (*ProcessManager, error) {
+	if spec.Command.IsZero() {
+		return nil, fmt.Errorf("process %s: empty command", spec.Name)
+	}
+	logger := r.logger.With("process", spec.Name)
+	if old, ok := r.procs[spec.Name]; ok {
+		if !old.Spec.sameRuntime(spec) {
+			logger.Info("command changed, stopping old process...")
+		} else if old.PM.IsRunning() {
+			logger.Info("process already running, restarting...")
+		}
+		old.PM.Stop()
+		delete(r.procs, spec.Name)
+	}
+
+	pm := NewProcessManager(spec.Name, spec.commandSpec(), logger)
+	pm.SetOutputOptions(r.output)
+	pm.SetRestartPolicy(r.policy)
+	if r.pidDir != "" {
+		pm.SetPidFile(filepath.Join(r.pidDir, spec.Name+".pid"))
+	}
+	pm.OnCrashLoop(func(pm *ProcessManager) {
+		select {
+		case r.loops <- pm:
+		default:
+		}
+	})
+	start := pm.Start
+	if adopt {
+		start = pm.Adopt
+	}
+	if err := start(); err != nil {
+		return nil, err
+	}
+	r.procs[spec.Name] = &registeredProcess{Spec: spec, PM: pm}
+	return pm, nil
+}
+
+// Restart applies an update to the process described by spec: a running
+// process configured for hot reload whose command is unchanged gets the
+// reload signal, any other is (re)started
+func (r *ProcessRegistry) Restart(spec ProcessSpec) (*ProcessManager, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if pm, ok := r.reloadLocked(spec); ok {
+		return pm, nil
+	}
+	return r.startLocked(spec, false)
+}
+
+// reloadLocked sends the reload signal to the registered process if spec
+// allows it. It returns false when the process has to be restarted.
+func (r *ProcessRegistry) reloadLocked(spec ProcessSpec) (*ProcessManager, bool) {
+	old, ok := r.procs[spec.Name]
+	if !ok || !spec.Reload || !old.Spec.sameRuntime(spec) || !old.PM.IsRunning() {
+		return nil, false
+	}
+	if err := old.PM.Reload(); err != nil {
+		r.logger.With("process", spec.Name).Warn("reload failed, restarting instead: %v", err)
+		return nil, false
+	}
+	old.Spec = spec
+	return old.PM, true
+}
+
+// Reload sends the reload signal to the named process
+func (r *ProcessRegistry) Reload(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.procs[name]
+	if !ok {
+		return errUnknownProcess
+	}
+	if !p.Spec.Reload {
+		return fmt.Errorf("process %s does not support reload", name)
+	}
+	return p.PM.Reload()
+}
+
+// Stop stops and unregisters the named process
+func (r *ProcessRegistry) Stop(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.procs[name]
+	if !ok {
+		return nil
+	}
+	delete(r.procs, name)
+	return p.PM.Stop()
+}
+
+// StopAll stops every process
+func (r *ProcessRegistry) StopAll() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var firstErr error
+	for name, p := range r.procs {
+		if err := p.PM.Stop(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("stop %s: %w", name, err)
+		}
+		delete(r.procs, name)
+	}
+	return firstErr
+}
+
+// ReleaseAll stops supervising every process but leaves them running,
+// for the next agent run to adopt
+func (r *ProcessRegistry) ReleaseAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, p := range r.procs {
+		p.PM.Release()
+		delete(r.procs, name)
+	}
+}
+
+// Current reports whether pm is the process registered under its name
+func (r *ProcessRegistry) Current(pm *ProcessManager) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.procs[pm.name]
+	return ok && p.PM == pm
+}
+
+// Get returns the named process
+func (r *ProcessRegistry) Get(name string) (ProcessSpec, *ProcessManager, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.procs[name]
+	if !ok {
+		return ProcessSpec{}, nil, false
+	}
+	return p.Spec, p.PM, true
+}
+
+// List returns all processes sorted by name
+func (r *ProcessRegistry) List() []registeredProcess {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]registeredProcess, 0, len(r.procs))
+	for _, p := range r.procs {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Spec.Name < list[j].Spec.Name })
+	return list
+}
+
+// Apply brings the configured processes in line with specs: processes no
+// longer listed are stopped, new ones are started, and a process is
+// restarted when its command, environment or directory changed or when
+// one of the changed files triggers it; processes configured for hot
+// reload get the reload signal instead in the latter case. Processes that
+// are not running are started; a process left running by a previous agent
+// run is adopted unless one of the changed files triggers it. The default
+// process is left alone. Returns
+// the processes that were (re)started or reloaded.
+func (r *ProcessRegistry) Apply(specs []ProcessSpec, changed map[string]bool) ([]*ProcessManager, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	wanted := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		wanted[spec.Name] = true
+	}
+	for name, p := range r.procs {
+		if name != defaultProcessName && !wanted[name] {
+			r.logger.With("process", name).Info("process removed from config, stopping")
+			p.PM.Stop()
+			delete(r.procs, name)
+		}
+	}
+
+	var started []*ProcessManager
+	var firstErr error
+	for _, spec := range specs {
+		logger := r.logger.With("process", spec.Name)
+		reason, adopt := "", false
+		if old, ok := r.procs[spec.Name]; !ok {
+			reason, adopt = "starting", !spec.triggeredBy(changed)
+		} else if !old.Spec.sameRuntime(spec) {
+			reason = "config changed, restarting"
+		} else if spec.triggeredBy(changed) {
+			if pm, ok := r.reloadLocked(spec); ok {
+				started = append(started, pm)
+				continue
+			}
+			reason = "files updated, restarting"
+		} else if !old.PM.IsRunning() {
+			reason = "not running, starting"
+		} else {
+			old.Spec = spec
+			continue
+		}
+		logger.Info("%s: %s", reason, spec.Command)
+		pm, err := r.startLocked(spec, adopt)
+		if err != nil {
+			logger.Error("failed to start: %v", err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("start %s: %w", spec.Name, err)
+			}
+			continue
+		}
+		started = append(started, pm)
+	}
+	return started, firstErr
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// outputRelayArg is the first argument of the agent re-executed as the
+// output relay of a managed process
+const outputRelayArg = "__ota-relay"
+
+// relayQueueLines bounds the lines read from a process and not written
+// yet. Lines arriving while the queue is full are dropped, so that a slow
+// log file or agent output never makes the process wait.
+const relayQueueLines = 4096
+
+// processLogTime is the timestamp format of captured output lines
+const processLogTime = "2006-01-02T15:04:05.000Z07:00"
+
+// relaySpec tells an output relay where to write the output of a process
+type relaySpec struct {
+	Path        string        `json:"path"`                   // lines are appended here with a timestamp and their stream
+	MaxSize     int64         `json:"max_size,omitempty"`     // rotate the file once it exceeds this many bytes (0 disables)
+	MaxBackups  int           `json:"max_backups"`            // rotated files kept
+	RotateEvery time.Duration `json:"rotate_every,omitempty"` // also rotate the file after this long (0 disables)
+	Passthrough bool          `json:"passthrough,omitempty"`  // also copy the lines to the relay's stdout and stderr
+}
+
+// relayLine is a line of output waiting to be written
+type relayLine struct {
+	time   time.Time
+	stream int // index in outputStreams
+	text   string
+}
+
+// outputStreams names the streams of a process, in the order of the pipes
+// handed to relayOutput
+var outputStreams = []string{"stdout", "stderr"}
+
+// relayOutput reads lines from the stdout and stderr pipes of a process
+// until both are closed. Each line is written to w with a timestamp and
+// its stream, and copied unchanged to pass if it is set.
+func relayOutput(pipes []io.Reader, w io.Writer, pass []io.Writer) {
+	lines := make(chan relayLine, relayQueueLines)
+	var dropped atomic.Int64
+	var wg sync.WaitGroup
+	for i, r := range pipes {
+		wg.Add(1)
+		go func(stream int, r io.Reader) {
+			defer wg.Done()
+			readLines(r, func(text string) {
+				select {
+				case lines <- relayLine{time: time.Now(), stream: stream, text: text}:
+				default:
+					dropped.Add(1)
+				}
+			})
+		}(i, r)
+	}
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+	reportDropped := func() {
+		if n := dropped.Swap(0); n > 0 {
+			fmt.Fprintf(w, "%s [relay] %d lines dropped\n", time.Now().Format(processLogTime), n)
+		}
+	}
+	for l := range lines {
+		reportDropped()
+		fmt.Fprintf(w, "%s [%s] %s\n", l.time.Format(processLogTime), outputStreams[l.stream], l.text)
+		if pass != nil {
+			// A closed agent output must not stop the log file
+			io.WriteString(pass[l.stream], l.text+"\n")
+		}
+	}
+	reportDropped()
+}
+
+// readLines calls line for each line read from r until it fails. Lines
+// longer than maxOutputLine are split.
+func readLines(r io.Reader, line func(string)) {
+	br := bufio.NewReaderSize(r, maxOutputLine)
+	for {
+		b, err := br.ReadSlice('\n')
+		if len(b) > 0 {
+			line(strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r"))
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
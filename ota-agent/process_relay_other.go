@@ -0,0 +1,23 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// relaySupported reports whether process output goes through a relay
+// process on this platform
+const relaySupported = false
+
+// startOutputRelay is not supported on this platform
+func startOutputRelay(spec relaySpec, pipes []*os.File) (pid int, done <-chan struct{}, err error) {
+	return 0, nil, fmt.Errorf("output relay is not supported on this platform")
+}
+
+// runOutputRelay is not supported on this platform
+func runOutputRelay(args []string) {
+	fmt.Fprintln(os.Stderr, "ota-agent: output relay is not supported on this platform")
+	os.Exit(126)
+}
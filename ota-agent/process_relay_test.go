@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelayOutput(t *testing.T) {
+	long := strings.Repeat("x", maxOutputLine+10)
+	tests := []struct {
+		name   string
+		stdout string
+		stderr string
+		want   []string // lines without their timestamp
+		pass   [2]string
+	}{
+		{name: "empty"},
+		{
+			name:   "streams",
+			stdout: "one\ntwo\n",
+			stderr: "oops\n",
+			want:   []string{"[stdout] one", "[stdout] two", "[stderr] oops"},
+			pass:   [2]string{"one\ntwo\n", "oops\n"},
+		},
+		{
+			name:   "crlf and trailing line",
+			stdout: "dos\r\nlast",
+			want:   []string{"[stdout] dos", "[stdout] last"},
+			pass:   [2]string{"dos\nlast\n", ""},
+		},
+		{
+			name:   "long line is split",
+			stdout: long + "\n",
+			want:   []string{"[stdout] " + long[:maxOutputLine], "[stdout] " + long[maxOutputLine:]},
+			pass:   [2]string{long[:maxOutputLine] + "\n" + long[maxOutputLine:] + "\n", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w, stdout, stderr bytes.Buffer
+			relayOutput([]io.Reader{strings.NewReader(tt.stdout), strings.NewReader(tt.stderr)}, &w, []io.Writer{&stdout, &stderr})
+			var got []string
+			for _, line := range strings.Split(strings.TrimSuffix(w.String(), "\n"), "\n") {
+				if line == "" {
+					continue
+				}
+				ts, rest, _ := strings.Cut(line, " ")
+				if _, err := time.Parse(processLogTime, ts); err != nil {
+					t.Errorf("line %q has no timestamp: %v", line, err)
+				}
+				got = append(got, rest)
+			}
+			// The streams are read concurrently; only their own order is kept
+			if !reflect.DeepEqual(filterStream(got, "[stdout]"), filterStream(tt.want, "[stdout]")) ||
+				!reflect.DeepEqual(filterStream(got, "[stderr]"), filterStream(tt.want, "[stderr]")) {
+				t.Errorf("lines = %q, want %q", got, tt.want)
+			}
+			if stdout.String() != tt.pass[0] || stderr.String() != tt.pass[1] {
+				t.Errorf("passed through %q, %q, want %q, %q", stdout.String(), stderr.String(), tt.pass[0], tt.pass[1])
+			}
+		})
+	}
+}
+
+func filterStream(lines []string, stream string) []string {
+	var out []string
+	for _, l := range lines {
+		if strings.HasPrefix(l, stream) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+func TestTailFileAcrossRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.out")
+	rf, err := openRotatingFile(path, 64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintf(rf, "line %d\n", i)
+	}
+	rf.Close()
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Fatalf("file was not rotated: %v", err)
+	}
+	tests := []struct {
+		n    int
+		want []string
+	}{
+		{n: 1, want: []string{"line 10"}},
+		{n: 3, want: []string{"line 8", "line 9", "line 10"}},
+	}
+	for _, tt := range tests {
+		if got := tailFile(path, tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tailFile(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+	// Lines before the last rotation come from the backup
+	got := tailFile(path, 8)
+	if len(got) != 8 || got[7] != "line 10" {
+		t.Errorf("tailFile(8) = %q, want 8 lines ending with line 10", got)
+	}
+	if got := tailFile(filepath.Join(t.TempDir(), "missing"), 5); got != nil {
+		t.Errorf("tailFile of a missing file = %q, want nil", got)
+	}
+}
@@ -0,0 +1,75 @@
+//go:build unix
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// relaySupported reports whether process output goes through a relay
+// process on this platform
+const relaySupported = true
+
+// startOutputRelay starts the agent as the output relay of a process
+// writing to pipes, its stdout and stderr. The relay outlives the agent,
+// so a process adopted by the next agent run keeps a reader. The returned
+// channel is closed once the relay has exited.
+func startOutputRelay(spec relaySpec, pipes []*os.File) (pid int, done <-chan struct{}, err error) {
+	exe, err := getExecutablePath()
+	if err != nil {
+		return 0, nil, err
+	}
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return 0, nil, err
+	}
+	cmd := exec.Command(exe, outputRelayArg, string(b))
+	cmd.ExtraFiles = pipes
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return 0, nil, err
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	return cmd.Process.Pid, exited, nil
+}
+
+// runOutputRelay is the main function of the output relay. It reads the
+// output of the process from fds 3 and 4 until the process and its
+// children have closed them.
+func runOutputRelay(args []string) {
+	// The relay lives as long as the process output; it is not stopped
+	// with the agent, and a closed agent output is not fatal
+	signal.Ignore(syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGPIPE)
+	var spec relaySpec
+	err := fmt.Errorf("usage: %s <spec>", outputRelayArg)
+	if len(args) == 1 {
+		err = json.Unmarshal([]byte(args[0]), &spec)
+	}
+	var rf *rotatingFile
+	if err == nil {
+		rf, err = openRotatingFile(spec.Path, spec.MaxSize, spec.MaxBackups)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ota-agent: output relay: %v\n", err)
+		os.Exit(1)
+	}
+	rf.rotateEvery = spec.RotateEvery
+	pipes := []io.Reader{os.NewFile(3, "stdout"), os.NewFile(4, "stderr")}
+	var pass []io.Writer
+	if spec.Passthrough {
+		pass = []io.Writer{os.Stdout, os.Stderr}
+	}
+	relayOutput(pipes, rf, pass)
+	rf.Close()
+	os.Exit(0)
+}
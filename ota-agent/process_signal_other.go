@@ -0,0 +1,32 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup is a no-op on this platform
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcess sends sig to p; process groups are not supported on this
+// platform, where only SIGKILL is delivered reliably
+func signalProcess(p *os.Process, sig syscall.Signal, group bool) error {
+	return p.Signal(sig)
+}
+
+// groupAlive always reports false on this platform
+func groupAlive(p *os.Process) bool {
+	return false
+}
+
+// signals are the signal names accepted in the config
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
@@ -0,0 +1,42 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd the leader of a new process group
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalProcess sends sig to p, or to the process group p leads
+func signalProcess(p *os.Process, sig syscall.Signal, group bool) error {
+	if group {
+		return syscall.Kill(-p.Pid, sig)
+	}
+	return p.Signal(sig)
+}
+
+// groupAlive reports whether any process is left in the group led by p
+func groupAlive(p *os.Process) bool {
+	return syscall.Kill(-p.Pid, 0) == nil
+}
+
+// signals are the signal names accepted in the config
+var signals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"WINCH": syscall.SIGWINCH,
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errNoProcInfo = errors.New("process identity is not available on this platform")
+
+// processStartTime is not available on this platform, so processes are
+// never adopted
+func processStartTime(pid int) (uint64, bool, error) {
+	return 0, false, errNoProcInfo
+}
+
+// processExe is not available on this platform
+func processExe(pid int) (string, error) {
+	return "", errNoProcInfo
+}
+
+// bootID is not available on this platform
+func bootID() string {
+	return ""
+}
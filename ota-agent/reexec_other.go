@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+// reexec is not supported on this platform
+func reexec(exe string) error {
+	return fmt.Errorf("re-executing the agent is not supported on this platform")
+}
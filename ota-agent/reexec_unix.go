@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// reexec replaces the running agent with exe, run with the same arguments.
+// The agent keeps its pid, so the supervised processes stay its children
+// and are adopted by the new agent; their output relays keep running. It
+// only returns on error.
+func reexec(exe string) error {
+	if err := syscall.Exec(exe, os.Args, os.Environ()); err != nil {
+		return fmt.Errorf("exec %s: %w", exe, err)
+	}
+	return nil
+}
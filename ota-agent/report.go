@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Check outcomes reported to the server
+const (
+	OutcomeUpToDate     = "up_to_date"    // remote version already installed
+	OutcomeSkipped      = "skipped"       // remote version refused (e.g. previously rolled back)
+	OutcomeDeferred     = "deferred"      // remote version not installed yet (e.g. outside the rollout)
+	OutcomeUpdated      = "updated"       // new version installed
+	OutcomeFailed       = "failed"        // check or install failed, install unchanged
+	OutcomeRolledBack   = "rolled_back"   // installed, then rolled back after a failed health check
+	OutcomeAgentUpdated = "agent_updated" // agent binary replaced, the release is left to the new agent
+)
+
+// FileReport describes what happened to one file during an update
+type FileReport struct {
+	Name       string `json:"name"`
+	Target     string `json:"target"`
+	Outcome    string `json:"outcome"`          // updated, unchanged, failed, not_attempted, reverted
+	Method     string `json:"method,omitempty"` // full, delta, reused or prefetched
+	Size       int64  `json:"size,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// AgentReport describes an update of the agent binary
+type AgentReport struct {
+	Version        string `json:"version,omitempty"`
+	SHA256         string `json:"sha256"`
+	PreviousSHA256 string `json:"previous_sha256,omitempty"`
+	Outcome        string `json:"outcome"` // installed, failed or rolled_back
+	Error          string `json:"error,omitempty"`
+}
+
+// RestartReport describes the process restart that followed an update
+type RestartReport struct {
+	Command     string   `json:"command"`
+	Processes   []string `json:"processes,omitempty"` // supervised processes (re)started
+	Commands    []string `json:"commands,omitempty"`  // per-file restart commands run
+	Started     bool     `json:"started"`
+	HealthCheck string   `json:"health_check,omitempty"` // passed, failed or empty when no gate ran
+	RolledBack  bool     `json:"rolled_back"`
+	Error       string   `json:"error,omitempty"`
+	Output      []string `json:"output,omitempty"` // last process output lines when the health gate failed
+}
+
+// UpdateReport is POSTed to the report endpoint after every update check
+type UpdateReport struct {
+	AgentID         string         `json:"agent_id"`
+	Hostname        string         `json:"hostname,omitempty"`
+	Labels          Labels         `json:"labels,omitempty"`
+	Timestamp       time.Time      `json:"timestamp"`
+	Outcome         string         `json:"outcome"`
+	PreviousVersion string         `json:"previous_version"`
+	TargetVersion   string         `json:"target_version,omitempty"`
+	Channel         string         `json:"channel,omitempty"` // release channel, when the config URL serves a manifest index
+	CurrentVersion  string         `json:"current_version"`
+	Files           []FileReport   `json:"files,omitempty"`
+	Restart         *RestartReport `json:"restart,omitempty"`
+	Agent           *AgentReport   `json:"agent,omitempty"`
+	Errors          []string       `json:"errors,omitempty"`
+	Warnings        []string       `json:"warnings,omitempty"` // problems that did not fail the update
+	DurationMs      int64          `json:"duration_ms"`
+}
+
+// newUpdateReport builds the report for a finished check
+func newUpdateReport(agentID string, result UpdateResult, restart *RestartReport, started time.Time, versionFile string) UpdateReport {
+	hostname, _ := os.Hostname()
+	current, _ := readLocalVersion(versionFile)
+	report := UpdateReport{
+		AgentID:         agentID,
+		Hostname:        hostname,
+		Timestamp:       time.Now().UTC(),
+		Outcome:         result.Outcome,
+		PreviousVersion: result.PreviousVersion,
+		TargetVersion:   result.RemoteVersion,
+		Channel:         result.Channel,
+		CurrentVersion:  current,
+		Files:           result.Files,
+		Restart:         restart,
+		Agent:           result.Agent,
+		DurationMs:      time.Since(started).Milliseconds(),
+	}
+	if result.Error != nil {
+		report.Errors = append(report.Errors, result.Error.Error())
+	}
+	report.Warnings = result.Warnings
+	if restart != nil && restart.Error != "" {
+		report.Errors = append(report.Errors, restart.Error)
+	}
+	return report
+}
+
+// maxSpooledReports bounds the spool; the oldest reports are dropped first
+const maxSpooledReports = 500
+
+// maxRejectedReports bounds the reports kept after the server rejected them
+const maxRejectedReports = 50
+
+// rejectedDir is the spool subdirectory of reports the server rejected
+const rejectedDir = "rejected"
+
+// Reporter delivers update reports to the server. Every report is written
+// to a local spool directory first and removed only after the server has
+// accepted it, so reports survive network outages and agent restarts.
+// Delivery runs in the background so that a slow or unreachable server
+// never holds up the agent.
+type Reporter struct {
+	url      string
+	spoolDir string
+	agentID  string
+	client   *http.Client
+	logger   *Logger
+	mu       sync.Mutex
+	seq      int
+	flushMu  sync.Mutex    // serializes deliveries
+	kick     chan struct{} // wakes the delivery goroutine
+	done     chan struct{} // closed by Close
+	stopped  chan struct{} // closed when the delivery goroutine has exited
+}
+
+// NewReporter creates a reporter posting to url and spooling to spoolDir.
+// Reports left in the spool by a previous agent run are delivered right
+// away.
+func NewReporter(url, spoolDir, agentID string, timeout time.Duration, logger *Logger) (*Reporter, error) {
+	if err := os.MkdirAll(spoolDir, 0755); err != nil {
+		return nil, fmt.Errorf("create report spool: %w", err)
+	}
+	r := &Reporter{
+		url:      url,
+		spoolDir: spoolDir,
+		agentID:  agentID,
+		client:   &http.Client{Timeout: timeout},
+		logger:   logger,
+		kick:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go r.run()
+	r.wake()
+	return r, nil
+}
+
+// run delivers the spool whenever a report is submitted, until Close
+func (r *Reporter) run() {
+	defer close(r.stopped)
+	for {
+		select {
+		case <-r.kick:
+			r.Flush()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// wake asks the delivery goroutine to flush the spool
+func (r *Reporter) wake() {
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the background delivery and makes a last attempt to deliver
+// what is spooled; reports that are not delivered stay in the spool
+func (r *Reporter) Close() {
+	close(r.done)
+	<-r.stopped
+	r.Flush()
+}
+
+// Submit spools a report and wakes the delivery of everything pending
+func (r *Reporter) Submit(report UpdateReport) {
+	r.mu.Lock()
+	r.seq++
+	name := fmt.Sprintf("%020d-%04d.json", time.Now().UnixNano(), r.seq%10000)
+	r.mu.Unlock()
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		r.logger.Error("encode report: %v", err)
+		return
+	}
+	tmp := filepath.Join(r.spoolDir, "."+name)
+	if err := os.WriteFile(tmp, b, 0644); err == nil {
+		err = os.Rename(tmp, filepath.Join(r.spoolDir, name))
+	}
+	if err != nil {
+		r.logger.Error("spool report: %v", err)
+	}
+	r.wake()
+}
+
+// pending returns spooled report files, oldest first
+func (r *Reporter) pending() []string {
+	return spooledReports(r.spoolDir)
+}
+
+// spooledReports returns the report files in dir, oldest first
+func spooledReports(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Flush delivers spooled reports in order, stopping at the first failure
+// that may go away on a retry. A report the server rejects for good is
+// logged and moved to the rejected directory of the spool.
+func (r *Reporter) Flush() {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	names := r.pending()
+	if drop := len(names) - maxSpooledReports; drop > 0 {
+		r.logger.Warn("report spool full, dropping %d oldest report(s)", drop)
+		for _, name := range names[:drop] {
+			_ = os.Remove(filepath.Join(r.spoolDir, name))
+		}
+		names = names[drop:]
+	}
+
+	sent := 0
+	for i, name := range names {
+		path := filepath.Join(r.spoolDir, name)
+		body, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		err = r.post(body)
+		var rejected *reportRejectedError
+		if errors.As(err, &rejected) {
+			r.logger.Error("server rejected report %s, moving it to %s: %v: %s", name, rejectedDir, err, body)
+			r.quarantine(name)
+			continue
+		}
+		if err != nil {
+			r.logger.Warn("report delivery failed, %d report(s) spooled: %v", len(names)-i, err)
+			return
+		}
+		_ = os.Remove(path)
+		sent++
+	}
+	if sent > 1 {
+		r.logger.Info("delivered %d spooled report(s)", sent)
+	}
+}
+
+// quarantine moves a rejected report out of the spool, keeping the most
+// recent maxRejectedReports
+func (r *Reporter) quarantine(name string) {
+	dir := filepath.Join(r.spoolDir, rejectedDir)
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = os.Rename(filepath.Join(r.spoolDir, name), filepath.Join(dir, name))
+	}
+	if err != nil {
+		r.logger.Warn("quarantine report %s: %v", name, err)
+		_ = os.Remove(filepath.Join(r.spoolDir, name))
+		return
+	}
+	kept := spooledReports(dir)
+	for len(kept) > maxRejectedReports {
+		_ = os.Remove(filepath.Join(dir, kept[0]))
+		kept = kept[1:]
+	}
+}
+
+// reportRejectedError is a response that retrying the report cannot change
+type reportRejectedError struct {
+	status int
+}
+
+func (e *reportRejectedError) Error() string {
+	return fmt.Sprintf("bad status %d", e.status)
+}
+
+// permanentStatus reports whether a response status rejects the report for
+// good: a 4xx other than 408 Request Timeout and 429 Too Many Requests
+func permanentStatus(code int) bool {
+	return code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+}
+
+func (r *Reporter) post(body []byte) error {
+	req, err := http.NewRequest("POST", r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.agentID != "" {
+		req.Header.Set("X-Agent-ID", r.agentID)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if permanentStatus(resp.StatusCode) {
+		return &reportRejectedError{status: resp.StatusCode}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bad status %d", resp.StatusCode)
+	}
+	return nil
+}
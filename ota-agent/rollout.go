@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Rollout limits which agents install the version of a config. Every agent
+// hashes its id with the seed into a bucket between 0 and 100; it installs
+// the version once the percentage exceeds its bucket. Raising the
+// percentage keeps the agents already in the cohort and adds new ones.
+type Rollout struct {
+	Percent float64 `yaml:"percent"` // share of agents that install the version, 0-100
+	Seed    string  `yaml:"seed"`    // optional: cohort seed (default: the version, a new cohort per release)
+	Halt    bool    `yaml:"halt"`    // stop further adoption; agents already on the version keep it
+}
+
+// validate checks the rollout of a config
+func (r *Rollout) validate() error {
+	if math.IsNaN(r.Percent) || r.Percent < 0 || r.Percent > 100 {
+		return fmt.Errorf("rollout.percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// rolloutBucket places agentID in [0, 100) for seed, in steps of 0.01
+func rolloutBucket(seed, agentID string) float64 {
+	sum := sha256.Sum256([]byte(seed + "/" + agentID))
+	return float64(binary.BigEndian.Uint64(sum[:8])%10000) / 100
+}
+
+// excludes returns why the agent must not install version yet, or "" if it
+// may
+func (r *Rollout) excludes(version, agentID string) string {
+	if r.Halt {
+		return fmt.Sprintf("rollout of %s is halted", version)
+	}
+	seed := r.Seed
+	if seed == "" {
+		seed = version
+	}
+	if bucket := rolloutBucket(seed, agentID); bucket >= r.Percent {
+		return fmt.Sprintf("not in the %g%% rollout of %s (bucket %.2f)", r.Percent, version, bucket)
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestRolloutBucket(t *testing.T) {
+	// Buckets must never change between agent releases, or raising the
+	// percentage would reshuffle the cohort
+	tests := []struct {
+		seed, agentID string
+		want          float64
+	}{
+		{"1.3.0", "agent-1", 6.80},
+		{"1.3.0", "agent-2", 18.48},
+		{"1.3.0", "host-a", 18.81},
+		{"fleet-canary", "agent-1", 53.97},
+		{"", "", 61.15},
+	}
+	for _, tt := range tests {
+		if got := rolloutBucket(tt.seed, tt.agentID); got != tt.want {
+			t.Errorf("rolloutBucket(%q, %q) = %.2f, want %.2f", tt.seed, tt.agentID, got, tt.want)
+		}
+	}
+}
+
+func TestRolloutBucketRange(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		b := rolloutBucket("1.3.0", fmt.Sprintf("agent-%d", i))
+		if b < 0 || b >= 100 {
+			t.Fatalf("bucket of agent-%d = %v, want [0, 100)", i, b)
+		}
+		if math.Abs(math.Round(b*100)-b*100) > 1e-9 {
+			t.Fatalf("bucket of agent-%d = %v, want a step of 0.01", i, b)
+		}
+	}
+}
+
+func TestRolloutValidate(t *testing.T) {
+	tests := []struct {
+		percent float64
+		wantErr bool
+	}{
+		{0, false},
+		{0.5, false},
+		{100, false},
+		{-1, true},
+		{100.01, true},
+		{math.NaN(), true},
+	}
+	for _, tt := range tests {
+		err := (&Rollout{Percent: tt.percent}).validate()
+		if tt.wantErr != (err != nil) {
+			t.Errorf("validate(percent %v) error = %v, want error %v", tt.percent, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRolloutExcludes(t *testing.T) {
+	// agent-1 is in bucket 6.80 of 1.3.0 and 53.97 of fleet-canary
+	tests := []struct {
+		name    string
+		rollout Rollout
+		agentID string
+		want    string // substring of the reason, "" if included
+	}{
+		{"everyone", Rollout{Percent: 100}, "agent-1", ""},
+		{"no one", Rollout{Percent: 0}, "agent-1", "not in the 0% rollout of 1.3.0"},
+		{"inside the cohort", Rollout{Percent: 6.81}, "agent-1", ""},
+		{"bucket equal to percent", Rollout{Percent: 6.80}, "agent-1", "bucket 6.80"},
+		{"default seed is the version", Rollout{Percent: 10}, "agent-1", ""},
+		{"explicit seed", Rollout{Percent: 10, Seed: "fleet-canary"}, "agent-1", "bucket 53.97"},
+		{"explicit seed inside", Rollout{Percent: 54, Seed: "fleet-canary"}, "agent-1", ""},
+		{"halted", Rollout{Percent: 100, Halt: true}, "agent-1", "rollout of 1.3.0 is halted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rollout.excludes("1.3.0", tt.agentID)
+			if tt.want == "" {
+				if got != "" {
+					t.Errorf("excludes = %q, want the agent included", got)
+				}
+				return
+			}
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("excludes = %q, want it to contain %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRolloutRaisingKeepsCohort(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("agent-%d", i)
+		included := false
+		for _, percent := range []float64{1, 5, 10, 25, 50, 100} {
+			in := (&Rollout{Percent: percent}).excludes("2.0.0", id) == ""
+			if included && !in {
+				t.Fatalf("%s left the cohort when the rollout was raised to %v%%", id, percent)
+			}
+			included = in
+		}
+		if !included {
+			t.Fatalf("%s is not included at 100%%", id)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errOutsideWindow defers an install whose files are staged and verified
+// until the update window opens
+var errOutsideWindow = errors.New("outside the update window")
+
+// maxWindowDuration bounds how long an update window stays open
+const maxWindowDuration = 7 * 24 * time.Hour
+
+// Schedule restricts when updates are installed. Outside its windows and
+// on blackout dates files are still downloaded and verified, but nothing
+// is replaced and no process is restarted.
+type Schedule struct {
+	Windows  []string `yaml:"windows"`  // "<minute> <hour> <day of month> <month> <day of week> <duration>", e.g. "0 2 * * 1-5 3h"; empty: always open
+	TimeZone string   `yaml:"timezone"` // IANA time zone of windows and blackout dates (default: local time)
+	Blackout []string `yaml:"blackout"` // dates without updates: "2026-12-24" or inclusive ranges "2026-12-20..2027-01-02"
+}
+
+// updateWindow is a parsed window: it opens at every minute matching the
+// cron fields and stays open for duration
+type updateWindow struct {
+	minute, hour, dom, month, dow uint64 // bit sets of allowed values
+	domAny, dowAny                bool
+	duration                      time.Duration
+}
+
+// schedulePolicy is a compiled Schedule
+type schedulePolicy struct {
+	windows  []updateWindow
+	loc      *time.Location
+	blackout [][2]string // inclusive YYYY-MM-DD ranges
+}
+
+var (
+	monthNames = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+	dayNames   = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+)
+
+// compile parses the schedule; a nil schedule yields a nil policy, which
+// is always open
+func (s *Schedule) compile() (*schedulePolicy, error) {
+	if s == nil {
+		return nil, nil
+	}
+	p := &schedulePolicy{loc: time.Local}
+	if s.TimeZone != "" {
+		loc, err := time.LoadLocation(s.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("timezone: %w", err)
+		}
+		p.loc = loc
+	}
+	for i, spec := range s.Windows {
+		w, err := parseWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("windows[%d]: %w", i, err)
+		}
+		p.windows = append(p.windows, w)
+	}
+	for i, spec := range s.Blackout {
+		from, to, ok := strings.Cut(spec, "..")
+		if !ok {
+			to = from
+		}
+		for _, d := range []string{from, to} {
+			if _, err := time.Parse(time.DateOnly, d); err != nil {
+				return nil, fmt.Errorf("blackout[%d]: %q is not a YYYY-MM-DD date", i, d)
+			}
+		}
+		if to < from {
+			return nil, fmt.Errorf("blackout[%d]: %s ends before it starts", i, spec)
+		}
+		p.blackout = append(p.blackout, [2]string{from, to})
+	}
+	return p, nil
+}
+
+// parseWindow parses "<5 cron fields> <duration>"
+func parseWindow(spec string) (updateWindow, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 6 {
+		return updateWindow{}, fmt.Errorf("%q: want 5 cron fields and a duration", spec)
+	}
+	var w updateWindow
+	var err error
+	if w.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return updateWindow{}, fmt.Errorf("%q: minute: %w", spec, err)
+	}
+	if w.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return updateWindow{}, fmt.Errorf("%q: hour: %w", spec, err)
+	}
+	if w.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return updateWindow{}, fmt.Errorf("%q: day of month: %w", spec, err)
+	}
+	if w.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return updateWindow{}, fmt.Errorf("%q: month: %w", spec, err)
+	}
+	if w.dow, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+		return updateWindow{}, fmt.Errorf("%q: day of week: %w", spec, err)
+	}
+	// 7 is Sunday as well
+	if w.dow&(1<<7) != 0 {
+		w.dow |= 1
+	}
+	w.domAny, w.dowAny = fields[2] == "*", fields[4] == "*"
+	if w.duration, err = time.ParseDuration(fields[5]); err != nil {
+		return updateWindow{}, fmt.Errorf("%q: duration: %w", spec, err)
+	}
+	if w.duration < time.Minute || w.duration > maxWindowDuration {
+		return updateWindow{}, fmt.Errorf("%q: duration must be between 1m and %v", spec, maxWindowDuration)
+	}
+	return w, nil
+}
+
+// parseCronField parses a comma separated list of *, values, ranges and
+// steps into a bit set
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	value := func(s string) (int, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q is not between %d and %d", s, min, max)
+		}
+		return n, nil
+	}
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step %q", stepStr)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = value(from); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(to); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("range %q ends before it starts", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// dayMatches reports whether the window can open on the day of t
+func (w updateWindow) dayMatches(t time.Time) bool {
+	if w.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := w.dom&(1<<uint(t.Day())) != 0
+	dow := w.dow&(1<<uint(t.Weekday())) != 0
+	// As in cron, a restricted day of month or day of week suffices when
+	// both are restricted
+	switch {
+	case w.domAny && w.dowAny:
+		return true
+	case w.domAny:
+		return dow
+	case w.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// opensAt reports whether the window opens at the minute of t
+func (w updateWindow) opensAt(t time.Time) bool {
+	return w.minute&(1<<uint(t.Minute())) != 0 && w.hour&(1<<uint(t.Hour())) != 0 && w.dayMatches(t)
+}
+
+// contains reports whether the window is open at t
+func (w updateWindow) contains(t time.Time) bool {
+	start := t.Truncate(time.Minute)
+	for d := time.Duration(0); d < w.duration; d += time.Minute {
+		if w.opensAt(start.Add(-d).In(t.Location())) {
+			return true
+		}
+	}
+	return false
+}
+
+// blackedOut reports whether t falls on a blackout date
+func (p *schedulePolicy) blackedOut(t time.Time) bool {
+	day := t.In(p.loc).Format(time.DateOnly)
+	for _, b := range p.blackout {
+		if day >= b[0] && day <= b[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Open reports whether updates may be installed at t
+func (p *schedulePolicy) Open(t time.Time) bool {
+	if p == nil {
+		return true
+	}
+	if p.blackedOut(t) {
+		return false
+	}
+	if len(p.windows) == 0 {
+		return true
+	}
+	t = t.In(p.loc)
+	for _, w := range p.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns the first time from t on at which updates may be
+// installed, or false if there is none within a year
+func (p *schedulePolicy) NextOpen(t time.Time) (time.Time, bool) {
+	if p.Open(t) {
+		return t, true
+	}
+	t = t.In(p.loc)
+	end := t.AddDate(1, 0, 0)
+	for c := t.Truncate(time.Minute).Add(time.Minute); c.Before(end); {
+		c = c.In(p.loc)
+		if p.blackedOut(c) || !p.dayMayOpen(c) {
+			// A window may already be open when the next day starts
+			c = time.Date(c.Year(), c.Month(), c.Day()+1, 0, 0, 0, 0, p.loc)
+			if p.Open(c) {
+				return c, true
+			}
+			continue
+		}
+		for _, w := range p.windows {
+			if w.opensAt(c) {
+				return c, true
+			}
+		}
+		c = c.Add(time.Minute)
+	}
+	return time.Time{}, false
+}
+
+// dayMayOpen reports whether any window opens on the day of t
+func (p *schedulePolicy) dayMayOpen(t time.Time) bool {
+	for _, w := range p.windows {
+		if w.dayMatches(t) {
+			return true
+		}
+	}
+	return len(p.windows) == 0
+}
+
+// listFlag collects the values of a repeatable flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
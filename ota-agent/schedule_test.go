@@ -0,0 +1,270 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// bits returns the bit set of values
+func bits(values ...int) uint64 {
+	var set uint64
+	for _, v := range values {
+		set |= 1 << uint(v)
+	}
+	return set
+}
+
+// mustLocation loads an IANA time zone or fails the test
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("load time zone %s: %v", name, err)
+	}
+	return loc
+}
+
+// mustWindow parses a window spec or fails the test
+func mustWindow(t *testing.T, spec string) updateWindow {
+	t.Helper()
+	w, err := parseWindow(spec)
+	if err != nil {
+		t.Fatalf("parseWindow(%q): %v", spec, err)
+	}
+	return w
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		names    map[string]int
+		want     uint64
+		wantErr  bool
+	}{
+		{field: "*", min: 0, max: 5, want: bits(0, 1, 2, 3, 4, 5)},
+		{field: "3", min: 0, max: 59, want: bits(3)},
+		{field: "1,5,9", min: 0, max: 59, want: bits(1, 5, 9)},
+		{field: "2-4", min: 0, max: 23, want: bits(2, 3, 4)},
+		{field: "*/15", min: 0, max: 59, want: bits(0, 15, 30, 45)},
+		{field: "10/20", min: 0, max: 59, want: bits(10, 30, 50)},
+		{field: "1-10/3", min: 0, max: 59, want: bits(1, 4, 7, 10)},
+		{field: "0-2,22-23", min: 0, max: 23, want: bits(0, 1, 2, 22, 23)},
+		{field: "*/2", min: 1, max: 12, want: bits(1, 3, 5, 7, 9, 11)},
+		{field: "mon-fri", min: 0, max: 7, names: dayNames, want: bits(1, 2, 3, 4, 5)},
+		{field: "SAT,sun", min: 0, max: 7, names: dayNames, want: bits(6, 0)},
+		{field: "Jan,jul-aug", min: 1, max: 12, names: monthNames, want: bits(1, 7, 8)},
+
+		{field: "60", min: 0, max: 59, wantErr: true},
+		{field: "0", min: 1, max: 31, wantErr: true},
+		{field: "-1", min: 0, max: 59, wantErr: true},
+		{field: "5-1", min: 0, max: 59, wantErr: true},
+		{field: "*/0", min: 0, max: 59, wantErr: true},
+		{field: "*/x", min: 0, max: 59, wantErr: true},
+		{field: "x", min: 0, max: 59, wantErr: true},
+		{field: "", min: 0, max: 59, wantErr: true},
+		{field: "1,", min: 0, max: 59, wantErr: true},
+		{field: "mon", min: 1, max: 12, names: monthNames, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCronField(tt.field, tt.min, tt.max, tt.names)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseCronField(%q, %d, %d) = %b, want an error", tt.field, tt.min, tt.max, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCronField(%q, %d, %d): %v", tt.field, tt.min, tt.max, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseCronField(%q, %d, %d) = %b, want %b", tt.field, tt.min, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{spec: "0 2 * * 1-5 3h"},
+		{spec: "*/30 * * * * 1m"},
+		{spec: "0 0 1 jan * 168h"},
+		{spec: "0 2 * * 7 1h"},
+		{spec: "0 2 * * 1-5", wantErr: true},
+		{spec: "0 2 * * 1-5 3h extra", wantErr: true},
+		{spec: "0 24 * * * 1h", wantErr: true},
+		{spec: "0 2 32 * * 1h", wantErr: true},
+		{spec: "0 2 * 13 * 1h", wantErr: true},
+		{spec: "0 2 * * 8 1h", wantErr: true},
+		{spec: "0 2 * * * soon", wantErr: true},
+		{spec: "0 2 * * * 30s", wantErr: true},
+		{spec: "0 2 * * * 169h", wantErr: true},
+	}
+	for _, tt := range tests {
+		_, err := parseWindow(tt.spec)
+		if tt.wantErr != (err != nil) {
+			t.Errorf("parseWindow(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	utc := time.UTC
+	newYork := mustLocation(t, "America/New_York")
+	at := func(loc *time.Location, year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, loc)
+	}
+	tests := []struct {
+		name   string
+		window string
+		t      time.Time
+		want   bool
+	}{
+		{"before the window", "0 2 * * * 3h", at(utc, 2026, 10, 16, 1, 59), false},
+		{"window opens", "0 2 * * * 3h", at(utc, 2026, 10, 16, 2, 0), true},
+		{"inside the window", "0 2 * * * 3h", at(utc, 2026, 10, 16, 4, 59), true},
+		{"window closed", "0 2 * * * 3h", at(utc, 2026, 10, 16, 5, 0), false},
+		{"seconds are ignored", "0 2 * * * 3h", at(utc, 2026, 10, 16, 4, 59).Add(59 * time.Second), true},
+
+		// 2026-10-16 is a Friday, 2026-10-18 a Sunday and 2026-10-19 a Monday
+		{"weekday window on a weekday", "0 2 * * 1-5 3h", at(utc, 2026, 10, 16, 3, 0), true},
+		{"weekday window on a weekend", "0 2 * * 1-5 3h", at(utc, 2026, 10, 18, 3, 0), false},
+		{"sunday as 7", "0 2 * * 7 1h", at(utc, 2026, 10, 18, 2, 30), true},
+		{"sunday as 0", "0 2 * * 0 1h", at(utc, 2026, 10, 18, 2, 30), true},
+		{"month restricted", "0 2 * nov * 1h", at(utc, 2026, 10, 16, 2, 30), false},
+
+		// A restricted day of month or day of week suffices when both are
+		// restricted: the 13th or any Friday
+		{"dom/dow: friday 13th", "0 0 13 * 5 24h", at(utc, 2026, 11, 13, 12, 0), true},
+		{"dom/dow: friday", "0 0 13 * 5 24h", at(utc, 2026, 11, 6, 12, 0), true},
+		{"dom/dow: tuesday 13th", "0 0 13 * 5 24h", at(utc, 2026, 10, 13, 12, 0), true},
+		{"dom/dow: neither", "0 0 13 * 5 24h", at(utc, 2026, 11, 12, 12, 0), false},
+		{"dom only", "0 0 13 * * 24h", at(utc, 2026, 11, 6, 12, 0), false},
+		{"dow only", "0 0 * * 5 24h", at(utc, 2026, 11, 13, 12, 0), true},
+
+		// A window keeps running into the next day
+		{"past midnight", "30 23 * * * 2h", at(utc, 2026, 10, 17, 0, 59), true},
+		{"past midnight, closed", "30 23 * * * 2h", at(utc, 2026, 10, 17, 1, 30), false},
+		{"past midnight into a day it does not open on", "0 22 * * 5 4h", at(utc, 2026, 10, 17, 1, 0), true},
+		{"past midnight from a day it does not open on", "0 22 * * 5 4h", at(utc, 2026, 10, 16, 1, 0), false},
+
+		// The duration is elapsed time: on 2026-03-08 New York clocks go
+		// from 02:00 EST to 03:00 EDT, so a 3h window opening at 01:00
+		// closes at 05:00 local time
+		{"spring forward, open", "0 1 * * * 3h", at(newYork, 2026, 3, 8, 4, 30), true},
+		{"spring forward, closed", "0 1 * * * 3h", at(newYork, 2026, 3, 8, 5, 0), false},
+		{"spring forward, skipped opening", "30 2 * * * 1h", at(newYork, 2026, 3, 8, 3, 15), false},
+		// On 2026-11-01 clocks go from 02:00 EDT back to 01:00 EST, so a
+		// 2h window opening at 00:30 EDT closes at 01:30 EST (06:30 UTC)
+		{"fall back, open", "30 0 * * * 2h", at(utc, 2026, 11, 1, 6, 15).In(newYork), true},
+		{"fall back, closed", "30 0 * * * 2h", at(utc, 2026, 11, 1, 6, 30).In(newYork), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := mustWindow(t, tt.window)
+			if got := w.contains(tt.t); got != tt.want {
+				t.Errorf("%q contains %v = %v, want %v", tt.window, tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleOpen(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule *Schedule
+		t        time.Time
+		want     bool
+	}{
+		{"nil schedule", nil, time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC), true},
+		{"no windows", &Schedule{TimeZone: "UTC"}, time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC), true},
+		{"blackout day", &Schedule{TimeZone: "UTC", Blackout: []string{"2026-10-16"}}, time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC), false},
+		{"day after a blackout day", &Schedule{TimeZone: "UTC", Blackout: []string{"2026-10-16"}}, time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC), true},
+		{"blackout range start", &Schedule{TimeZone: "UTC", Blackout: []string{"2026-12-20..2027-01-02"}}, time.Date(2026, 12, 20, 0, 0, 0, 0, time.UTC), false},
+		{"blackout range end", &Schedule{TimeZone: "UTC", Blackout: []string{"2026-12-20..2027-01-02"}}, time.Date(2027, 1, 2, 23, 59, 0, 0, time.UTC), false},
+		{"after a blackout range", &Schedule{TimeZone: "UTC", Blackout: []string{"2026-12-20..2027-01-02"}}, time.Date(2027, 1, 3, 0, 0, 0, 0, time.UTC), true},
+		{"before a blackout range", &Schedule{TimeZone: "UTC", Blackout: []string{"2026-12-20..2027-01-02"}}, time.Date(2026, 12, 19, 23, 59, 0, 0, time.UTC), true},
+		{"blackout in the schedule time zone", &Schedule{TimeZone: "Asia/Shanghai", Blackout: []string{"2026-10-17"}}, time.Date(2026, 10, 16, 17, 0, 0, 0, time.UTC), false},
+		{"blackout beats an open window", &Schedule{TimeZone: "UTC", Windows: []string{"0 0 * * * 24h"}, Blackout: []string{"2026-10-16"}}, time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC), false},
+		{"window in the schedule time zone", &Schedule{TimeZone: "Asia/Shanghai", Windows: []string{"0 2 * * * 1h"}}, time.Date(2026, 10, 15, 18, 30, 0, 0, time.UTC), true},
+		{"any window", &Schedule{TimeZone: "UTC", Windows: []string{"0 2 * * * 1h", "0 14 * * * 1h"}}, time.Date(2026, 10, 16, 14, 30, 0, 0, time.UTC), true},
+		{"no window open", &Schedule{TimeZone: "UTC", Windows: []string{"0 2 * * * 1h", "0 14 * * * 1h"}}, time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := tt.schedule.compile()
+			if err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			if got := p.Open(tt.t); got != tt.want {
+				t.Errorf("Open(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleCompileErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule Schedule
+	}{
+		{"bad time zone", Schedule{TimeZone: "Mars/Olympus_Mons"}},
+		{"bad window", Schedule{Windows: []string{"0 2 * *"}}},
+		{"bad date", Schedule{Blackout: []string{"2026-13-01"}}},
+		{"bad range", Schedule{Blackout: []string{"2026-12-20..soon"}}},
+		{"range ends before it starts", Schedule{Blackout: []string{"2027-01-02..2026-12-20"}}},
+	}
+	for _, tt := range tests {
+		if _, err := tt.schedule.compile(); err == nil {
+			t.Errorf("%s: compile succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestNextOpen(t *testing.T) {
+	newYork := mustLocation(t, "America/New_York")
+	utc := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name     string
+		schedule Schedule
+		from     time.Time
+		want     time.Time // zero if no window opens within a year
+	}{
+		{"already open", Schedule{TimeZone: "UTC", Windows: []string{"0 2 * * * 3h"}}, utc(2026, 10, 16, 3, 0), utc(2026, 10, 16, 3, 0)},
+		{"later today", Schedule{TimeZone: "UTC", Windows: []string{"0 14 * * * 1h"}}, utc(2026, 10, 16, 10, 0), utc(2026, 10, 16, 14, 0)},
+		{"tomorrow", Schedule{TimeZone: "UTC", Windows: []string{"0 2 * * * 1h"}}, utc(2026, 10, 16, 10, 0), utc(2026, 10, 17, 2, 0)},
+		{"next weekday", Schedule{TimeZone: "UTC", Windows: []string{"0 2 * * mon-fri 1h"}}, utc(2026, 10, 17, 10, 0), utc(2026, 10, 19, 2, 0)},
+		{"earliest window", Schedule{TimeZone: "UTC", Windows: []string{"0 2 * * * 1h", "30 1 * * * 1h"}}, utc(2026, 10, 16, 10, 0), utc(2026, 10, 17, 1, 30)},
+		{"dom/dow: the 13th or a friday", Schedule{TimeZone: "UTC", Windows: []string{"0 0 13 * 5 1h"}}, utc(2026, 10, 10, 12, 0), utc(2026, 10, 13, 0, 0)},
+		{"skips a blackout day", Schedule{TimeZone: "UTC", Windows: []string{"0 2 * * * 1h"}, Blackout: []string{"2026-10-17"}}, utc(2026, 10, 16, 10, 0), utc(2026, 10, 18, 2, 0)},
+		{"end of a blackout range", Schedule{TimeZone: "UTC", Blackout: []string{"2026-12-20..2027-01-02"}}, utc(2026, 12, 24, 10, 0), utc(2027, 1, 3, 0, 0)},
+		{"window still open after a blackout day", Schedule{TimeZone: "UTC", Windows: []string{"0 22 * * * 4h"}, Blackout: []string{"2026-10-16"}}, utc(2026, 10, 16, 12, 0), utc(2026, 10, 17, 0, 0)},
+		{"opening skipped by spring forward", Schedule{TimeZone: "America/New_York", Windows: []string{"30 2 * * * 1h"}}, time.Date(2026, 3, 8, 0, 0, 0, 0, newYork), time.Date(2026, 3, 9, 2, 30, 0, 0, newYork)},
+		{"next month", Schedule{TimeZone: "UTC", Windows: []string{"0 3 1 * * 1h"}}, utc(2026, 10, 16, 10, 0), utc(2026, 11, 1, 3, 0)},
+		{"none within a year", Schedule{TimeZone: "UTC", Windows: []string{"0 0 30 feb * 1h"}}, utc(2026, 10, 16, 10, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := tt.schedule.compile()
+			if err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			got, ok := p.NextOpen(tt.from)
+			if tt.want.IsZero() {
+				if ok {
+					t.Errorf("NextOpen(%v) = %v, want none", tt.from, got)
+				}
+				return
+			}
+			if !ok || !got.Equal(tt.want) {
+				t.Errorf("NextOpen(%v) = %v, %v, want %v", tt.from, got, ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// selfProbeArg makes the agent exit successfully right away. A downloaded
+// agent binary is run with it before it replaces the running one.
+const selfProbeArg = "__ota-probe"
+
+// defaultSelfHealthTimeout is how long a new agent has to start up
+const defaultSelfHealthTimeout = 2 * time.Minute
+
+// SelfUpdate describes the ota-agent binary in the config
+type SelfUpdate struct {
+	Version       string        `yaml:"version"`        // optional: agent version, for logs and reports
+	URL           string        `yaml:"url"`            // download URL
+	SHA256        string        `yaml:"sha256"`         // binary sha256 hex
+	Patches       []Patch       `yaml:"patches"`        // optional: delta patches against the running binary
+	HealthTimeout time.Duration `yaml:"health_timeout"` // optional: time the new agent has to start up (default 2m)
+}
+
+// validate checks the self entry of a config
+func (s *SelfUpdate) validate() error {
+	if s.URL == "" {
+		return fmt.Errorf("self.url is required")
+	}
+	if _, err := url.Parse(s.URL); err != nil {
+		return fmt.Errorf("self.url is invalid: %w", err)
+	}
+	if !strings.HasPrefix(s.URL, "http://") && !strings.HasPrefix(s.URL, "https://") {
+		return fmt.Errorf("self.url must be http:// or https://")
+	}
+	sha256Regex := regexp.MustCompile(`^[a-fA-F0-9]{64}$`)
+	if !sha256Regex.MatchString(s.SHA256) {
+		return fmt.Errorf("self.sha256 must be 64 hex characters")
+	}
+	for j, p := range s.Patches {
+		if !strings.HasPrefix(p.URL, "http://") && !strings.HasPrefix(p.URL, "https://") {
+			return fmt.Errorf("self.patches[%d].url must be http:// or https://", j)
+		}
+		if !sha256Regex.MatchString(p.FromSHA256) || !sha256Regex.MatchString(p.SHA256) {
+			return fmt.Errorf("self.patches[%d] from_sha256 and sha256 must be 64 hex characters", j)
+		}
+	}
+	if s.HealthTimeout < 0 {
+		return fmt.Errorf("self.health_timeout must not be negative")
+	}
+	return nil
+}
+
+// healthTimeout returns the health timeout with the default applied
+func (s *SelfUpdate) healthTimeout() time.Duration {
+	if s.HealthTimeout <= 0 {
+		return defaultSelfHealthTimeout
+	}
+	return s.HealthTimeout
+}
+
+// badAgentKey is the entry of a rejected agent binary in the bad versions file
+func badAgentKey(sha string) string {
+	return "agent:" + strings.ToLower(sha)
+}
+
+// rolloutKey names the agent binary in the rollout of a config that only
+// updates the agent, and seeds its cohort by default
+func (s *SelfUpdate) rolloutKey() string {
+	if s.Version != "" {
+		return "agent " + s.Version
+	}
+	return "agent " + strings.ToLower(s.SHA256)
+}
+
+// selfPending reports whether the config would replace the running agent
+// binary: it differs from self and was not rejected before
+func selfPending(self *SelfUpdate, versionFile string) bool {
+	exe, err := getExecutablePath()
+	if err != nil {
+		return false
+	}
+	if sum, err := fileSHA256(exe); err == nil && strings.EqualFold(sum, self.SHA256) {
+		return false
+	}
+	return !isBadVersion(versionFile, badAgentKey(self.SHA256))
+}
+
+// stageSelf downloads and verifies the agent binary of the config next to
+// the running one. It returns nil when the running agent is already that
+// binary or the binary was rejected before.
+func stageSelf(self *SelfUpdate, versionFile, agentID string, timeout time.Duration, maxRetries int, logger *Logger) (*stagedFile, error) {
+	exe, err := getExecutablePath()
+	if err != nil {
+		return nil, err
+	}
+	if sum, err := fileSHA256(exe); err == nil && strings.EqualFold(sum, self.SHA256) {
+		logger.Debug("agent binary is up to date")
+		return nil, nil
+	}
+	if isBadVersion(versionFile, badAgentKey(self.SHA256)) {
+		logger.Debug("agent binary %s previously failed, skipping", self.SHA256)
+		return nil, nil
+	}
+	file := FileUpdate{Name: "ota-agent", URL: self.URL, SHA256: self.SHA256, Target: exe, Version: self.Version, Patches: self.Patches}
+	sf, err := stageFile(file, exe, stagedPath(exe), agentID, timeout, maxRetries, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &sf, nil
+}
+
+// selfUpdateState records an agent binary on probation. The new binary
+// runs from New until it has started up; only then does it replace Exe.
+// The previous binary thus stays in place for the supervisor of the agent
+// to restart if the new one crashes.
+type selfUpdateState struct {
+	SHA256   string    `yaml:"sha256"`            // new agent binary
+	Previous string    `yaml:"previous"`          // sha256 of the binary it replaces
+	Version  string    `yaml:"version,omitempty"` // version of the new agent, if known
+	Exe      string    `yaml:"exe"`               // installed agent binary
+	New      string    `yaml:"new"`               // new agent binary on probation
+	Deadline time.Time `yaml:"deadline"`          // start up deadline of the new agent
+	Started  bool      `yaml:"started"`           // the new agent has started once
+}
+
+// selfStateFile returns where the agent update on probation is recorded
+func selfStateFile(versionFile string) string {
+	return versionFile + ".self.yaml"
+}
+
+// readSelfState returns the agent update on probation, nil if there is none
+func readSelfState(versionFile string) (*selfUpdateState, error) {
+	b, err := os.ReadFile(selfStateFile(versionFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st selfUpdateState
+	if err := yaml.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("%s: %w", selfStateFile(versionFile), err)
+	}
+	return &st, nil
+}
+
+// writeSelfState atomically records st
+func writeSelfState(versionFile string, st *selfUpdateState) error {
+	b, err := yaml.Marshal(st)
+	if err != nil {
+		return err
+	}
+	path := selfStateFile(versionFile)
+	if err := os.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// prepareSelf checks that the staged agent binary runs on this machine and
+// puts it on probation next to the running one
+func prepareSelf(sf *stagedFile, self *SelfUpdate, versionFile string, logger *Logger) (*selfUpdateState, error) {
+	fail := func(err error) (*selfUpdateState, error) {
+		discardStaged([]stagedFile{*sf})
+		return nil, err
+	}
+	exe := sf.File.Target
+	previous, err := fileSHA256(exe)
+	if err != nil {
+		return fail(err)
+	}
+	if err := os.Chmod(sf.Path, 0755); err != nil {
+		return fail(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, sf.Path, selfProbeArg).CombinedOutput(); err != nil {
+		if mErr := markBadVersion(versionFile, badAgentKey(self.SHA256)); mErr != nil {
+			logger.Warn("failed to record bad agent binary: %v", mErr)
+		}
+		return fail(fmt.Errorf("new agent binary does not run: %v %s", err, strings.TrimSpace(string(out))))
+	}
+	st := &selfUpdateState{
+		SHA256:   strings.ToLower(self.SHA256),
+		Previous: previous,
+		Version:  self.Version,
+		Exe:      exe,
+		New:      exe + ".new",
+		Deadline: time.Now().Add(self.healthTimeout()),
+	}
+	if err := os.Rename(sf.Path, st.New); err != nil {
+		return fail(err)
+	}
+	if err := writeSelfState(versionFile, st); err != nil {
+		os.Remove(st.New)
+		return nil, fmt.Errorf("record agent update: %w", err)
+	}
+	return st, nil
+}
+
+// beginSelfProbation is called by every agent on startup. It returns the
+// agent update on probation, if any. The error is set when the update
+// failed: the new binary started before without confirming, missed its
+// deadline, or the agent running is not the new binary, which means that
+// the new one exited and the supervisor restarted the previous binary.
+func beginSelfProbation(versionFile string) (*selfUpdateState, error) {
+	st, err := readSelfState(versionFile)
+	if err != nil || st == nil {
+		return nil, err
+	}
+	if exe, _ := getExecutablePath(); exe != st.New {
+		return st, fmt.Errorf("new agent exited before it started up")
+	}
+	if st.Started {
+		return st, fmt.Errorf("new agent did not start up")
+	}
+	if time.Now().After(st.Deadline) {
+		return st, fmt.Errorf("new agent did not start up before %s", st.Deadline.Format(time.RFC3339))
+	}
+	st.Started = true
+	if err := writeSelfState(versionFile, st); err != nil {
+		return st, err
+	}
+	return st, nil
+}
+
+// confirmSelf ends the probation of the running new agent: its binary
+// replaces the previous one, which is kept as backup
+func confirmSelf(st *selfUpdateState, versionFile string, logger *Logger) error {
+	backup, err := atomicReplace(st.New, st.Exe, logger)
+	if err != nil {
+		return err
+	}
+	logger.Info("agent binary replaced (backup=%s)", backup)
+	return os.Remove(selfStateFile(versionFile))
+}
+
+// revertSelf discards the new agent binary on probation and records it
+// as bad
+func revertSelf(st *selfUpdateState, versionFile string, logger *Logger) {
+	if err := os.Remove(st.New); err != nil && !os.IsNotExist(err) {
+		logger.Warn("failed to remove new agent binary: %v", err)
+	}
+	if err := markBadVersion(versionFile, badAgentKey(st.SHA256)); err != nil {
+		logger.Warn("failed to record bad agent binary: %v", err)
+	}
+	if err := os.Remove(selfStateFile(versionFile)); err != nil && !os.IsNotExist(err) {
+		logger.Warn("failed to remove agent update state: %v", err)
+	}
+}
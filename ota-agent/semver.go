@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// semVersion is a parsed semantic version (https://semver.org)
+type semVersion struct {
+	Major, Minor, Patch uint64
+	Pre                 []string // pre-release identifiers
+	Build               string   // build metadata, ignored for precedence
+}
+
+// parseSemVer parses a semantic version. A leading "v" is accepted.
+func parseSemVer(s string) (semVersion, error) {
+	var v semVersion
+	rest := strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(rest, '+'); i >= 0 {
+		v.Build = rest[i+1:]
+		rest = rest[:i]
+		if err := checkIdentifiers(v.Build, false); err != nil {
+			return semVersion{}, fmt.Errorf("version %q: build metadata: %w", s, err)
+		}
+	}
+	if i := strings.IndexByte(rest, '-'); i >= 0 {
+		pre := rest[i+1:]
+		rest = rest[:i]
+		if err := checkIdentifiers(pre, true); err != nil {
+			return semVersion{}, fmt.Errorf("version %q: pre-release: %w", s, err)
+		}
+		v.Pre = strings.Split(pre, ".")
+	}
+	parts := strings.Split(rest, ".")
+	if len(parts) != 3 {
+		return semVersion{}, fmt.Errorf("version %q is not MAJOR.MINOR.PATCH", s)
+	}
+	nums := make([]uint64, 3)
+	for i, p := range parts {
+		n, err := parseNumericIdentifier(p)
+		if err != nil {
+			return semVersion{}, fmt.Errorf("version %q: %w", s, err)
+		}
+		nums[i] = n
+	}
+	v.Major, v.Minor, v.Patch = nums[0], nums[1], nums[2]
+	return v, nil
+}
+
+// parseNumericIdentifier parses a number without leading zeros
+func parseNumericIdentifier(s string) (uint64, error) {
+	if s == "" || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return n, nil
+}
+
+// checkIdentifiers checks dot-separated pre-release or build identifiers
+func checkIdentifiers(s string, pre bool) error {
+	for _, id := range strings.Split(s, ".") {
+		if id == "" {
+			return fmt.Errorf("empty identifier")
+		}
+		numeric := true
+		for _, c := range id {
+			switch {
+			case c >= '0' && c <= '9':
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '-':
+				numeric = false
+			default:
+				return fmt.Errorf("bad character %q in %q", c, id)
+			}
+		}
+		if pre && numeric && len(id) > 1 && id[0] == '0' {
+			return fmt.Errorf("leading zero in %q", id)
+		}
+	}
+	return nil
+}
+
+// compare returns -1, 0 or 1 as v has lower, equal or higher precedence
+// than o
+func (v semVersion) compare(o semVersion) int {
+	for _, d := range [][2]uint64{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if d[0] != d[1] {
+			if d[0] < d[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	// A pre-release has lower precedence than the release
+	switch {
+	case len(v.Pre) == 0 && len(o.Pre) == 0:
+		return 0
+	case len(v.Pre) == 0:
+		return 1
+	case len(o.Pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.Pre) && i < len(o.Pre); i++ {
+		if c := compareIdentifier(v.Pre[i], o.Pre[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(v.Pre) < len(o.Pre):
+		return -1
+	case len(v.Pre) > len(o.Pre):
+		return 1
+	}
+	return 0
+}
+
+// compareIdentifier compares pre-release identifiers: numeric ones by
+// value and below alphanumeric ones, which compare in ASCII order
+func compareIdentifier(a, b string) int {
+	na, errA := strconv.ParseUint(a, 10, 64)
+	nb, errB := strconv.ParseUint(b, 10, 64)
+	switch {
+	case errA == nil && errB == nil:
+		if na == nb {
+			return 0
+		}
+		if na < nb {
+			return -1
+		}
+		return 1
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// compareVersions compares two semantic versions by precedence
+func compareVersions(a, b string) (int, error) {
+	va, err := parseSemVer(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseSemVer(b)
+	if err != nil {
+		return 0, err
+	}
+	return va.compare(vb), nil
+}
+
+// versionFloorFile returns where the minimum installable version is kept
+func versionFloorFile(versionFile string) string {
+	return versionFile + ".floor"
+}
+
+// readVersionFloor returns the minimum installable version, "" if none
+func readVersionFloor(versionFile string) (string, error) {
+	b, err := os.ReadFile(versionFloorFile(versionFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// raiseVersionFloor sets the minimum installable version to version unless
+// the floor is already at least that high. It reports whether it changed.
+func raiseVersionFloor(versionFile, version string) (bool, error) {
+	if _, err := parseSemVer(version); err != nil {
+		return false, err
+	}
+	floor, err := readVersionFloor(versionFile)
+	if err != nil {
+		return false, err
+	}
+	if floor != "" {
+		if c, err := compareVersions(version, floor); err == nil && c <= 0 {
+			return false, nil
+		}
+	}
+	tmp := versionFloorFile(versionFile) + ".tmp"
+	if err := os.WriteFile(tmp, []byte(version+"\n"), 0644); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, versionFloorFile(versionFile))
+}
+
+// sameVersion reports whether a and b name the same release: equal
+// strings, or semantic versions of equal precedence and build metadata
+func sameVersion(a, b string) bool {
+	if a == b {
+		return true
+	}
+	va, errA := parseSemVer(a)
+	vb, errB := parseSemVer(b)
+	return errA == nil && errB == nil && va.compare(vb) == 0 && va.Build == vb.Build
+}
+
+// checkVersionPolicy returns why the remote config must not be applied
+// over localVer, or "" if it may: its version must not be below the local
+// floor, and must not be lower than the local version unless the config
+// allows a downgrade. A version that is not a semantic version cannot be
+// ordered; it is refused against a floor, and against a different local
+// version unless the config allows a downgrade.
+func checkVersionPolicy(cfg *Config, localVer, floor string) string {
+	remote, err := parseSemVer(cfg.Version)
+	if err != nil {
+		if floor != "" {
+			return fmt.Sprintf("%v, cannot check it against the minimum version %s", err, floor)
+		}
+		if localVer == "" || sameVersion(cfg.Version, localVer) || cfg.AllowDowngrade {
+			return ""
+		}
+		return fmt.Sprintf("%v, cannot tell whether it is a downgrade from %s, allow_downgrade is not set", err, localVer)
+	}
+	if floor != "" {
+		min, err := parseSemVer(floor)
+		if err != nil {
+			return fmt.Sprintf("minimum %v, cannot check %s against it", err, cfg.Version)
+		}
+		if remote.compare(min) < 0 {
+			return fmt.Sprintf("version %s is below the minimum version %s", cfg.Version, floor)
+		}
+	}
+	if localVer == "" || cfg.AllowDowngrade {
+		return ""
+	}
+	local, err := parseSemVer(localVer)
+	if err != nil {
+		return fmt.Sprintf("local %v, cannot tell whether %s is a downgrade, allow_downgrade is not set", err, cfg.Version)
+	}
+	if remote.compare(local) >= 0 {
+		return ""
+	}
+	return fmt.Sprintf("downgrade from %s to %s refused, allow_downgrade is not set", localVer, cfg.Version)
+}
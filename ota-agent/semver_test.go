@@ -0,0 +1,189 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSemVer(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    semVersion
+		wantErr bool
+	}{
+		{in: "1.2.3", want: semVersion{Major: 1, Minor: 2, Patch: 3}},
+		{in: "v1.2.3", want: semVersion{Major: 1, Minor: 2, Patch: 3}},
+		{in: "0.0.0", want: semVersion{}},
+		{in: "10.20.30", want: semVersion{Major: 10, Minor: 20, Patch: 30}},
+		{in: "1.0.0-alpha.1", want: semVersion{Major: 1, Pre: []string{"alpha", "1"}}},
+		{in: "1.0.0-0a.x-y", want: semVersion{Major: 1, Pre: []string{"0a", "x-y"}}},
+		{in: "1.0.0+build.5", want: semVersion{Major: 1, Build: "build.5"}},
+		{in: "1.0.0+001", want: semVersion{Major: 1, Build: "001"}},
+		{in: "1.0.0-rc.1+sha.abc", want: semVersion{Major: 1, Pre: []string{"rc", "1"}, Build: "sha.abc"}},
+
+		// Leading zeros are not allowed in numbers and numeric pre-release
+		// identifiers
+		{in: "01.2.3", wantErr: true},
+		{in: "1.02.3", wantErr: true},
+		{in: "1.2.03", wantErr: true},
+		{in: "1.0.0-01", wantErr: true},
+		{in: "1.0.0-rc.01", wantErr: true},
+
+		{in: "", wantErr: true},
+		{in: "1.2", wantErr: true},
+		{in: "1.2.3.4", wantErr: true},
+		{in: "1.2.x", wantErr: true},
+		{in: "-1.2.3", wantErr: true},
+		{in: "1.2.3-", wantErr: true},
+		{in: "1.2.3-a..b", wantErr: true},
+		{in: "1.2.3-a_b", wantErr: true},
+		{in: "1.2.3+", wantErr: true},
+		{in: "1.2.3+a b", wantErr: true},
+		{in: "18446744073709551616.0.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSemVer(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSemVer(%q) = %+v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSemVer(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSemVer(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"v1.0.0", "1.0.0", 0},
+		{"1.0.0", "2.0.0", -1},
+		{"2.0.0", "1.9.9", 1},
+		{"1.2.0", "1.10.0", -1},
+		{"1.0.10", "1.0.9", 1},
+		{"1.0.0+a", "1.0.0+b", 0},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0", "1.0.0-rc.1", 1},
+		{"1.0.0-rc.1", "0.9.9", 1},
+	}
+	for _, tt := range tests {
+		got, err := compareVersions(tt.a, tt.b)
+		if err != nil {
+			t.Errorf("compareVersions(%q, %q): %v", tt.a, tt.b, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestComparePreRelease(t *testing.T) {
+	// Ascending precedence, from the semver specification
+	ordered := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+	}
+	for i, a := range ordered {
+		for j, b := range ordered {
+			want := 0
+			switch {
+			case i < j:
+				want = -1
+			case i > j:
+				want = 1
+			}
+			got, err := compareVersions(a, b)
+			if err != nil {
+				t.Fatalf("compareVersions(%q, %q): %v", a, b, err)
+			}
+			if got != want {
+				t.Errorf("compareVersions(%q, %q) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestSameVersion(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"1.0.0", "1.0.0", true},
+		{"v1.0.0", "1.0.0", true},
+		{"1.0.0+a", "1.0.0+a", true},
+		{"1.0.0+a", "1.0.0+b", false},
+		{"1.0.0", "1.0.0-rc.1", false},
+		{"build-42", "build-42", true},
+		{"build-42", "build-43", false},
+		{"", "1.0.0", false},
+	}
+	for _, tt := range tests {
+		if got := sameVersion(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameVersion(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCheckVersionPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		remote    string
+		downgrade bool
+		local     string
+		floor     string
+		want      string // substring of the reason, "" if allowed
+	}{
+		{name: "upgrade", remote: "1.2.0", local: "1.1.0"},
+		{name: "same version", remote: "1.1.0", local: "1.1.0"},
+		{name: "first install", remote: "1.0.0", local: ""},
+		{name: "downgrade", remote: "1.0.0", local: "1.1.0", want: "downgrade from 1.1.0 to 1.0.0 refused"},
+		{name: "downgrade to pre-release", remote: "1.1.0-rc.1", local: "1.1.0", want: "downgrade"},
+		{name: "allowed downgrade", remote: "1.0.0", downgrade: true, local: "1.1.0"},
+		{name: "at floor", remote: "1.1.0", local: "1.0.0", floor: "1.1.0"},
+		{name: "below floor", remote: "1.0.0", local: "0.9.0", floor: "1.1.0", want: "below the minimum version 1.1.0"},
+		{name: "allowed downgrade below floor", remote: "1.0.0", downgrade: true, local: "1.2.0", floor: "1.1.0", want: "below the minimum version"},
+		{name: "pre-release below floor", remote: "1.1.0-rc.1", local: "1.0.0", floor: "1.1.0", want: "below the minimum version"},
+		{name: "local not semver", remote: "1.0.0", local: "build-42", want: "cannot tell whether 1.0.0 is a downgrade"},
+		{name: "local not semver, downgrade allowed", remote: "1.0.0", downgrade: true, local: "build-42"},
+		{name: "remote not semver", remote: "build-42", local: "1.0.0", want: "cannot tell whether it is a downgrade from 1.0.0"},
+		{name: "remote not semver, downgrade allowed", remote: "build-42", downgrade: true, local: "1.0.0"},
+		{name: "remote not semver, first install", remote: "build-42", local: ""},
+		{name: "neither semver, same version", remote: "build-42", local: "build-42"},
+		{name: "neither semver", remote: "build-43", local: "build-42", want: "allow_downgrade is not set"},
+		{name: "remote not semver with floor", remote: "build-42", local: "1.0.0", floor: "1.0.0", want: "cannot check it against the minimum version 1.0.0"},
+		{name: "remote not semver with floor, downgrade allowed", remote: "build-42", downgrade: true, local: "1.0.0", floor: "1.0.0", want: "minimum version"},
+		{name: "floor not semver", remote: "1.0.0", local: "0.9.0", floor: "junk", want: "cannot check 1.0.0 against it"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Version: tt.remote, AllowDowngrade: tt.downgrade}
+			got := checkVersionPolicy(cfg, tt.local, tt.floor)
+			if tt.want == "" {
+				if got != "" {
+					t.Errorf("checkVersionPolicy = %q, want the update allowed", got)
+				}
+				return
+			}
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("checkVersionPolicy = %q, want it to contain %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TrustedKeys maps key IDs to pinned Ed25519 public keys.
+// Several keys may be trusted at once so that releases can be signed with
+// both the old and the new key while a key rotation is rolled out.
+type TrustedKeys map[string]ed25519.PublicKey
+
+// keyFlag collects repeated -trusted-key flags
+type keyFlag []string
+
+func (k *keyFlag) String() string {
+	return strings.Join(*k, ",")
+}
+
+func (k *keyFlag) Set(v string) error {
+	*k = append(*k, v)
+	return nil
+}
+
+// parseKeySpec parses a "<key-id>:<base64 public key>" pair
+func parseKeySpec(spec string) (string, ed25519.PublicKey, error) {
+	id, encoded, ok := strings.Cut(strings.TrimSpace(spec), ":")
+	if !ok || id == "" || encoded == "" {
+		return "", nil, fmt.Errorf("trusted key must be <key-id>:<base64>, got %q", spec)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, fmt.Errorf("decode key %s: %w", id, err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return "", nil, fmt.Errorf("key %s: want %d bytes, got %d", id, ed25519.PublicKeySize, len(raw))
+	}
+	return id, ed25519.PublicKey(raw), nil
+}
+
+// loadTrustedKeys builds the trusted key set from -trusted-key values and an
+// optional keys file containing one "<key-id>:<base64>" entry per line
+func loadTrustedKeys(specs []string, keysFile string) (TrustedKeys, error) {
+	all := append([]string(nil), specs...)
+	if keysFile != "" {
+		b, err := os.ReadFile(keysFile)
+		if err != nil {
+			return nil, fmt.Errorf("read trusted keys file: %w", err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			all = append(all, line)
+		}
+	}
+
+	keys := TrustedKeys{}
+	for _, spec := range all {
+		id, pub, err := parseKeySpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("duplicate trusted key id %s", id)
+		}
+		keys[id] = pub
+	}
+	return keys, nil
+}
+
+// IDs returns the sorted list of trusted key IDs
+func (tk TrustedKeys) IDs() []string {
+	ids := make([]string, 0, len(tk))
+	for id := range tk {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Verify checks a detached signature file against the manifest bytes.
+// The signature file holds one "<key-id> <base64 signature>" entry per line;
+// entries made with unknown keys are skipped so that a manifest may carry
+// signatures from keys that are being introduced or retired.
+// Returns the ID of the key that produced a valid signature.
+func (tk TrustedKeys) Verify(manifest, sigFile []byte) (string, error) {
+	if len(tk) == 0 {
+		return "", fmt.Errorf("no trusted keys configured")
+	}
+	checked := 0
+	scanner := bufio.NewScanner(bytes.NewReader(sigFile))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return "", fmt.Errorf("malformed signature line %q", line)
+		}
+		pub, ok := tk[fields[0]]
+		if !ok {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return "", fmt.Errorf("decode signature for key %s: %w", fields[0], err)
+		}
+		checked++
+		if ed25519.Verify(pub, manifest, sig) {
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("read signature: %w", err)
+	}
+	if checked == 0 {
+		return "", fmt.Errorf("no signature from a trusted key (trusted: %s)", strings.Join(tk.IDs(), ", "))
+	}
+	return "", fmt.Errorf("signature invalid")
+}
+
+// readPrivateKey reads a base64 encoded Ed25519 private key (seed or full key)
+func readPrivateKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("decode private key: %w", err)
+	}
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	}
+	return nil, fmt.Errorf("private key has invalid length %d", len(raw))
+}
+
+// runKeygen implements the "keygen" subcommand
+func runKeygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	keyID := fs.String("key-id", "", "identifier of the new key (required)")
+	outDir := fs.String("out", ".", "directory to write <key-id>.key and <key-id>.pub to")
+	fs.Parse(args)
+
+	if *keyID == "" || strings.ContainsAny(*keyID, " \t:") {
+		return fmt.Errorf("-key-id is required and must not contain spaces or ':'")
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate key: %w", err)
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return err
+	}
+	privPath := filepath.Join(*outDir, *keyID+".key")
+	pubPath := filepath.Join(*outDir, *keyID+".pub")
+	if err := os.WriteFile(privPath, []byte(base64.StdEncoding.EncodeToString(priv)+"\n"), 0600); err != nil {
+		return fmt.Errorf("write private key: %w", err)
+	}
+	spec := *keyID + ":" + base64.StdEncoding.EncodeToString(pub)
+	if err := os.WriteFile(pubPath, []byte(spec+"\n"), 0644); err != nil {
+		return fmt.Errorf("write public key: %w", err)
+	}
+	fmt.Printf("private key: %s\n", privPath)
+	fmt.Printf("public key:  %s\n", pubPath)
+	fmt.Printf("agent flag:  -trusted-key=%s\n", spec)
+	return nil
+}
+
+// runSign implements the "sign" subcommand used by the release pipeline.
+// It writes (or appends to) the detached signature file next to the manifest.
+func runSign(args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyPath := fs.String("key", "", "path to base64 Ed25519 private key (required)")
+	keyID := fs.String("key-id", "", "key identifier recorded in the signature (required)")
+	out := fs.String("out", "", "signature output path (default: <manifest>.sig)")
+	appendSig := fs.Bool("append", false, "append to an existing signature file (for key rotation)")
+	fs.Parse(args)
+
+	if *keyPath == "" || *keyID == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: ota-agent sign -key <file> -key-id <id> [-out <file>] [-append] <version.yaml>")
+	}
+	manifestPath := fs.Arg(0)
+	if *out == "" {
+		*out = manifestPath + ".sig"
+	}
+
+	priv, err := readPrivateKey(*keyPath)
+	if err != nil {
+		return fmt.Errorf("read private key: %w", err)
+	}
+	manifest, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	line := fmt.Sprintf("%s %s\n", *keyID, base64.StdEncoding.EncodeToString(ed25519.Sign(priv, manifest)))
+
+	var content []byte
+	if *appendSig {
+		existing, err := os.ReadFile(*out)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("read existing signature: %w", err)
+		}
+		// drop any previous signature by the same key
+		for _, l := range strings.SplitAfter(string(existing), "\n") {
+			if f := strings.Fields(l); len(f) > 0 && f[0] != *keyID {
+				content = append(content, strings.TrimRight(l, "\n")+"\n"...)
+			}
+		}
+	}
+	content = append(content, line...)
+	if err := os.WriteFile(*out, content, 0644); err != nil {
+		return fmt.Errorf("write signature: %w", err)
+	}
+	fmt.Printf("signed %s with key %s -> %s\n", manifestPath, *keyID, *out)
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testKey(seed byte) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+}
+
+// sigLine returns the signature file entry of key id over manifest
+func sigLine(id string, key ed25519.PrivateKey, manifest []byte) string {
+	return id + " " + base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest)) + "\n"
+}
+
+func TestTrustedKeysVerify(t *testing.T) {
+	manifest := []byte("version: \"1.2.0\"\nfiles: []\n")
+	tampered := []byte("version: \"1.2.1\"\nfiles: []\n")
+	oldKey, newKey, otherKey := testKey(1), testKey(2), testKey(3)
+	keys := TrustedKeys{
+		"old": oldKey.Public().(ed25519.PublicKey),
+		"new": newKey.Public().(ed25519.PublicKey),
+	}
+	tests := []struct {
+		name    string
+		keys    TrustedKeys
+		sig     string
+		wantID  string
+		wantErr string
+	}{
+		{name: "good signature", keys: keys, sig: sigLine("new", newKey, manifest), wantID: "new"},
+		{
+			name:   "unknown keys and comments skipped",
+			keys:   keys,
+			sig:    "# release 1.2.0\n\n" + sigLine("retired", otherKey, manifest) + sigLine("old", oldKey, manifest),
+			wantID: "old",
+		},
+		{
+			name:   "one valid signature is enough",
+			keys:   keys,
+			sig:    sigLine("old", otherKey, manifest) + sigLine("new", newKey, manifest),
+			wantID: "new",
+		},
+		{name: "wrong key", keys: keys, sig: sigLine("new", otherKey, manifest), wantErr: "signature invalid"},
+		{name: "tampered manifest", keys: keys, sig: sigLine("new", newKey, tampered), wantErr: "signature invalid"},
+		{name: "truncated signature", keys: keys, sig: "new " + base64.StdEncoding.EncodeToString(ed25519.Sign(newKey, manifest)[:32]), wantErr: "signature invalid"},
+		{name: "only untrusted keys", keys: keys, sig: sigLine("other", otherKey, manifest), wantErr: "no signature from a trusted key (trusted: new, old)"},
+		{name: "empty signature file", keys: keys, sig: "", wantErr: "no signature from a trusted key"},
+		{name: "missing signature", keys: keys, sig: "new\n", wantErr: "malformed signature line"},
+		{name: "extra field", keys: keys, sig: strings.TrimSuffix(sigLine("new", newKey, manifest), "\n") + " x\n", wantErr: "malformed signature line"},
+		{name: "bad base64", keys: keys, sig: "new not*base64\n", wantErr: "decode signature for key new"},
+		{name: "no trusted keys", keys: TrustedKeys{}, sig: sigLine("new", newKey, manifest), wantErr: "no trusted keys configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := tt.keys.Verify(manifest, []byte(tt.sig))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if id != tt.wantID {
+				t.Errorf("key = %q, want %q", id, tt.wantID)
+			}
+		})
+	}
+}
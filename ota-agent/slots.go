@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SlotLayout installs every release into a directory of its own and
+// switches between releases by atomically replacing a symlink:
+//
+//	<dir>/releases/<version>/<target>
+//	<dir>/current -> releases/<version>
+//
+// File targets are relative to the release directory. The last Keep
+// releases stay on disk so that a rollback is a single symlink flip.
+type SlotLayout struct {
+	Dir  string // base directory holding releases/ and current
+	Keep int    // releases kept on disk, including the current one
+}
+
+func (s *SlotLayout) releasesDir() string {
+	return filepath.Join(s.Dir, "releases")
+}
+
+func (s *SlotLayout) currentLink() string {
+	return filepath.Join(s.Dir, "current")
+}
+
+func (s *SlotLayout) releaseDir(version string) string {
+	return filepath.Join(s.releasesDir(), version)
+}
+
+// Current returns the version the current symlink points to, or "" if none
+func (s *SlotLayout) Current() (string, error) {
+	dest, err := os.Readlink(s.currentLink())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return filepath.Base(dest), nil
+}
+
+// Releases returns the installed release versions, newest first
+func (s *SlotLayout) Releases() ([]string, error) {
+	entries, err := os.ReadDir(s.releasesDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	type release struct {
+		version string
+		mtime   time.Time
+	}
+	var releases []release
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		releases = append(releases, release{e.Name(), info.ModTime()})
+	}
+	sort.Slice(releases, func(i, j int) bool { return releases[i].mtime.After(releases[j].mtime) })
+	versions := make([]string, len(releases))
+	for i, r := range releases {
+		versions[i] = r.version
+	}
+	return versions, nil
+}
+
+// validate checks that a release can be laid out under the slot directory
+func (s *SlotLayout) validate(cfg *Config) error {
+	if cfg.Version == "." || cfg.Version == ".." || strings.ContainsAny(cfg.Version, `/\`) || strings.HasPrefix(cfg.Version, ".") {
+		return fmt.Errorf("version %q cannot be used as a release directory name", cfg.Version)
+	}
+	for i, file := range cfg.Files {
+		clean := filepath.Clean(file.Target)
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("files[%d].target must be relative to the release directory in slot mode: %s", i, file.Target)
+		}
+	}
+	return nil
+}
+
+// Switch atomically points the current symlink at version
+func (s *SlotLayout) Switch(version string) error {
+	if _, err := os.Stat(s.releaseDir(version)); err != nil {
+		return fmt.Errorf("release %s: %w", version, err)
+	}
+	tmp := s.currentLink() + ".tmp"
+	_ = os.Remove(tmp)
+	if err := os.Symlink(filepath.Join("releases", version), tmp); err != nil {
+		return fmt.Errorf("create symlink: %w", err)
+	}
+	if err := renameFile(tmp, s.currentLink()); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("switch symlink: %w", err)
+	}
+	return nil
+}
+
+// Install stages a complete release into a fresh directory, switches the
+// current symlink to it and prunes old releases. Files whose sha256 matches
+// the current release are linked instead of downloaded. preSwitch is called
+// with the file reports right before the switch and aborts the install
+// when it fails.
+// Returns the version current pointed to before the switch and a report
+// per file. When current already points at cfg.Version, e.g. after an
+// install that was interrupted before the version file was written,
+// nothing is installed and the returned previous version is cfg.Version.
+func (s *SlotLayout) Install(cfg *Config, agentID string, timeout time.Duration, maxRetries int, preSwitch func(reports []FileReport) error, logger *Logger) (string, []FileReport, error) {
+	reports := pendingReports(cfg.Files)
+	if err := s.validate(cfg); err != nil {
+		return "", reports, err
+	}
+	prev, err := s.Current()
+	if err != nil {
+		return "", reports, fmt.Errorf("read current release: %w", err)
+	}
+	if prev == cfg.Version {
+		for i := range reports {
+			reports[i].Outcome = "unchanged"
+		}
+		return prev, reports, nil
+	}
+	prevDir := ""
+	if prev != "" {
+		prevDir = s.releaseDir(prev)
+	}
+
+	// The staging directory is stable per version so that partial
+	// downloads inside it survive a failed attempt
+	staging := filepath.Join(s.releasesDir(), ".staging-"+cfg.Version)
+	fail := func(i int, start time.Time, err error) (string, []FileReport, error) {
+		reports[i].Outcome = "failed"
+		reports[i].Error = err.Error()
+		reports[i].DurationMs = time.Since(start).Milliseconds()
+		return "", reports, err
+	}
+	for i, file := range cfg.Files {
+		start := time.Now()
+		logger := logger.With("file", file.Name)
+		dest := filepath.Join(staging, filepath.Clean(file.Target))
+		base := ""
+		if prevDir != "" {
+			base = filepath.Join(prevDir, filepath.Clean(file.Target))
+			if sum, err := fileSHA256(base); err == nil && strings.EqualFold(sum, file.SHA256) {
+				if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+					return fail(i, start, err)
+				}
+				if err := linkOrCopy(base, dest); err != nil {
+					return fail(i, start, fmt.Errorf("reuse %s: %w", file.Name, err))
+				}
+				logger.Info("%s unchanged, reused from release %s", file.Name, prev)
+				reports[i].Outcome = "unchanged"
+				reports[i].Method = "reused"
+				reports[i].DurationMs = time.Since(start).Milliseconds()
+				continue
+			}
+		}
+		sf, err := stageFile(file, base, dest, agentID, timeout, maxRetries, logger)
+		if err != nil {
+			return fail(i, start, fmt.Errorf("stage %s: %w", file.Name, err))
+		}
+		reports[i] = sf.Report
+		if err := os.Chmod(dest, 0755); err != nil {
+			logger.Warn("chmod failed: %v", err)
+		}
+	}
+
+	// Leftovers of earlier attempts must not end up in the release
+	filepath.WalkDir(staging, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && (strings.HasPrefix(d.Name(), partialPrefix) || strings.HasPrefix(d.Name(), ".ota-patch-")) {
+			_ = os.Remove(path)
+		}
+		return nil
+	})
+
+	final := s.releaseDir(cfg.Version)
+	if err := os.RemoveAll(final); err != nil {
+		return "", reports, fmt.Errorf("remove stale release dir: %w", err)
+	}
+	if err := renameFile(staging, final); err != nil {
+		return "", reports, fmt.Errorf("move release into place: %w", err)
+	}
+	now := time.Now()
+	_ = os.Chtimes(final, now, now)
+
+	if err := preSwitch(reports); err != nil {
+		// A deferred release is kept staged for the next attempt
+		if errors.Is(err, errOutsideWindow) && renameFile(final, staging) == nil {
+			return "", reports, err
+		}
+		_ = os.RemoveAll(final)
+		setOutcome(reports, "not_attempted")
+		return "", reports, err
+	}
+
+	if err := s.Switch(cfg.Version); err != nil {
+		return "", reports, err
+	}
+	logger.Info("current -> releases/%s (previous: %q)", cfg.Version, prev)
+
+	s.Prune(cfg.Version, prev, logger)
+	setOutcome(reports, "updated")
+	return prev, reports, nil
+}
+
+// Rollback points current back at prev, or removes it if there was no
+// previous release
+func (s *SlotLayout) Rollback(prev string) error {
+	if prev == "" {
+		err := os.Remove(s.currentLink())
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return s.Switch(prev)
+}
+
+// Prune removes all but the newest Keep releases; protected versions are
+// always kept. Abandoned staging directories are removed as well.
+func (s *SlotLayout) Prune(protect1, protect2 string, logger *Logger) {
+	releases, err := s.Releases()
+	if err != nil {
+		logger.Warn("list releases: %v", err)
+		return
+	}
+	kept := 0
+	for _, v := range releases {
+		if v == protect1 || v == protect2 || kept < s.Keep {
+			kept++
+			continue
+		}
+		if err := os.RemoveAll(s.releaseDir(v)); err != nil {
+			logger.Warn("prune release %s: %v", v, err)
+		} else {
+			logger.Info("pruned old release %s", v)
+		}
+	}
+
+	entries, _ := os.ReadDir(s.releasesDir())
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), ".staging-") {
+			_ = os.RemoveAll(filepath.Join(s.releasesDir(), e.Name()))
+		}
+	}
+}
+
+// linkOrCopy hard links src to dst, copying when linking is not possible
+func linkOrCopy(src, dst string) error {
+	_ = os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
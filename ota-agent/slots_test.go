@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlotInstallRestoresOnFailure(t *testing.T) {
+	content := []byte("app 2")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer srv.Close()
+	cfg := &Config{
+		Version: "2.0.0",
+		Files:   []FileUpdate{{Name: "app", URL: srv.URL + "/app", SHA256: sha256Hex(content), Target: "bin/app"}},
+	}
+	// setup lays out release 1.0.0 as the current one
+	setup := func(t *testing.T) *SlotLayout {
+		s := &SlotLayout{Dir: t.TempDir(), Keep: 3}
+		writeFiles(t, s.releaseDir("1.0.0"), map[string]string{"bin/app": "app 1"})
+		if err := s.Switch("1.0.0"); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	install := func(s *SlotLayout) error {
+		_, _, err := s.Install(cfg, "", 5*time.Second, 1, func([]FileReport) error { return nil }, discardLogger())
+		return err
+	}
+
+	s := setup(t)
+	calls := failNthRename(t, 0)
+	if err := install(s); err != nil {
+		t.Fatalf("Install: %v", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(s.currentLink(), "bin/app")); err != nil || string(b) != "app 2" {
+		t.Fatalf("current/bin/app = %q, %v after install", b, err)
+	}
+	renames := calls()
+
+	for n := 1; n <= renames; n++ {
+		s := setup(t)
+		failNthRename(t, n)
+		err := install(s)
+		if err == nil || !strings.Contains(err.Error(), "injected failure") {
+			t.Fatalf("rename %d/%d failed: Install error = %v", n, renames, err)
+		}
+		if cur, err := s.Current(); err != nil || cur != "1.0.0" {
+			t.Errorf("rename %d/%d failed: current = %q, %v", n, renames, cur, err)
+		}
+		if b, err := os.ReadFile(filepath.Join(s.currentLink(), "bin/app")); err != nil || string(b) != "app 1" {
+			t.Errorf("rename %d/%d failed: current/bin/app = %q, %v", n, renames, b, err)
+		}
+		if _, err := os.Lstat(s.currentLink() + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("rename %d/%d failed: temporary symlink left behind", n, renames)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// renameFile moves files into and out of place during a commit. Tests
+// replace it to make a rename fail.
+var renameFile = os.Rename
+
+// stagedFile is a downloaded and verified file waiting to be swapped in
+type stagedFile struct {
+	File   FileUpdate
+	Path   string     // verified copy next to the target
+	Report FileReport // how the file was obtained
+}
+
+// stagedPath returns where the new version of target is staged.
+// Staging next to the target keeps the final rename on the same filesystem.
+func stagedPath(target string) string {
+	return filepath.Join(filepath.Dir(target), ".ota-staged-"+filepath.Base(target))
+}
+
+// stageFile downloads and verifies a single file into dest without touching
+// its target. base is the currently installed copy, used for delta patches.
+func stageFile(file FileUpdate, base, dest string, agentID string, timeout time.Duration, maxRetries int, logger *Logger) (stagedFile, error) {
+	logger = logger.With("file", file.Name)
+	logger.Info("staging file %s (target: %s)", file.Name, file.Target)
+	start := time.Now()
+	staged := func(method string) stagedFile {
+		report := FileReport{Name: file.Name, Target: file.Target, Outcome: "staged", Method: method, DurationMs: time.Since(start).Milliseconds()}
+		if info, err := os.Stat(dest); err == nil {
+			report.Size = info.Size()
+		}
+		return stagedFile{File: file, Path: dest, Report: report}
+	}
+
+	// Check write permission
+	if err := checkWritePermission(dest); err != nil {
+		return stagedFile{}, fmt.Errorf("permission check failed for %s: %w", dest, err)
+	}
+
+	// A file staged by a deferred install is still good
+	if sum, err := fileSHA256(dest); err == nil && strings.EqualFold(sum, file.SHA256) {
+		logger.Info("%s already staged and verified", file.Name)
+		return staged("prefetched"), nil
+	}
+
+	// Prefer a delta patch against the current file
+	if patched, err := stageFromPatch(file, base, dest, agentID, timeout, maxRetries, logger); err != nil {
+		logger.Warn("delta update of %s failed, falling back to full download: %v", file.Name, err)
+		_ = os.Remove(dest)
+	} else if patched {
+		logger.With("duration", time.Since(start)).Info("checksum verified for %s (built from delta patch)", file.Name)
+		return staged("delta"), nil
+	}
+
+	// Download (resumable) and verify checksum while writing
+	logger.Info("downloading %s to %s", file.Name, dest)
+	if err := downloadFile(file.URL, dest, file.SHA256, agentID, timeout, maxRetries, logger); err != nil {
+		_ = os.Remove(dest)
+		return stagedFile{}, fmt.Errorf("download error: %w", err)
+	}
+	logger.With("duration", time.Since(start)).Info("checksum verified for %s", file.Name)
+
+	return staged("full"), nil
+}
+
+// stageAll stages every file of a release whose target differs from it.
+// If any file fails, everything staged so far is discarded and no target
+// is modified. The returned reports cover every file, including those
+// never attempted.
+func stageAll(files []FileUpdate, agentID string, timeout time.Duration, maxRetries int, logger *Logger) ([]stagedFile, []FileReport, error) {
+	staged := make([]stagedFile, 0, len(files))
+	reports := pendingReports(files)
+	for i, file := range files {
+		if sum, err := fileSHA256(file.Target); err == nil && strings.EqualFold(sum, file.SHA256) {
+			logger.With("file", file.Name).Info("%s is already up to date", file.Target)
+			reports[i].Outcome = "unchanged"
+			continue
+		}
+		start := time.Now()
+		sf, err := stageFile(file, file.Target, stagedPath(file.Target), agentID, timeout, maxRetries, logger)
+		if err != nil {
+			discardStaged(staged)
+			reports[i].Outcome = "failed"
+			reports[i].Error = err.Error()
+			reports[i].DurationMs = time.Since(start).Milliseconds()
+			return nil, reports, fmt.Errorf("stage %s: %w", file.Name, err)
+		}
+		staged = append(staged, sf)
+		reports[i] = sf.Report
+	}
+	return staged, reports, nil
+}
+
+// pendingReports returns one not_attempted report per file
+func pendingReports(files []FileUpdate) []FileReport {
+	reports := make([]FileReport, len(files))
+	for i, file := range files {
+		reports[i] = FileReport{Name: file.Name, Target: file.Target, Outcome: "not_attempted"}
+	}
+	return reports
+}
+
+// changedFiles returns the names of the files an update replaced
+func changedFiles(reports []FileReport) map[string]bool {
+	changed := make(map[string]bool)
+	for _, r := range reports {
+		if r.Outcome == "updated" {
+			changed[r.Name] = true
+		}
+	}
+	return changed
+}
+
+// stagedFiles returns the names of the files staged but not yet committed
+func stagedFiles(reports []FileReport) map[string]bool {
+	staged := make(map[string]bool)
+	for _, r := range reports {
+		if r.Outcome == "staged" {
+			staged[r.Name] = true
+		}
+	}
+	return staged
+}
+
+// setOutcome sets the outcome of every report that was staged
+func setOutcome(reports []FileReport, outcome string) {
+	for i := range reports {
+		if reports[i].Outcome == "staged" || reports[i].Outcome == "updated" {
+			reports[i].Outcome = outcome
+		}
+	}
+}
+
+// discardStaged removes staged files that were not committed
+func discardStaged(staged []stagedFile) {
+	for _, sf := range staged {
+		_ = os.Remove(sf.Path)
+	}
+}
+
+// commitStaged swaps all staged files into place. If a swap fails midway,
+// the files already swapped are restored from their backups so that the
+// install is left exactly as it was before the commit.
+func commitStaged(staged []stagedFile, logger *Logger) ([]ReplacedFile, error) {
+	replaced := make([]ReplacedFile, 0, len(staged))
+	for i, sf := range staged {
+		logger := logger.With("file", sf.File.Name)
+		logger.Info("replacing %s...", sf.File.Target)
+		backup, err := atomicReplace(sf.Path, sf.File.Target, logger)
+		if err != nil {
+			logger.Error("replace %s failed: %v, undoing %d committed file(s)", sf.File.Target, err, len(replaced))
+			discardStaged(staged[i:])
+			if rerr := restoreBackups(replaced, logger); rerr != nil {
+				return nil, fmt.Errorf("replace %s: %w (undo failed: %v)", sf.File.Target, err, rerr)
+			}
+			return nil, fmt.Errorf("replace %s: %w", sf.File.Target, err)
+		}
+		if backup != "" {
+			logger.Info("replaced %s (backup=%s)", sf.File.Target, backup)
+		} else {
+			logger.Info("replaced %s (no previous version)", sf.File.Target)
+		}
+		replaced = append(replaced, ReplacedFile{Target: sf.File.Target, Backup: backup})
+	}
+
+	// Partial downloads of superseded releases are no longer useful
+	keep := make(map[string]map[string]bool)
+	for _, sf := range staged {
+		dir := filepath.Dir(sf.File.Target)
+		if keep[dir] == nil {
+			keep[dir] = make(map[string]bool)
+		}
+		keep[dir][strings.ToLower(sf.File.SHA256)] = true
+	}
+	for dir, shas := range keep {
+		prunePartials(dir, shas)
+	}
+	return replaced, nil
+}
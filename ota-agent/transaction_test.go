@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failNthRename makes the nth call to renameFile fail, 0 for none, and
+// returns the number of calls made so far
+func failNthRename(t *testing.T, n int) func() int {
+	calls := 0
+	renameFile = func(from, to string) error {
+		calls++
+		if calls == n {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: errors.New("injected failure")}
+		}
+		return os.Rename(from, to)
+	}
+	t.Cleanup(func() { renameFile = os.Rename })
+	return func() int { return calls }
+}
+
+// readTree returns the content of every file below dir by relative path
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if d.Type()&fs.ModeSymlink != 0 {
+			dest, err := os.Readlink(path)
+			files[rel] = "-> " + dest
+			return err
+		}
+		b, err := os.ReadFile(path)
+		files[rel] = string(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCommitStagedRestoresOnFailure(t *testing.T) {
+	installed := map[string]string{"bin/app": "app 1", "lib/a.so": "a 1", "lib/b.so": "b 1"}
+	targets := []string{"bin/app", "lib/a.so", "lib/new.so", "lib/b.so"}
+	// setup installs the old release and stages the new one
+	setup := func(t *testing.T) (string, []stagedFile) {
+		dir := t.TempDir()
+		writeFiles(t, dir, installed)
+		var staged []stagedFile
+		for _, name := range targets {
+			target := filepath.Join(dir, name)
+			writeFiles(t, dir, map[string]string{filepath.Join(filepath.Dir(name), filepath.Base(stagedPath(target))): name + " 2"})
+			staged = append(staged, stagedFile{File: FileUpdate{Name: name, Target: target}, Path: stagedPath(target)})
+		}
+		return dir, staged
+	}
+
+	dir, staged := setup(t)
+	calls := failNthRename(t, 0)
+	if _, err := commitStaged(staged, discardLogger()); err != nil {
+		t.Fatalf("commitStaged: %v", err)
+	}
+	for _, name := range targets {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(b) != name+" 2" {
+			t.Fatalf("%s = %q, %v after commit", name, b, err)
+		}
+	}
+	renames := calls()
+
+	for n := 1; n <= renames; n++ {
+		dir, staged := setup(t)
+		failNthRename(t, n)
+		_, err := commitStaged(staged, discardLogger())
+		if err == nil || !strings.Contains(err.Error(), "injected failure") {
+			t.Fatalf("rename %d/%d failed: commitStaged error = %v", n, renames, err)
+		}
+		if got := readTree(t, dir); !maps.Equal(got, installed) {
+			t.Errorf("rename %d/%d failed: files = %q, want %q", n, renames, got, installed)
+		}
+	}
+}
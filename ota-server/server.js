@@ -17,7 +17,7 @@ if (!fs.existsSync(APPS_DIR)) {
 }
 
 // Agent 状态存储
-// 结构: { appName: { agentId: { id, ip, lastSeen, requestCount, currentVersion, localVersion, lastAction, userAgent } } }
+// 结构: { appName: { agentId: { id, ip, lastSeen, requestCount, currentVersion, localVersion, lastAction, userAgent, lastReport } } }
 const agentStatus = new Map();
 
 // 获取客户端 IP 地址
@@ -141,6 +141,16 @@ function getAppConfigFile(appName) {
   return path.join(getAppDir(appName), 'version.yaml');
 }
 
+// 获取应用某个发布版本的配置文件路径（清单索引中 versions 引用的 releases/<version>/version.yaml）
+function getAppReleaseConfigFile(appName, version) {
+  return path.join(getAppDir(appName), 'releases', version, 'version.yaml');
+}
+
+// 发布版本号只允许作为单个路径段
+function isValidReleaseVersion(version) {
+  return /^[0-9A-Za-z][0-9A-Za-z.+_-]*$/.test(version);
+}
+
 // 获取应用的文件目录
 function getAppBinaryDir(appName) {
   return path.join(getAppDir(appName), 'files');
@@ -273,8 +283,8 @@ function createServer() {
     
     // CORS 支持
     res.setHeader('Access-Control-Allow-Origin', '*');
-    res.setHeader('Access-Control-Allow-Methods', 'GET, OPTIONS');
-    res.setHeader('Access-Control-Allow-Headers', 'Content-Type');
+    res.setHeader('Access-Control-Allow-Methods', 'GET, POST, OPTIONS');
+    res.setHeader('Access-Control-Allow-Headers', 'Content-Type, X-Agent-ID');
     
     if (req.method === 'OPTIONS') {
       res.writeHead(200);
@@ -325,6 +335,59 @@ function createServer() {
       return;
     }
     
+    // 配置文件签名端点: /ota/<app_name>/version.yaml.sig
+    const sigMatch = url.pathname.match(/^\/ota\/([^\/]+)\/version\.yaml\.sig$/);
+    if (sigMatch) {
+      const appName = sigMatch[1];
+      const sigFile = getAppConfigFile(appName) + '.sig';
+      if (!fs.existsSync(sigFile)) {
+        res.writeHead(404, { 'Content-Type': 'text/plain' });
+        res.end(`Signature not found for app: ${appName}`);
+        return;
+      }
+      res.writeHead(200, {
+        'Content-Type': 'text/plain',
+        'Cache-Control': 'no-cache'
+      });
+      res.end(fs.readFileSync(sigFile, 'utf8'));
+      return;
+    }
+
+    // 发布版本配置端点: /ota/<app_name>/releases/<version>/version.yaml(.sig)
+    // 清单索引（/ota/<app_name>/version.yaml）中的 versions 相对索引地址引用这些配置
+    const releaseMatch = url.pathname.match(/^\/ota\/([^\/]+)\/releases\/([^\/]+)\/version\.yaml(\.sig)?$/);
+    if (releaseMatch) {
+      const appName = releaseMatch[1];
+      const version = releaseMatch[2];
+      const isSig = Boolean(releaseMatch[3]);
+      try {
+        if (!isValidReleaseVersion(version)) {
+          res.writeHead(400, { 'Content-Type': 'text/plain' });
+          res.end(`Invalid version: ${version}`);
+          return;
+        }
+        const configFile = getAppReleaseConfigFile(appName, version) + (isSig ? '.sig' : '');
+        if (!fs.existsSync(configFile)) {
+          res.writeHead(404, { 'Content-Type': 'text/plain' });
+          res.end(`${isSig ? 'Signature' : 'Config file'} not found for app: ${appName} version: ${version}`);
+          return;
+        }
+        if (!isSig) {
+          recordAgentStatus(appName, req, 'config_check', version);
+        }
+        res.writeHead(200, {
+          'Content-Type': isSig ? 'text/plain' : 'application/x-yaml',
+          'Cache-Control': 'no-cache'
+        });
+        res.end(fs.readFileSync(configFile, 'utf8'));
+      } catch (err) {
+        error('Error serving release %s for app %s: %s', version, appName, err.message);
+        res.writeHead(500, { 'Content-Type': 'text/plain' });
+        res.end('Internal Server Error');
+      }
+      return;
+    }
+
     // 向后兼容：旧格式 /version.yaml 和 /config
     if (url.pathname === '/version.yaml' || url.pathname === '/config') {
       try {
@@ -370,15 +433,42 @@ function createServer() {
         const stat = fs.statSync(binaryPath);
         const fileSize = stat.size;
         const actualFileName = path.basename(binaryPath);
+        const etag = `"${stat.size.toString(16)}-${stat.mtimeMs.toString(16)}"`;
         
-        res.writeHead(200, {
+        // 断点续传: 支持 Range / If-Range（仅支持 bytes=<start>- 和 bytes=<start>-<end>）
+        let start = 0;
+        let end = fileSize - 1;
+        let status = 200;
+        const range = req.headers['range'];
+        const ifRange = req.headers['if-range'];
+        const rangeMatch = range && range.match(/^bytes=(\d+)-(\d*)$/);
+        if (rangeMatch && (!ifRange || ifRange === etag)) {
+          start = parseInt(rangeMatch[1], 10);
+          if (rangeMatch[2]) {
+            end = Math.min(parseInt(rangeMatch[2], 10), fileSize - 1);
+          }
+          if (start >= fileSize || start > end) {
+            res.writeHead(416, { 'Content-Range': `bytes */${fileSize}` });
+            res.end();
+            return;
+          }
+          status = 206;
+        }
+        
+        const headers = {
           'Content-Type': 'application/octet-stream',
-          'Content-Length': fileSize,
+          'Content-Length': end - start + 1,
           'Content-Disposition': `attachment; filename="${actualFileName}"`,
-          'Cache-Control': 'no-cache'
-        });
+          'Cache-Control': 'no-cache',
+          'Accept-Ranges': 'bytes',
+          'ETag': etag
+        };
+        if (status === 206) {
+          headers['Content-Range'] = `bytes ${start}-${end}/${fileSize}`;
+        }
+        res.writeHead(status, headers);
         
-        const fileStream = fs.createReadStream(binaryPath);
+        const fileStream = fs.createReadStream(binaryPath, { start, end });
         fileStream.on('error', (err) => {
           error('Error streaming binary for app %s: %s', appName, err.message);
           if (!res.headersSent) {
@@ -396,6 +486,54 @@ function createServer() {
     }
     
     
+    // Agent 更新报告端点: POST /ota/<app_name>/report
+    const reportMatch = url.pathname.match(/^\/ota\/([^\/]+)\/report$/);
+    if (reportMatch) {
+      const appName = reportMatch[1];
+      if (req.method !== 'POST') {
+        res.writeHead(405, { 'Content-Type': 'text/plain', 'Allow': 'POST' });
+        res.end('Method Not Allowed');
+        return;
+      }
+      const chunks = [];
+      let size = 0;
+      req.on('data', (chunk) => {
+        size += chunk.length;
+        // 报告不应超过 1MB
+        if (size > 1024 * 1024) {
+          res.writeHead(413, { 'Content-Type': 'text/plain' });
+          res.end('Payload Too Large');
+          req.destroy();
+          return;
+        }
+        chunks.push(chunk);
+      });
+      req.on('end', () => {
+        if (res.writableEnded) {
+          return;
+        }
+        let report;
+        try {
+          report = JSON.parse(Buffer.concat(chunks).toString('utf8'));
+        } catch (err) {
+          res.writeHead(400, { 'Content-Type': 'text/plain' });
+          res.end('Invalid JSON');
+          return;
+        }
+        recordAgentStatus(appName, req, 'report', report.current_version || null);
+        const agent = agentStatus.get(appName).get(req.headers['x-agent-id'] || getClientIP(req));
+        agent.lastReport = report;
+        info('Report from %s for app %s: %s (%s -> %s)', agent.id, appName,
+          report.outcome, report.previous_version || '-', report.target_version || '-');
+        if (report.errors && report.errors.length > 0) {
+          warn('Report from %s for app %s has errors: %s', agent.id, appName, report.errors.join('; '));
+        }
+        res.writeHead(204);
+        res.end();
+      });
+      return;
+    }
+
     // Agent 状态端点: /ota/<app_name>/agents
     const agentsMatch = url.pathname.match(/^\/ota\/([^\/]+)\/agents$/);
     if (agentsMatch) {
@@ -450,9 +588,11 @@ function createServer() {
           },
           endpoints: {
             config: `/ota/${appName}/version.yaml`,
+            release: `/ota/${appName}/releases/<version>/version.yaml`,
             files: `/ota/${appName}/files/<filename>`,
             info: `/ota/${appName}/info`,
-            agents: `/ota/${appName}/agents`
+            agents: `/ota/${appName}/agents`,
+            report: `/ota/${appName}/report`
           }
         }, null, 2));
       } catch (err) {
@@ -492,6 +632,7 @@ function createServer() {
           apps: apps,
           endpoints: {
             config: '/ota/<app_name>/version.yaml',
+            release: '/ota/<app_name>/releases/<version>/version.yaml',
             files: '/ota/<app_name>/files/<filename>',
             info: '/ota/<app_name>/info',
             health: '/health'
@@ -530,6 +671,7 @@ function start() {
     info('');
     info('Endpoints:');
     info('  GET /ota/<app_name>/version.yaml  - Application configuration');
+    info('  GET /ota/<app_name>/releases/<v>/version.yaml - Release configuration');
     info('  GET /ota/<app_name>/files/<file>  - Application file download');
     info('  GET /ota/<app_name>/info           - Application information');
     info('  GET /ota/<app_name>/agents         - Agent status for application');
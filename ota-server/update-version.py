@@ -9,6 +9,7 @@ import argparse
 import hashlib
 import json
 import os
+import re
 import shutil
 import sys
 from datetime import datetime
@@ -47,8 +48,8 @@ def calculate_sha256(file_path):
     return sha256_hash.hexdigest()
 
 
-def copy_binary(source_path, app_name, apps_dir):
-    """复制文件到应用的二进制目录"""
+def copy_binary(source_path, app_name, apps_dir, subdir=None):
+    """复制文件到应用的二进制目录（subdir 为发布版本时放在 files/<version>/ 下）"""
     source = Path(source_path)
     if not source.exists():
         error(f'Binary file not found: {source_path}')
@@ -56,6 +57,8 @@ def copy_binary(source_path, app_name, apps_dir):
     # 确保应用目录结构存在: apps/<app_name>/files/
     app_dir = apps_dir / app_name
     app_binary_dir = app_dir / 'files'
+    if subdir:
+        app_binary_dir = app_binary_dir / subdir
     app_binary_dir.mkdir(parents=True, exist_ok=True)
     info(f'Created files directory for app {app_name}: {app_binary_dir}')
     
@@ -90,6 +93,41 @@ def generate_yaml_config(files, version, app_name, restart_cmd=None):
     return '\n'.join(yaml_lines) + '\n'
 
 
+def read_manifest_index(index_file):
+    """读取清单索引，返回 (channels, versions)；文件不存在或不是清单索引时返回空索引"""
+    channels, versions = {}, {}
+    if not index_file.exists():
+        return channels, versions
+    section = None
+    is_index = False
+    for line in index_file.read_text(encoding='utf-8').splitlines():
+        if not line.strip() or line.lstrip().startswith('#'):
+            continue
+        if not line.startswith(' '):
+            section = line.split(':', 1)[0].strip()
+            is_index = is_index or section == 'channels'
+            continue
+        key, _, value = line.strip().partition(':')
+        key, value = key.strip().strip('"\''), value.strip().strip('"\'')
+        if section == 'channels':
+            channels[key] = value
+        elif section == 'versions':
+            versions[key] = value
+    if not is_index:
+        info(f'{index_file} is a single version config, replacing it with a manifest index')
+        return {}, {}
+    return channels, versions
+
+
+def write_manifest_index(index_file, channels, versions):
+    """写入清单索引"""
+    lines = ['channels:']
+    lines += [f'  {name}: "{version}"' for name, version in sorted(channels.items())]
+    lines.append('versions:')
+    lines += [f'  "{version}": "{ref}"' for version, ref in sorted(versions.items())]
+    index_file.write_text('\n'.join(lines) + '\n', encoding='utf-8')
+
+
 def main():
     parser = argparse.ArgumentParser(
         description='OTA Version Update Script',
@@ -104,6 +142,10 @@ def main():
   # 使用 JSON 配置文件
   %(prog)s myapp 1.0.0 --config files.json
 
+  # 发布到通道：配置写入 releases/<版本>/version.yaml，
+  # version.yaml 成为清单索引，beta 通道指向该版本
+  %(prog)s myapp 1.3.0-beta.1 --file ./app:main:/usr/bin/app --channel beta
+
 JSON 配置文件格式:
   {
     "files": [
@@ -130,6 +172,8 @@ JSON 配置文件格式:
     parser.add_argument('-f', '--file', action='append', dest='files',
                        help='文件规格: path:name:target (例如: ./app:main:/usr/bin/app)')
     parser.add_argument('-c', '--config', help='JSON 配置文件路径（多文件配置）')
+    parser.add_argument('--channel', action='append', dest='channels',
+                       help='发布到该通道（可重复）：写入 releases/<版本>/version.yaml 并更新清单索引')
     
     args = parser.parse_args()
     
@@ -193,8 +237,9 @@ JSON 配置文件格式:
             error(f'File path is required for file: {file.get("name", "unknown")}')
         
         # 复制文件到应用目录
-        binary_path = copy_binary(file['path'], app_name, APPS_DIR)
-        file_name = binary_path.name
+        # 发布到通道时各版本的文件分开存放，索引中的旧版本仍可下载
+        binary_path = copy_binary(file['path'], app_name, APPS_DIR, version if args.channels else None)
+        file_name = binary_path.relative_to(APPS_DIR / app_name / 'files').as_posix()
         
         # 确定目标路径
         target_path = file.get('target')
@@ -224,8 +269,24 @@ JSON 配置文件格式:
         app_dir = APPS_DIR / app_name
         app_dir.mkdir(parents=True, exist_ok=True)
         config_file = app_dir / 'version.yaml'
-        config_file.write_text(yaml_content, encoding='utf-8')
-        info(f'Configuration updated: {config_file}')
+        if args.channels:
+            # 版本配置: apps/<app_name>/releases/<version>/version.yaml，
+            # apps/<app_name>/version.yaml 为清单索引
+            if not re.match(r'^[0-9A-Za-z][0-9A-Za-z.+_-]*$', version):
+                error(f'Invalid version for a release: {version}')
+            release_file = app_dir / 'releases' / version / 'version.yaml'
+            release_file.parent.mkdir(parents=True, exist_ok=True)
+            release_file.write_text(yaml_content, encoding='utf-8')
+            info(f'Release configuration written: {release_file}')
+            channels, versions = read_manifest_index(config_file)
+            versions[version] = f'releases/{version}/version.yaml'
+            for channel in args.channels:
+                channels[channel] = version
+            write_manifest_index(config_file, channels, versions)
+            info(f'Manifest index updated: {config_file}')
+        else:
+            config_file.write_text(yaml_content, encoding='utf-8')
+            info(f'Configuration updated: {config_file}')
         
         # 显示配置信息
         print('\n📋 Configuration:')
@@ -237,6 +298,10 @@ JSON 配置文件格式:
         if restart_cmd:
             print(f'  Restart Cmd: {restart_cmd}')
         print(f'\n📡 Config URL: {BASE_URL}/ota/{app_name}/version.yaml')
+        if args.channels:
+            print(f'  Channels:   {", ".join(args.channels)} -> {version}')
+            print(f'  Release:    {BASE_URL}/ota/{app_name}/releases/{version}/version.yaml')
+            print('  启用签名时需重新签名索引和版本配置（ota-agent sign 生成各自的 .sig）')
         print('\n✅ Version update completed successfully!')
         
     except Exception as e: